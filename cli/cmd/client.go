@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	controllerruntime "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+)
+
+// newClient creates the client of the commands run against the cluster of the current
+// kubeconfig, outside of the controller.
+func newClient() client.Client {
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to register Kubernetes objects: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := clonerv1alpha1.AddToScheme(scheme); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to register cloner objects: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := client.New(controllerruntime.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create client: %v\n", err)
+		os.Exit(1)
+	}
+
+	return c
+}
@@ -3,21 +3,76 @@ package cmd
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"time"
 
 	"github.com/impochi/cloner/cli/config"
+	"github.com/impochi/cloner/pkg/controller"
 	"github.com/impochi/cloner/pkg/manager"
+	"github.com/impochi/cloner/pkg/registry"
+	"github.com/impochi/cloner/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 )
 
+const (
+	defaultWebhookPort    = 9443
+	defaultWebhookTimeout = 8 * time.Second
+)
+
 var (
 	ignoreNamespaces     string
 	enableLeaderElection bool
+	platforms            string
+	namingScheme         string
+	registrySecret       string
+	replicaSecrets       string
+	backupPullSecret     string
+	mode                 string
+	workloadSelector     string
+	optIn                bool
+	dryRun               bool
+	copyWorkers          int
+	registryQPS          float64
+	registryBurst        int
+	layerParallelism     int
+	maxConcurrentCopies  int
+	bandwidthLimit       string
+	resyncPeriod         time.Duration
+	pinDigests           bool
+	sourceRules          string
+
+	enableWebhook        bool
+	webhookPort          int
+	webhookCertDir       string
+	webhookTimeout       time.Duration
+	webhookFailurePolicy string
+	validationMode       string
 )
 
 // Execute executes and initiates the cli flags, creates config.
 func Execute() {
-	flag.StringVar(&ignoreNamespaces, "ignore-namespaces", "kube-system", "Namespaces to ignore when cloning images")
-	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false, "Enable leader election")
+	if len(os.Args) > 1 && os.Args[1] == restoreCommand {
+		restore(os.Args[2:])
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == resyncReplicasCommand {
+		resyncReplicas(os.Args[2:])
+
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == migrateNamesCommand {
+		migrateNames(os.Args[2:])
+
+		return
+	}
+
+	bindFlags()
+	bindRegistryFlags()
+	bindWebhookFlags()
 
 	opts := zap.Options{}
 	opts.BindFlags(flag.CommandLine)
@@ -29,9 +84,208 @@ func Execute() {
 	// Create config
 	cfg := &config.Config{}
 
-	cfg.ParseIgnoreNamespaces(ignoreNamespaces)
 	cfg.Logger = logger
-	cfg.EnableLeaderElection = enableLeaderElection
+
+	if err := parseFlags(cfg); err != nil {
+		logger.Error(err, "invalid flags")
+		os.Exit(1)
+	}
 
 	manager.Run(cfg)
 }
+
+// bindFlags binds the flags of the controller.
+func bindFlags() {
+	flag.StringVar(&ignoreNamespaces, "ignore-namespaces", "kube-system", "Namespaces to ignore when cloning images")
+	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false, "Enable leader election")
+	flag.StringVar(&mode, "mode", string(controller.ModeClone),
+		"`clone` backs up the images of the workloads and rewrites them, `restore` puts back the original images "+
+			"of the workloads rewritten by the controller")
+	flag.StringVar(&workloadSelector, "workload-selector", "",
+		"Label selector of the workloads handled by the controller, e.g. `team=platform`, all by default")
+	flag.BoolVar(&optIn, "opt-in", false,
+		"Only handle the workloads annotated with cloner.impochi.io/enabled=true")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"Only report what would be done to the workloads through logs, events and metrics, without pushing any "+
+			"image nor updating the workloads")
+	flag.IntVar(&copyWorkers, "copy-workers", controller.DefaultCopyWorkers,
+		"Number of images backed up at the same time by the controller, in the background of the reconciliations")
+	flag.DurationVar(&resyncPeriod, "resync-period", 0,
+		"How often the original images of the rewritten workloads are checked for source tags moved upstream, "+
+			"e.g. `1h`, never by default")
+	flag.BoolVar(&pinDigests, "pin-digests", false,
+		"Rewrite the containers to the destination images pinned by the digest backed up, e.g. "+
+			"<destination>/nginx:1.21@sha256:..., so that the pods don't depend on the mutable destination tags")
+}
+
+// bindRegistryFlags binds the flags of the source and destination registries.
+func bindRegistryFlags() {
+	flag.StringVar(&platforms, "platforms", "",
+		"Platforms to back up for multi-architecture images, all by default. Format: "+
+			"`<image>=<os>/<arch>[/<variant>],...;...`, the image `*` applies to all images")
+	flag.StringVar(&namingScheme, "naming-scheme", string(registry.NamingSchemeFlat),
+		"How destination images are named, `flat` keeps only the last path segment of the source repository "+
+			"and `path` keeps the source registry host and full repository path")
+	flag.StringVar(&registrySecret, "registry-secret", "",
+		"`kubernetes.io/dockerconfigjson` or `kubernetes.io/basic-auth` Secret holding the credentials of the "+
+			"destination registry, as `<name>` or `<namespace>/<name>`, reloaded when it changes. The REGISTRY_* "+
+			"environment variables are used when empty")
+	flag.StringVar(&replicaSecrets, "replica-secrets", "",
+		"Comma separated Secrets holding the credentials of the replica registries, in the format of "+
+			"--registry-secret. The destination images are copied to the `<provider>/<username>` repository of "+
+			"each replica, the workloads keep using the destination registry")
+	flag.StringVar(&backupPullSecret, "backup-pull-secret", "",
+		"Secret holding pull-only credentials of the destination registry, in the format of --registry-secret, "+
+			"copied to the namespaces of the workloads using image pull secrets. Their image pull secrets are left "+
+			"untouched when empty, the credentials of --registry-secret are never copied")
+	flag.Float64Var(&registryQPS, "registry-qps", registry.DefaultRateLimit,
+		"Requests per second sent to each registry, a registry throttling the requests is not sent any "+
+			"request until its Retry-After delay is over")
+	flag.IntVar(&registryBurst, "registry-burst", registry.DefaultRateBurst,
+		"Requests sent at once to each registry")
+	flag.IntVar(&layerParallelism, "layer-parallelism", 0,
+		"Number of layers of an image transferred at the same time, all of them by default")
+	flag.IntVar(&maxConcurrentCopies, "max-concurrent-copies", 0,
+		"Number of images pushed at the same time across the controller, the mutating webhook and the replicas, "+
+			"unlimited by default")
+	flag.StringVar(&bandwidthLimit, "bandwidth-limit", "",
+		"Bytes per second transferred by all the copies together, e.g. `10Mi`, unlimited by default")
+	flag.StringVar(&sourceRules, "source-rules", "",
+		"Ordered rules deciding what is done with the source images, the first rule matching the source "+
+			"repository applies and the images matched by no rule are mirrored. Format: "+
+			"`<action>=<pattern>;...` with the actions mirror, skip and deny, the pattern being a glob matching "+
+			"the repository or its parents, e.g. quay.io, or a regular expression enclosed in slashes")
+}
+
+// bindWebhookFlags binds the flags of the admission webhooks.
+func bindWebhookFlags() {
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Serve the mutating admission webhook rewriting the images before the workloads are persisted")
+	flag.IntVar(&webhookPort, "webhook-port", defaultWebhookPort, "Port the admission webhook is served at")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "",
+		"Directory containing tls.crt and tls.key of the admission webhook, defaults to "+
+			"/tmp/k8s-webhook-server/serving-certs")
+	flag.DurationVar(&webhookTimeout, "webhook-timeout", defaultWebhookTimeout,
+		"Time given to the admission webhook to back up the images, must be lower than the timeout of "+
+			"the webhook configuration")
+	flag.StringVar(&webhookFailurePolicy, "webhook-failure-policy", string(webhook.FailurePolicyIgnore),
+		"What to do when the images can't be backed up within the webhook timeout, "+
+			"`Ignore` admits the workload unchanged and `Fail` rejects it")
+
+	flag.StringVar(&validationMode, "validation-mode", "",
+		"Serve the validating admission webhook checking that the workloads only use images of the destination "+
+			"registry, `enforce` rejects the other workloads and `audit` admits them with a warning. Disabled by default")
+}
+
+// parseFlags sets the config from the parsed flags.
+func parseFlags(cfg *config.Config) error {
+	cfg.ParseIgnoreNamespaces(ignoreNamespaces)
+	cfg.EnableLeaderElection = enableLeaderElection
+
+	var err error
+
+	cfg.Mode, err = controller.ParseMode(mode)
+	if err != nil {
+		return fmt.Errorf("invalid mode: %w", err)
+	}
+
+	if err := cfg.ParseWorkloadSelector(workloadSelector); err != nil {
+		return fmt.Errorf("invalid workload selector: %w", err)
+	}
+
+	cfg.OptIn = optIn
+	cfg.DryRun = dryRun
+
+	if copyWorkers < 1 {
+		return fmt.Errorf("invalid copy workers: must be at least 1, got %d", copyWorkers)
+	}
+
+	cfg.CopyWorkers = copyWorkers
+
+	if resyncPeriod < 0 {
+		return fmt.Errorf("invalid resync period: must not be negative, got %s", resyncPeriod)
+	}
+
+	cfg.ResyncPeriod = resyncPeriod
+	cfg.PinDigests = pinDigests
+
+	if err := parseRegistryFlags(cfg); err != nil {
+		return err
+	}
+
+	return parseWebhookFlags(cfg)
+}
+
+// parseRegistryFlags sets the registry config from the parsed flags.
+func parseRegistryFlags(cfg *config.Config) error {
+	var err error
+
+	if cfg.Platforms, err = registry.ParsePlatformFilter(platforms); err != nil {
+		return fmt.Errorf("invalid platforms: %w", err)
+	}
+
+	if cfg.NamingScheme, err = registry.ParseNamingScheme(namingScheme); err != nil {
+		return fmt.Errorf("invalid naming scheme: %w", err)
+	}
+
+	if err := cfg.ParseRegistrySecret(registrySecret); err != nil {
+		return fmt.Errorf("invalid registry secret: %w", err)
+	}
+
+	if err := cfg.ParseReplicaSecrets(replicaSecrets); err != nil {
+		return fmt.Errorf("invalid replica secrets: %w", err)
+	}
+
+	if err := cfg.ParseBackupPullSecret(backupPullSecret); err != nil {
+		return fmt.Errorf("invalid backup pull secret: %w", err)
+	}
+
+	if registryQPS <= 0 || registryBurst < 1 {
+		return fmt.Errorf("invalid registry rate limit: must be positive, got %v and %d", registryQPS, registryBurst)
+	}
+
+	cfg.RegistryQPS = registryQPS
+	cfg.RegistryBurst = registryBurst
+
+	if layerParallelism < 0 || maxConcurrentCopies < 0 {
+		return fmt.Errorf("invalid copy parallelism: must not be negative, got %d and %d",
+			layerParallelism, maxConcurrentCopies)
+	}
+
+	cfg.LayerParallelism = layerParallelism
+	cfg.MaxConcurrentCopies = maxConcurrentCopies
+
+	if err := cfg.ParseBandwidthLimit(bandwidthLimit); err != nil {
+		return fmt.Errorf("invalid bandwidth limit: %w", err)
+	}
+
+	if cfg.SourceRules, err = registry.ParseSourceRules(sourceRules); err != nil {
+		return fmt.Errorf("invalid source rules: %w", err)
+	}
+
+	return nil
+}
+
+// parseWebhookFlags sets the webhook config from the parsed flags.
+func parseWebhookFlags(cfg *config.Config) error {
+	failurePolicy, err := webhook.ParseFailurePolicy(webhookFailurePolicy)
+	if err != nil {
+		return fmt.Errorf("invalid webhook failure policy: %w", err)
+	}
+
+	validation, err := webhook.ParseValidationMode(validationMode)
+	if err != nil {
+		return fmt.Errorf("invalid validation mode: %w", err)
+	}
+
+	cfg.Webhook = config.WebhookConfig{
+		Enabled:        enableWebhook,
+		Port:           webhookPort,
+		CertDir:        webhookCertDir,
+		Timeout:        webhookTimeout,
+		FailurePolicy:  failurePolicy,
+		ValidationMode: validation,
+	}
+
+	return nil
+}
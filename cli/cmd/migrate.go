@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/impochi/cloner/cli/config"
+	"github.com/impochi/cloner/pkg/controller"
+	"github.com/impochi/cloner/pkg/registry"
+)
+
+const migrateNamesCommand = "migrate-names"
+
+// migrateNames executes the `migrate-names` command, moving the images of the rewritten workloads
+// to the names of another naming scheme.
+func migrateNames(args []string) {
+	flags := flag.NewFlagSet(migrateNamesCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]\n\n", os.Args[0], migrateNamesCommand)
+		fmt.Fprintf(flags.Output(), "Copies the images backed up with a naming scheme to the names of another "+
+			"naming scheme, and rewrites the workloads using them.\n\n")
+		flags.PrintDefaults()
+	}
+
+	var registrySecret, from, to string
+
+	opts := controller.MigrateOptions{}
+
+	flags.StringVar(&registrySecret, "registry-secret", "",
+		"Secret holding the credentials of the destination registry, as `<name>` or `<namespace>/<name>`. The "+
+			"REGISTRY_* environment variables are used when empty")
+	flags.StringVar(&from, "from", string(registry.NamingSchemeFlat), "Naming scheme the images were backed up with")
+	flags.StringVar(&to, "to", string(registry.NamingSchemePath), "Naming scheme the images are moved to")
+	flags.StringVar(&opts.Namespace, "namespace", "", "Only migrate the workloads of this namespace")
+	flags.StringVar(&opts.Kind, "kind", "", "Only migrate the workloads of this kind, e.g. `Deployment`")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Only print the changes, without copying any image")
+
+	// ExitOnError.
+	_ = flags.Parse(args)
+
+	cfg := &config.Config{}
+
+	if err := cfg.ParseRegistrySecret(registrySecret); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	opts.RegistrySecret = cfg.RegistrySecret
+
+	var err error
+
+	if opts.From, err = registry.ParseNamingScheme(from); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --from: %v\n", err)
+		os.Exit(1)
+	}
+
+	if opts.To, err = registry.ParseNamingScheme(to); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid --to: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := controller.MigrateNames(context.Background(), newClient(), opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to migrate names: %v\n", err)
+		os.Exit(1)
+	}
+}
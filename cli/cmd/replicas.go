@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/impochi/cloner/cli/config"
+	"github.com/impochi/cloner/pkg/controller"
+)
+
+const resyncReplicasCommand = "resync-replicas"
+
+// resyncReplicas executes the `resync-replicas` command, copying the destination images to the
+// replica registries which fell behind.
+func resyncReplicas(args []string) {
+	flags := flag.NewFlagSet(resyncReplicasCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]\n\n", os.Args[0], resyncReplicasCommand)
+		fmt.Fprintf(flags.Output(), "Copies the destination images recorded by the ImageMirrors to the replica "+
+			"registries missing them or holding outdated copies.\n\n")
+		flags.PrintDefaults()
+	}
+
+	var registrySecret, replicaSecrets string
+
+	opts := controller.ReplicaOptions{}
+
+	flags.StringVar(&registrySecret, "registry-secret", "",
+		"Secret holding the credentials of the destination registry, as `<name>` or `<namespace>/<name>`. The "+
+			"REGISTRY_* environment variables are used when empty")
+	flags.StringVar(&replicaSecrets, "replica-secrets", "",
+		"Comma separated Secrets holding the credentials of the replica registries, as for the controller")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Only print the replicas behind, without copying any image")
+
+	// ExitOnError.
+	_ = flags.Parse(args)
+
+	cfg := &config.Config{}
+
+	if err := cfg.ParseRegistrySecret(registrySecret); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.ParseReplicaSecrets(replicaSecrets); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	opts.RegistrySecret = cfg.RegistrySecret
+	opts.ReplicaSecrets = cfg.ReplicaSecrets
+
+	if err := controller.ResyncReplicas(context.Background(), newClient(), opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to resync replicas: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/impochi/cloner/pkg/controller"
+)
+
+const restoreCommand = "restore"
+
+// restore executes the `restore` command, putting back the original images of the workloads
+// rewritten by the controller.
+func restore(args []string) {
+	flags := flag.NewFlagSet(restoreCommand, flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s [flags]\n\n", os.Args[0], restoreCommand)
+		fmt.Fprintf(flags.Output(), "Puts back the original images of the workloads rewritten by the controller.\n\n")
+		flags.PrintDefaults()
+	}
+
+	opts := controller.RestoreOptions{}
+
+	flags.StringVar(&opts.Namespace, "namespace", "", "Only restore the workloads of this namespace, all by default")
+	flags.StringVar(&opts.Kind, "kind", "", "Only restore the workloads of this kind, e.g. `Deployment`, all by default")
+	flags.StringVar(&opts.Name, "name", "", "Only restore the workload of this name, requires --namespace and --kind")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "Only print the changes, without updating the workloads")
+
+	// ExitOnError.
+	_ = flags.Parse(args)
+
+	if err := controller.Restore(context.Background(), newClient(), opts, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to restore workloads: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -2,10 +2,19 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/impochi/cloner/pkg/controller"
+	"github.com/impochi/cloner/pkg/registry"
+	"github.com/impochi/cloner/pkg/webhook"
 )
 
 // Config represents the configuration for the controller.
@@ -13,6 +22,59 @@ type Config struct {
 	IgnoreNamespaces     []string
 	EnableLeaderElection bool
 	Logger               logr.Logger
+	Webhook              WebhookConfig
+	Platforms            registry.PlatformFilter
+	NamingScheme         registry.NamingScheme
+	// RegistrySecret is the Secret holding the credentials of the destination registry, nil
+	// when they are read from the REGISTRY_* environment variables.
+	RegistrySecret *types.NamespacedName
+	// ReplicaSecrets are the Secrets holding the credentials of the replica registries, the
+	// destination images being copied to each of them.
+	ReplicaSecrets []types.NamespacedName
+	// BackupPullSecret is the Secret holding the pull-only credentials of the destination
+	// registry, copied to the namespaces of the workloads using image pull secrets. Their image
+	// pull secrets are left untouched when nil.
+	BackupPullSecret *types.NamespacedName
+	Mode             controller.Mode
+	// WorkloadSelector selects the workloads handled by their labels, all of them when nil.
+	WorkloadSelector labels.Selector
+	// OptIn only handles the workloads annotated with controller.AnnotationEnabled.
+	OptIn bool
+	// DryRun only reports what would be done to the workloads, leaving the registries and
+	// workloads untouched.
+	DryRun bool
+	// CopyWorkers is the number of images backed up at the same time by the controller.
+	CopyWorkers int
+	// RegistryQPS and RegistryBurst limit the requests sent to each registry.
+	RegistryQPS   float64
+	RegistryBurst int
+	// LayerParallelism is the number of layers of an image transferred at the same time, all
+	// of them when zero.
+	LayerParallelism int
+	// MaxConcurrentCopies is the number of images pushed at the same time, by the controller,
+	// the mutating webhook and the replicas, unlimited when zero.
+	MaxConcurrentCopies int
+	// BandwidthLimit is the number of bytes per second transferred by all the copies,
+	// unlimited when zero.
+	BandwidthLimit int64
+	// ResyncPeriod is how often the rewritten workloads are checked for source tags moved
+	// upstream, never when zero.
+	ResyncPeriod time.Duration
+	// PinDigests rewrites the containers to the destination images pinned by digest.
+	PinDigests bool
+	// SourceRules decide whether the source images are mirrored, skipped or denied.
+	SourceRules registry.SourceRules
+}
+
+// WebhookConfig represents the configuration of the mutating admission webhook.
+type WebhookConfig struct {
+	Enabled       bool
+	Port          int
+	CertDir       string
+	Timeout       time.Duration
+	FailurePolicy webhook.FailurePolicy
+	// ValidationMode is the mode of the validating webhook, disabled when empty.
+	ValidationMode webhook.ValidationMode
 }
 
 // ParseIgnoreNamespaces parses the namespaces string provided by the user
@@ -45,3 +107,125 @@ func (c *Config) ParseIgnoreNamespaces(namespaces string) {
 
 	c.IgnoreNamespaces = ignoredNamespaces
 }
+
+// ParseRegistrySecret parses the Secret holding the credentials of the destination registry,
+// either `<name>` or `<namespace>/<name>`. The namespace defaults to CONTROLLER_NAMESPACE.
+func (c *Config) ParseRegistrySecret(secret string) error {
+	secret = strings.TrimSpace(secret)
+	if len(secret) == 0 {
+		c.RegistrySecret = nil
+
+		return nil
+	}
+
+	namespacedName, err := parseSecret(secret)
+	if err != nil {
+		return fmt.Errorf("invalid registry secret: %w", err)
+	}
+
+	c.RegistrySecret = &namespacedName
+
+	return nil
+}
+
+// ParseBackupPullSecret parses the Secret holding the pull-only credentials of the
+// destination registry, in the format of ParseRegistrySecret.
+func (c *Config) ParseBackupPullSecret(secret string) error {
+	secret = strings.TrimSpace(secret)
+	if len(secret) == 0 {
+		c.BackupPullSecret = nil
+
+		return nil
+	}
+
+	namespacedName, err := parseSecret(secret)
+	if err != nil {
+		return fmt.Errorf("invalid backup pull secret: %w", err)
+	}
+
+	c.BackupPullSecret = &namespacedName
+
+	return nil
+}
+
+// ParseReplicaSecrets parses the comma separated Secrets holding the credentials of the
+// replica registries, in the format of ParseRegistrySecret.
+func (c *Config) ParseReplicaSecrets(secrets string) error {
+	c.ReplicaSecrets = nil
+
+	for _, secret := range strings.Split(secrets, ",") {
+		secret = strings.TrimSpace(secret)
+		if len(secret) == 0 {
+			continue
+		}
+
+		namespacedName, err := parseSecret(secret)
+		if err != nil {
+			return fmt.Errorf("invalid replica secret: %w", err)
+		}
+
+		c.ReplicaSecrets = append(c.ReplicaSecrets, namespacedName)
+	}
+
+	return nil
+}
+
+func parseSecret(secret string) (types.NamespacedName, error) {
+	namespacedName := types.NamespacedName{Namespace: os.Getenv("CONTROLLER_NAMESPACE"), Name: secret}
+
+	if index := strings.Index(secret, "/"); index != -1 {
+		namespacedName = types.NamespacedName{Namespace: secret[:index], Name: secret[index+1:]}
+	}
+
+	if len(namespacedName.Namespace) == 0 || len(namespacedName.Name) == 0 ||
+		strings.Contains(namespacedName.Name, "/") {
+		return namespacedName, fmt.Errorf("%q must be `<name>` or `<namespace>/<name>`", secret)
+	}
+
+	return namespacedName, nil
+}
+
+// ParseWorkloadSelector parses the label selector of the workloads handled, e.g.
+// `team=platform,tier!=test`. All the workloads are selected when empty.
+func (c *Config) ParseWorkloadSelector(selector string) error {
+	selector = strings.TrimSpace(selector)
+	if len(selector) == 0 {
+		c.WorkloadSelector = nil
+
+		return nil
+	}
+
+	s, err := labels.Parse(selector)
+	if err != nil {
+		return fmt.Errorf("invalid workload selector %q: %w", selector, err)
+	}
+
+	c.WorkloadSelector = s
+
+	return nil
+}
+
+// ParseBandwidthLimit parses the bytes per second transferred by all the copies, e.g. `10Mi`
+// or `500k`. The transfers are not limited when empty or zero.
+func (c *Config) ParseBandwidthLimit(limit string) error {
+	limit = strings.TrimSpace(limit)
+	if len(limit) == 0 {
+		c.BandwidthLimit = 0
+
+		return nil
+	}
+
+	quantity, err := resource.ParseQuantity(limit)
+	if err != nil {
+		return fmt.Errorf("invalid bandwidth limit %q: %w", limit, err)
+	}
+
+	bytesPerSecond, ok := quantity.AsInt64()
+	if !ok || bytesPerSecond < 0 {
+		return fmt.Errorf("invalid bandwidth limit %q, must be a positive number of bytes per second", limit)
+	}
+
+	c.BandwidthLimit = bytesPerSecond
+
+	return nil
+}
@@ -48,6 +48,199 @@ func TestParseIgnoreNamespaces(t *testing.T) {
 	}
 }
 
+func TestParseRegistrySecret(t *testing.T) {
+	if err := os.Setenv("CONTROLLER_NAMESPACE", testNamespace); err != nil {
+		t.Fatalf("Failed to set env variable `CONTROLLER_NAMESPACE`")
+	}
+
+	cases := []struct {
+		secret  string
+		wanted  string
+		isError bool
+	}{
+		{
+			secret: "",
+			wanted: "",
+		},
+		{
+			secret: "registry",
+			wanted: testNamespace + "/registry",
+		},
+		{
+			secret: "other/registry",
+			wanted: "other/registry",
+		},
+		{
+			secret:  "/registry",
+			isError: true,
+		},
+		{
+			secret:  "other/registry/extra",
+			isError: true,
+		},
+	}
+
+	for _, test := range cases {
+		cfg := &config.Config{}
+
+		err := cfg.ParseRegistrySecret(test.secret)
+		if test.isError {
+			if err == nil {
+				t.Errorf("%q: expected error", test.secret)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.secret, err)
+		}
+
+		got := ""
+		if cfg.RegistrySecret != nil {
+			got = cfg.RegistrySecret.String()
+		}
+
+		if got != test.wanted {
+			t.Errorf("%q: expected %q, got %q", test.secret, test.wanted, got)
+		}
+	}
+}
+
+func TestParseReplicaSecrets(t *testing.T) {
+	if err := os.Setenv("CONTROLLER_NAMESPACE", testNamespace); err != nil {
+		t.Fatalf("Failed to set env variable `CONTROLLER_NAMESPACE`")
+	}
+
+	cfg := &config.Config{}
+
+	if err := cfg.ParseReplicaSecrets(" eu-registry, other/us-registry,"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	wanted := []string{testNamespace + "/eu-registry", "other/us-registry"}
+	if len(cfg.ReplicaSecrets) != len(wanted) {
+		t.Fatalf("expected %v, got %v", wanted, cfg.ReplicaSecrets)
+	}
+
+	for i, secret := range cfg.ReplicaSecrets {
+		if secret.String() != wanted[i] {
+			t.Errorf("expected %q, got %q", wanted[i], secret.String())
+		}
+	}
+
+	if err := cfg.ParseReplicaSecrets("eu-registry,/us-registry"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestParseBackupPullSecret(t *testing.T) {
+	if err := os.Setenv("CONTROLLER_NAMESPACE", testNamespace); err != nil {
+		t.Fatalf("Failed to set env variable `CONTROLLER_NAMESPACE`")
+	}
+
+	cfg := &config.Config{}
+
+	if err := cfg.ParseBackupPullSecret("pull-registry"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.BackupPullSecret == nil || cfg.BackupPullSecret.String() != testNamespace+"/pull-registry" {
+		t.Errorf("expected %q, got %v", testNamespace+"/pull-registry", cfg.BackupPullSecret)
+	}
+
+	if err := cfg.ParseBackupPullSecret(" "); err != nil || cfg.BackupPullSecret != nil {
+		t.Errorf("expected no backup pull secret, got %v (%v)", cfg.BackupPullSecret, err)
+	}
+
+	if err := cfg.ParseBackupPullSecret("/pull-registry"); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestParseBandwidthLimit(t *testing.T) {
+	cases := []struct {
+		limit   string
+		wanted  int64
+		isError bool
+	}{
+		{limit: "", wanted: 0},
+		{limit: "10Mi", wanted: 10 * 1024 * 1024},
+		{limit: "500k", wanted: 500000},
+		{limit: "1048576", wanted: 1048576},
+		{limit: "-1Mi", isError: true},
+		{limit: "fast", isError: true},
+	}
+
+	for _, test := range cases {
+		cfg := &config.Config{}
+
+		err := cfg.ParseBandwidthLimit(test.limit)
+		if test.isError {
+			if err == nil {
+				t.Errorf("%q: expected error", test.limit)
+			}
+
+			continue
+		}
+
+		if err != nil || cfg.BandwidthLimit != test.wanted {
+			t.Errorf("%q: expected %d, got %d (%v)", test.limit, test.wanted, cfg.BandwidthLimit, err)
+		}
+	}
+}
+
+func TestParseWorkloadSelector(t *testing.T) {
+	cases := []struct {
+		selector string
+		wanted   string
+		isError  bool
+	}{
+		{
+			selector: " ",
+			wanted:   "",
+		},
+		{
+			selector: "team=platform,tier!=test",
+			wanted:   "team=platform,tier!=test",
+		},
+		{
+			selector: "team in (platform,infra)",
+			wanted:   "team in (infra,platform)",
+		},
+		{
+			selector: "team in platform",
+			isError:  true,
+		},
+	}
+
+	for _, test := range cases {
+		cfg := &config.Config{}
+
+		err := cfg.ParseWorkloadSelector(test.selector)
+		if test.isError {
+			if err == nil {
+				t.Errorf("%q: expected error", test.selector)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", test.selector, err)
+		}
+
+		got := ""
+		if cfg.WorkloadSelector != nil {
+			got = cfg.WorkloadSelector.String()
+		}
+
+		if got != test.wanted {
+			t.Errorf("%q: expected %q, got %q", test.selector, test.wanted, got)
+		}
+	}
+}
+
 func areEqual(first, second []string) bool {
 	if len(first) != len(second) {
 		return false
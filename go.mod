@@ -5,6 +5,9 @@ go 1.16
 require (
 	github.com/go-logr/logr v0.3.0
 	github.com/google/go-containerregistry v0.4.1
+	github.com/prometheus/client_golang v1.7.1
+	github.com/prometheus/client_model v0.2.0
+	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
 	k8s.io/api v0.20.2
 	k8s.io/apimachinery v0.20.2
 	k8s.io/client-go v0.20.2
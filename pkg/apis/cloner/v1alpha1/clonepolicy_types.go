@@ -0,0 +1,136 @@
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CloneMode defines what is done with the workloads whose images are backed up.
+type CloneMode string
+
+const (
+	// CloneModeRewrite backs up the images and points the workloads to the destination
+	// images. This is the default.
+	CloneModeRewrite CloneMode = "Rewrite"
+	// CloneModeMirrorOnly backs up the images but leaves the workloads untouched.
+	CloneModeMirrorOnly CloneMode = "MirrorOnly"
+)
+
+// TagUpdatePolicy decides what happens to a backed up tag when the source tag moves to another
+// image upstream.
+type TagUpdatePolicy string
+
+const (
+	// TagUpdatesFollow backs up the new source image, the backed up tag following the source
+	// tag. This is the default.
+	TagUpdatesFollow TagUpdatePolicy = "Follow"
+	// TagUpdatesFreeze keeps the backed up tag on the image it was first backed up from.
+	TagUpdatesFreeze TagUpdatePolicy = "Freeze"
+)
+
+// ClonePolicySpec defines how the images of the selected workloads are cloned. The settings
+// which are not set fall back to the flags and environment variables of the controller.
+type ClonePolicySpec struct {
+	// Selector selects the workloads by their labels, all the workloads when not set.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Destination overrides the repository the images are backed up into.
+	// +optional
+	Destination *Destination `json:"destination,omitempty"`
+
+	// Sources restricts the source images being backed up.
+	// +optional
+	Sources *Sources `json:"sources,omitempty"`
+
+	// Mode is either Rewrite or MirrorOnly, Rewrite by default.
+	// +optional
+	// +kubebuilder:validation:Enum=Rewrite;MirrorOnly
+	Mode CloneMode `json:"mode,omitempty"`
+
+	// TagUpdates is either Follow or Freeze, Follow by default. It decides whether the tags
+	// of the rewritten workloads follow the source tags when the controller resyncs them.
+	// +optional
+	// +kubebuilder:validation:Enum=Follow;Freeze
+	TagUpdates TagUpdatePolicy `json:"tagUpdates,omitempty"`
+}
+
+// Destination is the repository the images are backed up into.
+type Destination struct {
+	// Repository is the registry and prefix of the destination images, e.g. `quay.io/team`.
+	Repository string `json:"repository"`
+
+	// CredentialsSecretRef is a `kubernetes.io/dockerconfigjson` or `kubernetes.io/basic-auth`
+	// Secret holding the credentials of the destination registry. The credentials of the
+	// controller are used when not set. The Secrets of a ClonePolicy are always read from its
+	// own namespace.
+	// +optional
+	CredentialsSecretRef *corev1.SecretReference `json:"credentialsSecretRef,omitempty"`
+}
+
+// Sources restricts the source images being backed up with patterns matched against the
+// source repository, e.g. `docker.io/library/nginx`. A pattern matches the repository or any
+// of its parents, so `quay.io` matches all the images of quay.io. The patterns support the
+// wildcards of path.Match, `*` not matching `/`.
+type Sources struct {
+	// Include are the patterns of the images being backed up, all the images when empty.
+	// +optional
+	Include []string `json:"include,omitempty"`
+
+	// Exclude are the patterns of the images which are not backed up, taking precedence
+	// over Include.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClonePolicy configures how the images of the workloads of its namespace are cloned. It
+// takes precedence over the ClusterClonePolicies.
+type ClonePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ClonePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClonePolicyList contains a list of ClonePolicy.
+type ClonePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClonePolicy `json:"items"`
+}
+
+// ClusterClonePolicySpec defines how the images of the selected workloads of the selected
+// namespaces are cloned.
+type ClusterClonePolicySpec struct {
+	// NamespaceSelector selects the namespaces by their labels, all the namespaces when not
+	// set.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	ClonePolicySpec `json:",inline"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// ClusterClonePolicy configures how the images of the workloads of the selected namespaces
+// are cloned.
+type ClusterClonePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ClusterClonePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterClonePolicyList contains a list of ClusterClonePolicy.
+type ClusterClonePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterClonePolicy `json:"items"`
+}
@@ -0,0 +1,25 @@
+// Package v1alpha1 contains the v1alpha1 API of the cloner.impochi.io group, configuring how
+// the images of the workloads are cloned.
+// +kubebuilder:object:generate=true
+// +groupName=cloner.impochi.io
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupVersion is the group version of the objects of this package.
+	GroupVersion = schema.GroupVersion{Group: "cloner.impochi.io", Version: "v1alpha1"}
+
+	// SchemeBuilder registers the objects of this package.
+	SchemeBuilder = (&scheme.Builder{GroupVersion: GroupVersion}).Register(
+		&ClonePolicy{}, &ClonePolicyList{},
+		&ClusterClonePolicy{}, &ClusterClonePolicyList{},
+		&ImageMirror{}, &ImageMirrorList{},
+	)
+
+	// AddToScheme adds the objects of this package to a scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
@@ -0,0 +1,106 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ImageMirrorReady is the condition of an ImageMirror whose destination image is up to
+	// date with the source image.
+	ImageMirrorReady = "Ready"
+
+	// ReasonBackedUp is the reason of the Ready condition of a backed up image.
+	ReasonBackedUp = "BackedUp"
+	// ReasonBackupFailed is the reason of the Ready condition of an image which couldn't be
+	// backed up, the message of the condition being the error.
+	ReasonBackupFailed = "BackupFailed"
+)
+
+// ImageMirrorSpec is the source image and its destination image.
+type ImageMirrorSpec struct {
+	// Source is the image the workloads were using, e.g. `nginx:1.21`.
+	Source string `json:"source"`
+	// Destination is the image it is backed up as, e.g. `quay.io/foo/nginx:1.21`.
+	Destination string `json:"destination"`
+}
+
+// WorkloadReference references a workload using the source image.
+type WorkloadReference struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// ImageMirrorStatus is the state of the destination image.
+type ImageMirrorStatus struct {
+	// SourceDigest is the digest of the source image when it was last backed up.
+	// +optional
+	SourceDigest string `json:"sourceDigest,omitempty"`
+
+	// DestinationDigest is the digest of the destination image. It differs from the
+	// SourceDigest when only some platforms of a multi-architecture image are backed up.
+	// +optional
+	DestinationDigest string `json:"destinationDigest,omitempty"`
+
+	// Platforms are the platforms backed up of a multi-architecture image.
+	// +optional
+	Platforms []string `json:"platforms,omitempty"`
+
+	// LastSyncTime is the last time the image was backed up.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Workloads are the workloads the image was backed up for.
+	// +optional
+	Workloads []WorkloadReference `json:"workloads,omitempty"`
+
+	// Conditions are the conditions of the ImageMirror, the Ready condition being false when
+	// the image couldn't be backed up.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Replicas are the copies of the destination image in the replica registries.
+	// +optional
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+}
+
+// ReplicaStatus is the state of the copy of the destination image in a replica registry.
+type ReplicaStatus struct {
+	// Image is the copy of the destination image, e.g. `eu.quay.io/foo/nginx:1.21`.
+	Image string `json:"image"`
+
+	// Digest is the digest of the image last copied. The replica is behind when it differs
+	// from the DestinationDigest.
+	// +optional
+	Digest string `json:"digest,omitempty"`
+
+	// LastSyncTime is the last time the image was copied.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// Error is the error of the last copy, empty when it succeeded.
+	// +optional
+	Error string `json:"error,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+
+// ImageMirror records an image backed up by the controller.
+type ImageMirror struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ImageMirrorSpec   `json:"spec,omitempty"`
+	Status ImageMirrorStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ImageMirrorList contains a list of ImageMirror.
+type ImageMirrorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ImageMirror `json:"items"`
+}
@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+const (
+	// AnnotationOriginalImages holds the images of the containers before they were rewritten,
+	// as a JSON object keyed by container name.
+	AnnotationOriginalImages = "cloner.impochi.io/original-images"
+	// AnnotationMirrorDigests holds the digests of the destination images of the rewritten
+	// containers, as a JSON object keyed by container name.
+	AnnotationMirrorDigests = "cloner.impochi.io/mirror-digests"
+	// AnnotationMirrorImages holds the destination images the containers were rewritten to,
+	// without their digest, as a JSON object keyed by container name.
+	AnnotationMirrorImages = "cloner.impochi.io/mirror-images"
+	// AnnotationLastCloned holds the last time the images of the object were rewritten, in
+	// RFC 3339 format.
+	AnnotationLastCloned = "cloner.impochi.io/last-cloned"
+	// AnnotationOriginalPullSecrets holds the names of the image pull secrets of the pod
+	// template before they were replaced by the BackupPullSecretName Secret, as a JSON array.
+	AnnotationOriginalPullSecrets = "cloner.impochi.io/original-image-pull-secrets"
+)
+
+// BackedUpImage is the image of a container which was backed up.
+type BackedUpImage struct {
+	// Container is the name of the container.
+	Container string
+	// Source is the image of the container before it was rewritten.
+	Source string
+	// Destination is the image the container was rewritten to.
+	Destination string
+	// SourceDigest and Digest are the digests of the source and destination images, empty
+	// when they couldn't be fetched.
+	SourceDigest string
+	Digest       string
+}
+
+// ContainerImage returns the image the container is rewritten to, the destination image
+// pinned by its digest when pinDigest is set, e.g. `<destination>/nginx:1.21@sha256:...`, so
+// that the pods don't depend on the mutable tags of the destination. The destination image is
+// returned as is when its digest is unknown.
+func (i *BackedUpImage) ContainerImage(pinDigest bool) string {
+	if !pinDigest || len(i.Digest) == 0 {
+		return i.Destination
+	}
+
+	pinned, err := pkgregistry.PinDigest(i.Destination, i.Digest)
+	if err != nil {
+		return i.Destination
+	}
+
+	return pinned
+}
+
+// AnnotateRewrite stamps the annotations of the rewritten images on the object. The original
+// image of a container is kept when its source image was the mirror of the original image,
+// e.g. when the images are backed up again into another destination.
+func AnnotateRewrite(obj client.Object, images []BackedUpImage, now time.Time) error {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	originals, err := annotationMap(annotations, AnnotationOriginalImages)
+	if err != nil {
+		return err
+	}
+
+	digests, err := annotationMap(annotations, AnnotationMirrorDigests)
+	if err != nil {
+		return err
+	}
+
+	mirrors, err := annotationMap(annotations, AnnotationMirrorImages)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		mirrored := len(image.SourceDigest) != 0 && digests[image.Container] == image.SourceDigest
+		if _, ok := originals[image.Container]; !ok || !mirrored {
+			originals[image.Container] = image.Source
+		}
+
+		digests[image.Container] = image.Digest
+		mirrors[image.Container] = image.Destination
+	}
+
+	for key, value := range map[string]map[string]string{
+		AnnotationOriginalImages: originals,
+		AnnotationMirrorDigests:  digests,
+		AnnotationMirrorImages:   mirrors,
+	} {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		annotations[key] = string(data)
+	}
+
+	annotations[AnnotationLastCloned] = now.UTC().Format(time.RFC3339)
+
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+// AnnotatePullSecrets stamps the image pull secrets of the pod template on the object before
+// they are replaced by the BackupPullSecretName Secret. The original image pull secrets are
+// kept when they were already replaced.
+func AnnotatePullSecrets(obj client.Object, template *corev1.PodTemplateSpec) error {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	if _, ok := annotations[AnnotationOriginalPullSecrets]; ok && isBackupPullSecret(template.Spec.ImagePullSecrets) {
+		return nil
+	}
+
+	secrets := []string{}
+	for _, secret := range template.Spec.ImagePullSecrets {
+		secrets = append(secrets, secret.Name)
+	}
+
+	data, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	annotations[AnnotationOriginalPullSecrets] = string(data)
+
+	obj.SetAnnotations(annotations)
+
+	return nil
+}
+
+// originalPullSecrets returns the image pull secrets stamped by AnnotatePullSecrets, and
+// whether they were stamped.
+func originalPullSecrets(annotations map[string]string) ([]string, bool, error) {
+	value, ok := annotations[AnnotationOriginalPullSecrets]
+	if !ok {
+		return nil, false, nil
+	}
+
+	secrets := []string{}
+	if err := json.Unmarshal([]byte(value), &secrets); err != nil {
+		return nil, false, fmt.Errorf("invalid annotation %q: %w", AnnotationOriginalPullSecrets, err)
+	}
+
+	return secrets, true, nil
+}
+
+func isBackupPullSecret(secrets []corev1.LocalObjectReference) bool {
+	return len(secrets) == 1 && secrets[0].Name == BackupPullSecretName
+}
+
+func annotationMap(annotations map[string]string, key string) (map[string]string, error) {
+	values := map[string]string{}
+
+	value, ok := annotations[key]
+	if !ok {
+		return values, nil
+	}
+
+	if err := json.Unmarshal([]byte(value), &values); err != nil {
+		return nil, fmt.Errorf("invalid annotation %q: %w", key, err)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,105 @@
+package controller_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+
+	"github.com/impochi/cloner/pkg/controller"
+)
+
+//nolint:funlen
+func TestAnnotateRewrite(t *testing.T) {
+	deployment := &appsv1.Deployment{}
+	now := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	if err := controller.AnnotateRewrite(deployment, []controller.BackedUpImage{
+		{
+			Container:    "nginx",
+			Source:       "nginx:1.21",
+			Destination:  "quay.io/foo/nginx:1.21",
+			SourceDigest: "sha256:a",
+			Digest:       "sha256:a",
+		},
+		{
+			Container:    "sidecar",
+			Source:       "busybox",
+			Destination:  "quay.io/foo/busybox",
+			SourceDigest: "sha256:b",
+			Digest:       "sha256:b",
+		},
+	}, now); err != nil {
+		t.Fatalf("failed to annotate: %v", err)
+	}
+
+	// nginx is backed up again into another destination, sidecar changed image.
+	if err := controller.AnnotateRewrite(deployment, []controller.BackedUpImage{
+		{
+			Container:    "nginx",
+			Source:       "quay.io/foo/nginx:1.21",
+			Destination:  "quay.io/bar/nginx:1.21",
+			SourceDigest: "sha256:a",
+			Digest:       "sha256:a",
+		},
+		{
+			Container:    "sidecar",
+			Source:       "alpine",
+			Destination:  "quay.io/bar/alpine",
+			SourceDigest: "sha256:c",
+			Digest:       "sha256:c",
+		},
+	}, now); err != nil {
+		t.Fatalf("failed to annotate: %v", err)
+	}
+
+	annotations := deployment.GetAnnotations()
+
+	originals := map[string]string{}
+	if err := json.Unmarshal([]byte(annotations[controller.AnnotationOriginalImages]), &originals); err != nil {
+		t.Fatalf("invalid original images annotation: %v", err)
+	}
+
+	if originals["nginx"] != "nginx:1.21" || originals["sidecar"] != "alpine" {
+		t.Errorf("unexpected original images %v", originals)
+	}
+
+	digests := map[string]string{}
+	if err := json.Unmarshal([]byte(annotations[controller.AnnotationMirrorDigests]), &digests); err != nil {
+		t.Fatalf("invalid mirror digests annotation: %v", err)
+	}
+
+	if digests["nginx"] != "sha256:a" || digests["sidecar"] != "sha256:c" {
+		t.Errorf("unexpected mirror digests %v", digests)
+	}
+
+	if wanted := "2021-03-01T12:00:00Z"; annotations[controller.AnnotationLastCloned] != wanted {
+		t.Errorf("expected last cloned %q, got %q", wanted, annotations[controller.AnnotationLastCloned])
+	}
+
+	deployment.SetAnnotations(map[string]string{controller.AnnotationOriginalImages: "not json"})
+
+	if err := controller.AnnotateRewrite(deployment, nil, now); err == nil {
+		t.Errorf("expected error for invalid annotation")
+	}
+}
+
+func TestContainerImage(t *testing.T) {
+	digest := "sha256:0b159cd1ee1203dad901967ac55eee18c24da84ba3be384690304be93538bea8"
+	image := controller.BackedUpImage{Container: "nginx", Destination: "quay.io/foo/nginx:1.21", Digest: digest}
+
+	if got := image.ContainerImage(false); got != image.Destination {
+		t.Errorf("Expected %q unpinned, got %q", image.Destination, got)
+	}
+
+	if got, expected := image.ContainerImage(true), image.Destination+"@"+digest; got != expected {
+		t.Errorf("Expected %q pinned, got %q", expected, got)
+	}
+
+	image.Digest = ""
+
+	if got := image.ContainerImage(true); got != image.Destination {
+		t.Errorf("Expected %q without digest, got %q", image.Destination, got)
+	}
+}
@@ -4,200 +4,480 @@ package controller
 
 import (
 	"context"
+	"strings"
+	"time"
 
-	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	"github.com/impochi/cloner/pkg/metrics"
 	pkgregistry "github.com/impochi/cloner/pkg/registry"
 )
 
+// Reasons of the events recorded on the reconciled objects.
+const (
+	// EventImageCloned is recorded for each image backed up.
+	EventImageCloned = "ImageCloned"
+	// EventImageCloneFailed is recorded when an image can't be backed up.
+	EventImageCloneFailed = "ImageCloneFailed"
+	// EventWorkloadRewritten is recorded when the images of an object are rewritten.
+	EventWorkloadRewritten = "WorkloadRewritten"
+	// EventWorkloadRestored is recorded when the original images of an object are restored.
+	EventWorkloadRestored = "WorkloadRestored"
+	// EventDryRun is recorded with what would have been done to an object, in dry run mode.
+	EventDryRun = "DryRun"
+	// EventImageResynced is recorded when the images of an object changed upstream are backed
+	// up again.
+	EventImageResynced = "ImageResynced"
+	// EventUpstreamChanged is recorded when an image of an object changed upstream is not
+	// backed up again, the policy freezing the backed up tags.
+	EventUpstreamChanged = "UpstreamChanged"
+	// EventImageDisallowed is recorded when the image of a container is denied by the source
+	// rules, the container being left unchanged.
+	EventImageDisallowed = "ImageDisallowed"
+)
+
 // ClonerReconciler is the controller's reconciler object.
 type ClonerReconciler struct {
 	Client client.Client
+	// APIReader reads the objects which are not cached, such as the image pull secrets.
+	APIReader client.Reader
+	// Workload is the kind of object reconciled by this reconciler.
+	Workload Workload
+	// RegistryOptions are passed to the registry when backing up the images.
+	RegistryOptions []pkgregistry.Option
+	// Credentials of the destination registry, the REGISTRY_* environment variables are used
+	// when nil or empty.
+	Credentials *pkgregistry.CredentialsStore
+	// PullCredentials are the pull-only credentials of the destination registry, replacing the
+	// image pull secrets of the rewritten objects. Their image pull secrets are left untouched
+	// when nil or empty.
+	PullCredentials *pkgregistry.CredentialsStore
+	// Mirrors records the backed up images.
+	Mirrors *MirrorRecorder
+	// Recorder records the events of the reconciled objects.
+	Recorder record.EventRecorder
+	// Mode is the mode the controller runs in, ModeClone when empty.
+	Mode Mode
+	// DryRun only reports what would be done to the objects, without pushing any image nor
+	// updating the objects.
+	DryRun bool
+	// Copier backs up the images in the background, the object being reconciled again until
+	// they are backed up. The images are backed up during the reconciliation when nil.
+	Copier *Copier
+	// ResyncPeriod is how often the original images of the rewritten objects are checked for
+	// changes upstream, never when zero.
+	ResyncPeriod time.Duration
+	// PinDigests rewrites the containers to the destination images pinned by the digest
+	// backed up, e.g. `<destination>/nginx:1.21@sha256:...`.
+	PinDigests bool
+
+	// frozen are the source tags kept frozen, already reported.
+	frozen frozenTags
 }
 
-// Reconcile reconciles the object that is in question. In this case its either a Deployment or
-// DaemonSet.
+// Reconcile reconciles the object that is in question, any of the kinds returned by
+// Workloads.
 func (cr *ClonerReconciler) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
-	log := pkglog.FromContext(ctx)
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind)
 
-	// Get the Deployents or DaemonSet from the cache
-	deployment := &appsv1.Deployment{}
-	daemonset := &appsv1.DaemonSet{}
+	obj := cr.Workload.New()
 
-	kind := "Deployment"
-
-	err := cr.Client.Get(ctx, req.NamespacedName, deployment)
+	err := cr.Client.Get(ctx, req.NamespacedName, obj)
 	if errors.IsNotFound(err) {
-		log.Info("not a Deployment, checking for Daemonset")
-
-		err = cr.Client.Get(ctx, req.NamespacedName, daemonset)
-		if errors.IsNotFound(err) {
-			log.Info("not a Daemonset")
+		log.Info("object not found")
+		metrics.DeleteWorkload(cr.Workload.Kind, req.NamespacedName)
+		cr.frozen.forget(req.NamespacedName)
 
-			return reconcile.Result{}, nil
-		}
-
-		kind = "DaemonSet"
+		return reconcile.Result{}, nil
 	}
 
 	if err != nil {
-		log.Error(err, "could not fetch Deployment or DaemonSet")
+		log.Error(err, "could not fetch object")
 
 		return reconcile.Result{}, err
 	}
 
-	log.Info("reconciling Deployment", "deployment name", deployment.Name)
+	// The workloads being deleted are not backed up anymore.
+	if obj.GetDeletionTimestamp() != nil {
+		log.Info("object being deleted")
+		metrics.DeleteWorkload(cr.Workload.Kind, req.NamespacedName)
+		cr.frozen.forget(req.NamespacedName)
 
-	if kind == "Deployment" && isDeploymentReady(deployment) && len(deployment.Spec.Template.Spec.ImagePullSecrets) == 0 {
-		return cr.reconcileDeployment(ctx, deployment)
+		return reconcile.Result{}, nil
 	}
 
-	if kind == "DaemonSet" && isDaemonSetReady(daemonset) && len(daemonset.Spec.Template.Spec.ImagePullSecrets) == 0 {
-		return cr.reconcileDaemonSet(ctx, daemonset)
+	log.Info("reconciling object", "name", obj.GetName())
+
+	template := cr.Workload.PodTemplate(obj)
+
+	if cr.Mode == ModeRestore {
+		return cr.restoreWorkload(ctx, obj, template)
+	}
+
+	if cr.Workload.IsReady(obj) {
+		return cr.reconcileWorkload(ctx, obj, template)
+	}
+
+	// The rewritten objects keep being resynced while they are not ready.
+	if _, rewritten := obj.GetAnnotations()[AnnotationOriginalImages]; rewritten {
+		return reconcile.Result{RequeueAfter: cr.ResyncPeriod}, nil
 	}
 
 	return reconcile.Result{}, nil
 }
 
-func isDaemonSetReady(ds *appsv1.DaemonSet) bool {
-	status := ds.Status
-	desired := status.DesiredNumberScheduled
+func (cr *ClonerReconciler) reconcileWorkload(ctx context.Context,
+	obj client.Object, template *corev1.PodTemplateSpec) (reconcile.Result, error) {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind)
 
-	ready := status.NumberReady
-	if desired == ready && desired > 0 {
-		return true
+	opts, policy, secrets, err := cr.workloadOptions(ctx, obj, template)
+	if err != nil {
+		return reconcile.Result{}, err
 	}
 
-	return false
-}
+	if policy != nil {
+		log = log.WithValues("policy", policy.Name, "policyKind", policy.Kind)
+	}
 
-func isDeploymentReady(deployments *appsv1.Deployment) bool {
-	status := deployments.Status
-	desired := status.Replicas
-	ready := status.ReadyReplicas
+	workload := &clonerv1alpha1.WorkloadReference{
+		Kind:      cr.Workload.Kind,
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}
+
+	// The images backed up are reported once reconciled, out of the images of the template
+	// before it is rewritten.
+	backedUp := []BackedUpImage{}
+	original := template.DeepCopy()
+
+	defer func() {
+		cr.reportUnmirrored(ctx, obj, original, backedUp, opts)
+	}()
+
+	if cr.DryRun {
+		return cr.reportWorkload(ctx, obj, template, policy, opts)
+	}
+
+	// The copies of private images are only shared by the workloads of the namespace, which
+	// are allowed to pull them.
+	scope := ""
+	if len(secrets) != 0 {
+		scope = obj.GetNamespace()
+	}
 
-	if desired == ready && desired > 0 {
-		return true
+	backedUp, pending, err := cr.backupTemplate(ctx, obj, workload, scope, template, opts)
+	if err != nil {
+		return backupFailed(log, err)
 	}
 
-	return false
+	switch {
+	case pending:
+		log.Info("waiting for images to be backed up")
+
+		return reconcile.Result{RequeueAfter: cr.Copier.pollInterval()}, nil
+	case cr.Workload.Immutable:
+		log.Info("pod template is immutable, images backed up without updating the object")
+
+		return reconcile.Result{}, nil
+	case !policy.Rewrite():
+		log.Info("images mirrored without updating the object")
+
+		return reconcile.Result{RequeueAfter: cr.ResyncPeriod}, nil
+	case len(backedUp) == 0:
+		return cr.resyncWorkload(ctx, obj, template, workload, scope, policy, opts)
+	default:
+		return cr.rewriteWorkload(ctx, obj, template, backedUp, secrets, opts)
+	}
 }
 
-func (cr *ClonerReconciler) reconcileDeployment(ctx context.Context,
-	deployment *appsv1.Deployment) (reconcile.Result, error) {
-	log := pkglog.FromContext(ctx)
+// workloadOptions returns the registry options of the object, made of the options of the
+// reconciler, the credentials of the destination registry, the ones of its clone policy and the
+// keychain of its image pull secrets. Returns its clone policy and its image pull secrets as well.
+func (cr *ClonerReconciler) workloadOptions(ctx context.Context, obj client.Object,
+	template *corev1.PodTemplateSpec) ([]pkgregistry.Option, *Policy, []string, error) {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind)
 
-	needsUpdate := false
+	opts := append([]pkgregistry.Option{}, cr.RegistryOptions...)
 
-	for index, container := range deployment.Spec.Template.Spec.InitContainers {
-		dstImage, err := pkgregistry.GetDestinationImage(container.Image)
-		if err != nil {
-			log.Error(err, "failed to get destination image")
+	// The same credentials are used for the whole reconciliation, even if they are rotated
+	// in the meantime.
+	if creds := cr.Credentials.Load(); creds != nil {
+		opts = append(opts, pkgregistry.WithCredentials(creds))
+	}
 
-			return reconcile.Result{}, err
-		}
+	policy, err := ResolvePolicy(ctx, cr.Client, obj)
+	if err != nil {
+		log.Error(err, "failed to resolve clone policy")
 
-		if container.Image != dstImage {
-			if err := pkgregistry.Backup(container.Image, dstImage); err != nil {
-				log.Error(err, "failed to push image")
+		return nil, nil, nil, err
+	}
 
-				return reconcile.Result{}, err
-			}
+	policyOpts, err := policy.RegistryOptions(ctx, cr.APIReader, opts)
+	if err != nil {
+		log.Error(err, "failed to apply clone policy", "policy", policy.Name, "policyKind", policy.Kind)
 
-			deployment.Spec.Template.Spec.InitContainers[index].Image = dstImage
-			needsUpdate = true
-		}
+		return nil, nil, nil, err
+	}
+
+	opts = append(opts, policyOpts...)
+
+	// Private source images are pulled with the image pull secrets of the workload.
+	secrets, err := cr.pullSecrets(ctx, obj.GetNamespace(), template)
+	if err != nil {
+		log.Error(err, "failed to get image pull secrets")
+
+		return nil, nil, nil, err
+	}
+
+	// The source images of a rewritten object are pulled with its original image pull secrets.
+	originalSecrets, _, err := originalPullSecrets(obj.GetAnnotations())
+	if err != nil {
+		log.Error(err, "failed to get original image pull secrets")
+
+		return nil, nil, nil, err
 	}
 
-	for index, container := range deployment.Spec.Template.Spec.Containers {
-		dstImage, err := pkgregistry.GetDestinationImage(container.Image)
+	if len(secrets) != 0 {
+		keychain, err := cr.sourceKeychain(ctx, obj.GetNamespace(), append(secrets, originalSecrets...))
 		if err != nil {
-			log.Error(err, "failed to get destination image")
+			log.Error(err, "failed to read image pull secrets")
 
-			return reconcile.Result{}, err
+			return nil, nil, nil, err
 		}
 
-		if container.Image != dstImage {
-			if err := pkgregistry.Backup(container.Image, dstImage); err != nil {
-				log.Error(err, "failed to push image")
+		opts = append(opts, pkgregistry.WithSourceKeychain(keychain))
+	}
 
-				return reconcile.Result{}, err
-			}
+	return opts, policy, secrets, nil
+}
 
-			deployment.Spec.Template.Spec.Containers[index].Image = dstImage
-			needsUpdate = true
-		}
+// backupTemplate backs up the images of the init containers and of the containers of the
+// template, as backupContainers.
+func (cr *ClonerReconciler) backupTemplate(ctx context.Context, obj client.Object,
+	workload *clonerv1alpha1.WorkloadReference, scope string, template *corev1.PodTemplateSpec,
+	opts []pkgregistry.Option) ([]BackedUpImage, bool, error) {
+	initImages, initPending, err := cr.backupContainers(ctx, obj, workload, scope, template.Spec.InitContainers, opts)
+	if err != nil {
+		return nil, false, err
+	}
+
+	images, pending, err := cr.backupContainers(ctx, obj, workload, scope, template.Spec.Containers, opts)
+	if err != nil {
+		// The images of the init containers are backed up nonetheless.
+		return initImages, false, err
 	}
-	// Update Deployment
-	if needsUpdate {
-		if err := cr.Client.Update(ctx, deployment); err != nil {
-			log.Error(err, "failed to update Deployment")
 
+	return append(initImages, images...), initPending || pending, nil
+}
+
+// rewriteWorkload updates the object whose containers were pointed to the destination images,
+// annotating the images backed up.
+func (cr *ClonerReconciler) rewriteWorkload(ctx context.Context, obj client.Object, template *corev1.PodTemplateSpec,
+	images []BackedUpImage, secrets []string, opts []pkgregistry.Option) (reconcile.Result, error) {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind)
+
+	if len(secrets) != 0 {
+		if err := cr.replacePullSecrets(ctx, obj, template, opts); err != nil {
 			return reconcile.Result{}, err
 		}
 	}
 
+	if err := AnnotateRewrite(obj, images, time.Now()); err != nil {
+		log.Error(err, "failed to annotate object")
+
+		return reconcile.Result{}, err
+	}
+
+	if err := cr.Client.Update(ctx, obj); err != nil {
+		log.Error(err, "failed to update object")
+
+		return reconcile.Result{}, err
+	}
+
+	metrics.WorkloadRewritten(cr.Workload.Kind)
+
+	containers := []string{}
+	for _, image := range images {
+		containers = append(containers, image.Container)
+	}
+
+	cr.Recorder.Eventf(obj, corev1.EventTypeNormal, EventWorkloadRewritten,
+		"Rewrote the images of containers %s to the backed up images", strings.Join(containers, ", "))
+
+	return reconcile.Result{RequeueAfter: cr.ResyncPeriod}, nil
+}
+
+// reportUnmirrored records whether the object runs images which are not backed up.
+func (cr *ClonerReconciler) reportUnmirrored(ctx context.Context, obj client.Object,
+	template *corev1.PodTemplateSpec, backedUp []BackedUpImage, opts []pkgregistry.Option) {
+	unmirrored, err := IsUnmirrored(obj, template, backedUp, opts)
+	if err != nil {
+		pkglog.FromContext(ctx).Error(err, "failed to check the mirrored images")
+
+		return
+	}
+
+	key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	metrics.SetUnmirrored(cr.Workload.Kind, key, unmirrored)
+}
+
+// restoreWorkload puts back the original images of the object.
+func (cr *ClonerReconciler) restoreWorkload(ctx context.Context,
+	obj client.Object, template *corev1.PodTemplateSpec) (reconcile.Result, error) {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind)
+
+	changes, changed, err := RestoreWorkload(obj, template)
+	if err != nil {
+		log.Error(err, "failed to restore original images")
+
+		return reconcile.Result{}, err
+	}
+
+	if !changed {
+		return reconcile.Result{}, nil
+	}
+
+	if cr.Workload.Immutable {
+		log.Info("pod template is immutable, original images not restored")
+
+		return reconcile.Result{}, nil
+	}
+
+	containers := []string{}
+	for _, change := range changes {
+		containers = append(containers, change.Container)
+	}
+
+	if cr.DryRun {
+		log.Info("original images would be restored", "containers", containers, "dryRun", true)
+		cr.Recorder.Eventf(obj, corev1.EventTypeNormal, EventDryRun,
+			"Dry run: would restore the original images of containers %s", strings.Join(containers, ", "))
+
+		return reconcile.Result{}, nil
+	}
+
+	if err := cr.Client.Update(ctx, obj); err != nil {
+		log.Error(err, "failed to update object")
+
+		return reconcile.Result{}, err
+	}
+
+	log.Info("original images restored", "containers", containers)
+	cr.Recorder.Eventf(obj, corev1.EventTypeNormal, EventWorkloadRestored,
+		"Restored the original images of containers %s", strings.Join(containers, ", "))
+
 	return reconcile.Result{}, nil
 }
 
-func (cr *ClonerReconciler) reconcileDaemonSet(ctx context.Context,
-	daemonset *appsv1.DaemonSet) (reconcile.Result, error) {
+// backupContainers backs up the images of the given containers not skipped by the object and
+// points them to the destination images. Returns the images of the containers which were changed,
+// and whether some of them are still being backed up by the Copier.
+func (cr *ClonerReconciler) backupContainers(ctx context.Context, obj client.Object,
+	workload *clonerv1alpha1.WorkloadReference, scope string, containers []corev1.Container,
+	opts []pkgregistry.Option) ([]BackedUpImage, bool, error) {
 	log := pkglog.FromContext(ctx)
 
-	needsUpdate := false
+	images := []BackedUpImage{}
+	pending := false
 
-	for index, container := range daemonset.Spec.Template.Spec.InitContainers {
-		dstImage, err := pkgregistry.GetDestinationImage(container.Image)
+	for index, container := range containers {
+		dstImage, mirrored, err := cr.destinationImage(ctx, obj, container, opts)
 		if err != nil {
-			log.Error(err, "failed to get destination image")
+			return nil, false, err
+		}
 
-			return reconcile.Result{}, err
+		if !mirrored {
+			continue
 		}
 
-		if container.Image != dstImage {
-			if err := pkgregistry.Backup(container.Image, dstImage); err != nil {
-				log.Error(err, "failed to push image")
+		image, done, err := cr.backupImage(ctx, CopyRequest{
+			Workload:    workload,
+			Container:   container.Name,
+			Source:      container.Image,
+			Destination: dstImage,
+			Scope:       scope,
+			Options:     opts,
+		})
+		if err != nil {
+			log.Error(err, "failed to push image")
 
-				return reconcile.Result{}, err
+			retry := ""
+			if isPermanent(err) {
+				retry = ", not retrying until the object changes"
 			}
 
-			daemonset.Spec.Template.Spec.InitContainers[index].Image = dstImage
-			needsUpdate = true
+			cr.Recorder.Eventf(obj, corev1.EventTypeWarning, EventImageCloneFailed,
+				"Failed to back up image %s of container %s%s: %v", container.Image, container.Name, retry, err)
+
+			return nil, false, err
 		}
-	}
 
-	for index, container := range daemonset.Spec.Template.Spec.Containers {
-		dstImage, err := pkgregistry.GetDestinationImage(container.Image)
-		if err != nil {
-			log.Error(err, "failed to get destination image")
+		if !done {
+			pending = true
 
-			return reconcile.Result{}, err
+			continue
 		}
 
-		if container.Image != dstImage {
-			if err := pkgregistry.Backup(container.Image, dstImage); err != nil {
-				log.Error(err, "failed to push image")
+		dstImage = image.ContainerImage(cr.PinDigests)
 
-				return reconcile.Result{}, err
-			}
+		cr.Recorder.Eventf(obj, corev1.EventTypeNormal, EventImageCloned,
+			"Backed up image %s of container %s as %s", container.Image, container.Name, dstImage)
 
-			daemonset.Spec.Template.Spec.Containers[index].Image = dstImage
-			needsUpdate = true
-		}
+		containers[index].Image = dstImage
+		images = append(images, image)
 	}
 
-	// Update Daemonset
-	if needsUpdate {
-		if err := cr.Client.Update(ctx, daemonset); err != nil {
-			log.Error(err, "failed to update DaemonSet")
+	return images, pending, nil
+}
 
-			return reconcile.Result{}, err
-		}
+// destinationImage returns the destination image of the container, and whether its image is
+// to be backed up. The images skipped by the object, denied by the rules or already in the
+// destination repository are not backed up.
+func (cr *ClonerReconciler) destinationImage(ctx context.Context, obj client.Object, container corev1.Container,
+	opts []pkgregistry.Option) (string, bool, error) {
+	log := pkglog.FromContext(ctx)
+
+	if SkipsContainer(obj, container.Name) {
+		return "", false, nil
 	}
 
-	return reconcile.Result{}, nil
+	decision, err := DecideImage(log, container.Image, opts)
+	if err != nil {
+		log.Error(err, "failed to get destination image")
+
+		return "", false, err
+	}
+
+	if decision.Action == pkgregistry.RuleActionDeny {
+		cr.Recorder.Eventf(obj, corev1.EventTypeWarning, EventImageDisallowed,
+			"Image %s of container %s is not allowed, left unchanged: %s", container.Image, container.Name,
+			decision.Reason)
+
+		return "", false, nil
+	}
+
+	return decision.Destination, container.Image != decision.Destination, nil
+}
+
+// backupImage backs up the image with the Copier, or right away without Copier. Returns
+// whether the image was backed up.
+func (cr *ClonerReconciler) backupImage(ctx context.Context, request CopyRequest) (BackedUpImage, bool, error) {
+	if cr.Copier != nil {
+		return cr.Copier.Copy(ctx, request)
+	}
+
+	image, err := BackupImage(ctx, cr.Mirrors, request.Workload, request.Container,
+		request.Source, request.Destination, request.Options)
+	if err == nil {
+		ReplicateImage(ctx, cr.Mirrors, request.Source, request.Destination, image.Digest, request.Options)
+	}
+
+	return image, true, err
 }
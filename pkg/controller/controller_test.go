@@ -0,0 +1,214 @@
+package controller_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	"github.com/impochi/cloner/pkg/controller"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+const (
+	resyncPeriod = time.Hour
+	sourceIndex  = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json",` +
+		`"manifests":[]}`
+)
+
+// workloadClient serves the given deployment and policies, recording the updates.
+type workloadClient struct {
+	client.Client
+	policyReader
+
+	deployment *appsv1.Deployment
+	updates    int
+}
+
+func (c *workloadClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object) error {
+	if deployment, ok := obj.(*appsv1.Deployment); ok {
+		c.deployment.DeepCopyInto(deployment)
+
+		return nil
+	}
+
+	return c.policyReader.Get(ctx, key, obj)
+}
+
+func (c *workloadClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.policyReader.List(ctx, list, opts...)
+}
+
+func (c *workloadClient) Update(_ context.Context, _ client.Object, _ ...client.UpdateOption) error {
+	c.updates++
+
+	return nil
+}
+
+// newRegistry serves the nginx source index, and the backups with the given digest, none when
+// empty. The other source images are not found.
+func newRegistry(backupDigest string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(r.URL.Path, "/v2/library/nginx/"):
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+			w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(sourceIndex))))
+			_, _ = w.Write([]byte(sourceIndex))
+		case strings.HasPrefix(r.URL.Path, "/v2/library/"), len(backupDigest) == 0:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+			w.Header().Set("Content-Length", fmt.Sprint(len(sourceIndex)))
+			w.Header().Set("Docker-Content-Digest", backupDigest)
+		}
+	}))
+}
+
+//nolint:funlen
+func TestReconcileResync(t *testing.T) {
+	inSync := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(sourceIndex)))
+	moved := "sha256:" + strings.Repeat("0", 64)
+
+	freeze := clonerv1alpha1.ClonePolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "freeze", Namespace: "default"},
+		Spec:       clonerv1alpha1.ClonePolicySpec{TagUpdates: clonerv1alpha1.TagUpdatesFreeze},
+	}
+
+	cases := []struct {
+		name         string
+		source       string
+		backupDigest string
+		policies     []clonerv1alpha1.ClonePolicy
+		originals    string
+		ready        bool
+		// events are the number of events recorded by each reconciliation.
+		events []int
+	}{
+		{
+			name:         "in sync",
+			source:       "nginx",
+			backupDigest: inSync,
+			ready:        true,
+			events:       []int{0, 0},
+		},
+		{
+			name:         "not ready",
+			source:       "nginx",
+			backupDigest: moved,
+			policies:     []clonerv1alpha1.ClonePolicy{freeze},
+			ready:        false,
+			events:       []int{0},
+		},
+		{
+			name:         "frozen",
+			source:       "nginx",
+			backupDigest: moved,
+			policies:     []clonerv1alpha1.ClonePolicy{freeze},
+			ready:        true,
+			events:       []int{1, 0, 0},
+		},
+		{
+			name:         "invalid original images",
+			source:       "nginx",
+			backupDigest: moved,
+			originals:    "{",
+			ready:        true,
+			events:       []int{0},
+		},
+		{
+			// The source image is not found, which is not retried.
+			name:         "missing source",
+			source:       "redis",
+			backupDigest: moved,
+			ready:        true,
+			events:       []int{0},
+		},
+	}
+
+	for _, testcase := range cases {
+		server := newRegistry(testcase.backupDigest)
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		originals := testcase.originals
+		if len(originals) == 0 {
+			originals = fmt.Sprintf(`{"app":"%s/library/%s:1.21"}`, host, testcase.source)
+		}
+
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app",
+				Namespace:   "default",
+				Annotations: map[string]string{controller.AnnotationOriginalImages: originals},
+			},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{
+						Containers: []corev1.Container{{Name: "app", Image: host + "/foo/" + testcase.source + ":1.21"}},
+					},
+				},
+			},
+		}
+
+		if testcase.ready {
+			deployment.Status = appsv1.DeploymentStatus{Replicas: 1, ReadyReplicas: 1}
+		}
+
+		reader := policyReader{policies: testcase.policies}
+		recorder := record.NewFakeRecorder(10)
+		workloads := &workloadClient{policyReader: reader, deployment: deployment}
+		reconciler := &controller.ClonerReconciler{
+			Client:    workloads,
+			APIReader: &reader,
+			Workload:  controller.Workloads()[0],
+			RegistryOptions: []pkgregistry.Option{
+				pkgregistry.WithCredentials(&pkgregistry.Credentials{Provider: host, Username: "foo", Password: "bar"}),
+				pkgregistry.WithDestination(host + "/foo"),
+			},
+			Recorder:     recorder,
+			ResyncPeriod: resyncPeriod,
+		}
+
+		for index, events := range testcase.events {
+			request := reconcile.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "app"}}
+
+			result, err := reconciler.Reconcile(context.TODO(), request)
+			if err != nil {
+				t.Fatalf("%s: reconciliation %d failed: %v", testcase.name, index, err)
+			}
+
+			if result.RequeueAfter != resyncPeriod {
+				t.Errorf("%s: reconciliation %d: expected to be reconciled again after %v, got %v",
+					testcase.name, index, resyncPeriod, result.RequeueAfter)
+			}
+
+			if recorded := len(recorder.Events); recorded != events {
+				t.Errorf("%s: reconciliation %d: expected %d events, got %d", testcase.name, index, events, recorded)
+			}
+
+			for len(recorder.Events) != 0 {
+				<-recorder.Events
+			}
+		}
+
+		server.Close()
+
+		if workloads.updates != 0 {
+			t.Errorf("%s: expected the object not to be updated, got %d updates", testcase.name, workloads.updates)
+		}
+	}
+}
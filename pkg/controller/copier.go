@@ -0,0 +1,291 @@
+package controller
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/client-go/util/workqueue"
+	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+const (
+	// DefaultCopyWorkers is the default number of images copied at the same time.
+	DefaultCopyWorkers = 2
+
+	// defaultCopyPollInterval is the default PollInterval of the Copier.
+	defaultCopyPollInterval = 5 * time.Second
+
+	// copyResultTTL is how long the result of a copy is kept for the workloads waiting for it.
+	// A failed copy is retried once its result expired, or once the delay requested by a
+	// throttling registry is over.
+	copyResultTTL = time.Minute
+)
+
+// CopyRequest is a request to back up the source image of a container as the destination
+// image.
+type CopyRequest struct {
+	Workload  *clonerv1alpha1.WorkloadReference
+	Container string
+	Source    string
+	// Destination is the image backed up into, the copies of the same source and destination
+	// images are only done once.
+	Destination string
+	// Scope restricts the sharing of the copy, e.g. to a namespace when the source image is
+	// pulled with the image pull secrets of the workload. Shared by all when empty.
+	Scope   string
+	Options []pkgregistry.Option
+}
+
+func (r *CopyRequest) key() string {
+	return r.Scope + " " + r.Source + " " + r.Destination
+}
+
+// Copier backs up the images in the background with its own pool of workers, so that the
+// reconciliation of the other workloads doesn't wait for the copy of large images.
+type Copier struct {
+	// Workers is the number of images copied at the same time, DefaultCopyWorkers when not
+	// positive.
+	Workers int
+	// Mirrors records the backed up images.
+	Mirrors *MirrorRecorder
+	// PollInterval is how often the reconcilers check whether their copies completed,
+	// 5 seconds when not positive.
+	PollInterval time.Duration
+
+	once  sync.Once
+	queue workqueue.Interface
+
+	mu   sync.Mutex
+	jobs map[string]*copyJob
+}
+
+// copyJob is a copy, shared by all the workloads requesting it, or the copy of its
+// destination image to the replica registries once backed up.
+type copyJob struct {
+	request CopyRequest
+	log     logr.Logger
+
+	// replicate is set for the copies to the replica registries of the destination image of
+	// the given digest, which nobody waits for.
+	replicate bool
+	digest    string
+
+	// recorded are the workloads recorded in the ImageMirror of the copy.
+	recorded map[clonerv1alpha1.WorkloadReference]bool
+
+	// finished is closed once the copy completed.
+	finished chan struct{}
+
+	done    bool
+	image   BackedUpImage
+	err     error
+	expires time.Time
+}
+
+func (c *Copier) init() {
+	c.once.Do(func() {
+		c.queue = workqueue.NewNamed("copies")
+		c.jobs = map[string]*copyJob{}
+	})
+}
+
+// Start runs the workers until the context is done.
+func (c *Copier) Start(ctx context.Context) error {
+	c.init()
+
+	workers := c.Workers
+	if workers <= 0 {
+		workers = DefaultCopyWorkers
+	}
+
+	for i := 0; i < workers; i++ {
+		go c.work(ctx)
+	}
+
+	<-ctx.Done()
+	c.queue.ShutDown()
+
+	return nil
+}
+
+// Copy requests the copy of the image, returning its result once the copy completed. done is
+// false while the copy is pending, the caller is expected to call Copy again later, e.g.
+// after PollInterval.
+func (c *Copier) Copy(ctx context.Context, request CopyRequest) (image BackedUpImage, done bool, err error) {
+	c.init()
+
+	key := request.key()
+
+	c.mu.Lock()
+
+	c.evict(time.Now())
+
+	job, ok := c.jobs[key]
+	if !ok {
+		job = &copyJob{
+			request:  request,
+			log:      pkglog.FromContext(ctx),
+			recorded: map[clonerv1alpha1.WorkloadReference]bool{},
+			finished: make(chan struct{}),
+		}
+
+		if request.Workload != nil {
+			job.recorded[*request.Workload] = true
+		}
+
+		c.jobs[key] = job
+		c.queue.Add(key)
+	}
+
+	if !job.done {
+		c.mu.Unlock()
+
+		return BackedUpImage{}, false, nil
+	}
+
+	// The workloads joining a copy started for another workload are recorded as well.
+	record := request.Workload != nil && !job.recorded[*request.Workload]
+	if record {
+		job.recorded[*request.Workload] = true
+	}
+
+	image, err = job.image, job.err
+
+	c.mu.Unlock()
+
+	if record {
+		recordErr := c.Mirrors.Record(ctx, request.Workload, request.Source, request.Destination, nil, err)
+		if recordErr != nil {
+			pkglog.FromContext(ctx).Error(recordErr, "failed to record image mirror")
+		}
+	}
+
+	image.Container = request.Container
+
+	return image, true, err
+}
+
+// Wait requests the copy of the image like Copy, and waits until it completed or the context
+// is done. The copy keeps running in the background when the context is done first, for its
+// result to be available to the next request.
+func (c *Copier) Wait(ctx context.Context, request CopyRequest) (BackedUpImage, error) {
+	for {
+		image, done, err := c.Copy(ctx, request)
+		if done {
+			return image, err
+		}
+
+		c.mu.Lock()
+		job := c.jobs[request.key()]
+		c.mu.Unlock()
+
+		if job == nil {
+			continue
+		}
+
+		select {
+		case <-job.finished:
+		case <-ctx.Done():
+			return BackedUpImage{}, ctx.Err()
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the copies run on all the
+// replicas regardless of the leader election, so that the webhook can back up images as well.
+func (c *Copier) NeedLeaderElection() bool {
+	return false
+}
+
+func (c *Copier) pollInterval() time.Duration {
+	if c == nil || c.PollInterval <= 0 {
+		return defaultCopyPollInterval
+	}
+
+	return c.PollInterval
+}
+
+// evict forgets the expired results.
+func (c *Copier) evict(now time.Time) {
+	for key, job := range c.jobs {
+		if job.done && now.After(job.expires) {
+			delete(c.jobs, key)
+		}
+	}
+}
+
+// work runs the copies until the queue is shut down, the copies running being given up once
+// the context is done.
+func (c *Copier) work(ctx context.Context) {
+	for {
+		item, shutdown := c.queue.Get()
+		if shutdown {
+			return
+		}
+
+		key, _ := item.(string)
+
+		c.mu.Lock()
+		job := c.jobs[key]
+		c.mu.Unlock()
+
+		if job != nil {
+			c.run(pkglog.IntoContext(ctx, job.log), key, job)
+		}
+
+		c.queue.Done(item)
+	}
+}
+
+// run runs the job. Once backed up, the destination image is copied to the replica registries
+// by a job of its own, so that the workloads waiting for the backup don't wait for the replicas.
+func (c *Copier) run(ctx context.Context, key string, job *copyJob) {
+	request := job.request
+
+	var (
+		image BackedUpImage
+		err   error
+	)
+
+	if job.replicate {
+		ReplicateImage(ctx, c.Mirrors, request.Source, request.Destination, job.digest, request.Options)
+	} else {
+		image, err = BackupImage(ctx, c.Mirrors, request.Workload, request.Container, request.Source,
+			request.Destination, request.Options)
+	}
+
+	c.mu.Lock()
+	job.done, job.image, job.err, job.expires = true, image, err, time.Now().Add(resultTTL(err))
+
+	if !job.replicate && err == nil {
+		c.addReplication(ctx, key, job.request, image.Digest)
+	}
+
+	c.mu.Unlock()
+
+	close(job.finished)
+}
+
+// addReplication queues the copy of the destination image of the copy of the given key to the
+// replica registries, unless it is already pending. Must be called with the lock held.
+func (c *Copier) addReplication(ctx context.Context, key string, request CopyRequest, digest string) {
+	key = "replicas/" + key
+
+	if job, ok := c.jobs[key]; ok && !job.done {
+		return
+	}
+
+	c.jobs[key] = &copyJob{
+		request:   request,
+		log:       pkglog.FromContext(ctx),
+		replicate: true,
+		digest:    digest,
+		finished:  make(chan struct{}),
+	}
+	c.queue.Add(key)
+}
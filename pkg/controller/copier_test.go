@@ -0,0 +1,185 @@
+package controller_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	"github.com/impochi/cloner/pkg/controller"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+func TestCopierDeduplicates(t *testing.T) {
+	copier := &controller.Copier{Workers: 1}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The copy fails right away, the source image being invalid.
+	requests := []controller.CopyRequest{
+		{
+			Workload:    &clonerv1alpha1.WorkloadReference{Kind: "Deployment", Namespace: "default", Name: "first"},
+			Container:   "app",
+			Source:      "INVALID:image",
+			Destination: "quay.io/foo/image",
+		},
+		{
+			Workload:    &clonerv1alpha1.WorkloadReference{Kind: "Deployment", Namespace: "default", Name: "second"},
+			Container:   "sidecar",
+			Source:      "INVALID:image",
+			Destination: "quay.io/foo/image",
+		},
+	}
+
+	for _, request := range requests {
+		if _, done, err := copier.Copy(ctx, request); done || err != nil {
+			t.Fatalf("expected copy to be pending, got done %t and error %v", done, err)
+		}
+	}
+
+	go func() {
+		_ = copier.Start(ctx)
+	}()
+
+	for _, request := range requests {
+		var (
+			image controller.BackedUpImage
+			done  bool
+			err   error
+		)
+
+		for deadline := time.Now().Add(5 * time.Second); !done && time.Now().Before(deadline); {
+			image, done, err = copier.Copy(ctx, request)
+
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if !done {
+			t.Fatalf("container %s: expected copy to complete", request.Container)
+		}
+
+		if err == nil {
+			t.Errorf("container %s: expected copy error", request.Container)
+		}
+
+		if image.Container != request.Container {
+			t.Errorf("expected container %q, got %q", request.Container, image.Container)
+		}
+	}
+}
+
+func TestCopierWait(t *testing.T) {
+	copier := &controller.Copier{Workers: 1}
+	request := controller.CopyRequest{Container: "app", Source: "INVALID:image", Destination: "quay.io/foo/image"}
+
+	// The copier is not started yet, the wait is abandoned once the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := copier.Wait(ctx, request); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+
+	started, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	go func() {
+		_ = copier.Start(started)
+	}()
+
+	// The abandoned copy is done in the background, and its result shared.
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	image, err := copier.Wait(ctx, request)
+	if err == nil || errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected copy error, got %v", err)
+	}
+
+	if image.Container != request.Container {
+		t.Errorf("expected container %q, got %q", request.Container, image.Container)
+	}
+}
+
+//nolint:funlen
+func TestCopierReplicatesInBackground(t *testing.T) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(sourceIndex)))
+
+	// The source and destination images are the same index, already backed up.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+		w.Header().Set("Content-Length", fmt.Sprint(len(sourceIndex)))
+		w.Header().Set("Docker-Content-Digest", digest)
+
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(sourceIndex))
+		}
+	}))
+	defer server.Close()
+
+	// The replica answers once released, after the backup was waited for.
+	var replicaRequests int32
+
+	release := make(chan struct{})
+	replicaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&replicaRequests, 1)
+		<-release
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	defer replicaServer.Close()
+	defer close(release)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	replica := &pkgregistry.CredentialsStore{}
+	replica.Store(&pkgregistry.Credentials{
+		Provider: strings.TrimPrefix(replicaServer.URL, "http://"),
+		Username: "bar",
+		Password: "baz",
+	})
+
+	started, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	copier := &controller.Copier{Workers: 1}
+
+	go func() {
+		_ = copier.Start(started)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	image, err := copier.Wait(ctx, controller.CopyRequest{
+		Container:   "app",
+		Source:      host + "/library/nginx:1.21",
+		Destination: host + "/foo/nginx:1.21",
+		Options: []pkgregistry.Option{
+			pkgregistry.WithCredentials(&pkgregistry.Credentials{Provider: host, Username: "foo", Password: "bar"}),
+			pkgregistry.WithReplicas(replica),
+		},
+	})
+	if err != nil || image.Digest != digest {
+		t.Fatalf("expected the image to be backed up with digest %s, got %q (%v)", digest, image.Digest, err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&replicaRequests) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the image to be copied to the replica")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
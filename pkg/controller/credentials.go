@@ -0,0 +1,147 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// providerKey is the optional key of the registry credentials Secret overriding the
+// destination registry.
+const providerKey = "provider"
+
+// CredentialsWatcher keeps the credentials of the destination registry in sync with a
+// `kubernetes.io/dockerconfigjson` or `kubernetes.io/basic-auth` Secret.
+type CredentialsWatcher struct {
+	// Secret is the Secret holding the credentials.
+	Secret types.NamespacedName
+	// Store is updated with the credentials every time the Secret changes.
+	Store *pkgregistry.CredentialsStore
+	Log   logr.Logger
+
+	informer toolscache.SharedInformer
+}
+
+// SetupWithManager adds the watcher to the manager. The Secret is watched by an informer of its
+// own, only listing and watching the Secret by name in its namespace, so that the other Secrets
+// of the cluster are neither cached nor readable by the controller.
+func (w *CredentialsWatcher) SetupWithManager(mgr manager.Manager) error {
+	clientset, err := corev1client.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return fmt.Errorf("failed to create Secret client: %w", err)
+	}
+
+	lw := toolscache.NewFilteredListWatchFromClient(clientset.RESTClient(), "secrets", w.Secret.Namespace,
+		func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", w.Secret.Name).String()
+		})
+
+	w.informer = toolscache.NewSharedInformer(lw, &corev1.Secret{}, 0)
+	w.informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc: w.update,
+		UpdateFunc: func(_, obj interface{}) {
+			w.update(obj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if _, ok := w.secret(obj); ok {
+				w.Log.Info("registry credentials Secret deleted, keeping the current credentials", "secret", w.Secret)
+			}
+		},
+	})
+
+	return mgr.Add(w)
+}
+
+// Start runs the informer until the context is done.
+func (w *CredentialsWatcher) Start(ctx context.Context) error {
+	w.informer.Run(ctx.Done())
+
+	return nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, the watcher runs on all the
+// replicas regardless of the leader election, so that the webhook gets the credentials as well.
+func (w *CredentialsWatcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *CredentialsWatcher) secret(obj interface{}) (*corev1.Secret, bool) {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || secret.Namespace != w.Secret.Namespace || secret.Name != w.Secret.Name {
+		return nil, false
+	}
+
+	return secret, true
+}
+
+func (w *CredentialsWatcher) update(obj interface{}) {
+	secret, ok := w.secret(obj)
+	if !ok {
+		return
+	}
+
+	creds, err := credentialsFromSecret(secret)
+	if err != nil {
+		w.Log.Error(err, "invalid registry credentials Secret, keeping the current credentials", "secret", w.Secret)
+
+		return
+	}
+
+	w.Store.Store(creds)
+	w.Log.Info("registry credentials loaded", "secret", w.Secret, "provider", creds.Provider)
+}
+
+// readCredentials reads the credentials of a registry from their Secret.
+func readCredentials(ctx context.Context, c client.Client,
+	name types.NamespacedName) (*pkgregistry.Credentials, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, name, secret); err != nil {
+		return nil, fmt.Errorf("failed to get credentials Secret %s: %w", name, err)
+	}
+
+	creds, err := credentialsFromSecret(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credentials Secret %s: %w", name, err)
+	}
+
+	return creds, nil
+}
+
+func credentialsFromSecret(secret *corev1.Secret) (*pkgregistry.Credentials, error) {
+	var creds *pkgregistry.Credentials
+
+	switch secret.Type { //nolint:exhaustive
+	case corev1.SecretTypeDockerConfigJson:
+		dockerCreds, err := pkgregistry.CredentialsFromDockerConfig(secret.Data[corev1.DockerConfigJsonKey])
+		if err != nil {
+			return nil, err
+		}
+
+		creds = dockerCreds
+	case corev1.SecretTypeBasicAuth:
+		creds = &pkgregistry.Credentials{
+			Username: string(secret.Data[corev1.BasicAuthUsernameKey]),
+			Password: string(secret.Data[corev1.BasicAuthPasswordKey]),
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Secret type %q, must be %q or %q",
+			secret.Type, corev1.SecretTypeDockerConfigJson, corev1.SecretTypeBasicAuth)
+	}
+
+	if provider, ok := secret.Data[providerKey]; ok {
+		creds.Provider = string(provider)
+	}
+
+	return creds, creds.Validate()
+}
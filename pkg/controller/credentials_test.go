@@ -0,0 +1,133 @@
+//nolint:testpackage
+package controller
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+func TestCredentialsFromSecret(t *testing.T) { //nolint:funlen
+	cases := []struct {
+		name   string
+		secret corev1.Secret
+		creds  *pkgregistry.Credentials
+	}{
+		{
+			name: "dockerconfigjson",
+			secret: corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(quayConfig)},
+			},
+			creds: &pkgregistry.Credentials{Provider: "quay.io", Username: "quay", Password: "quaypass"},
+		},
+		{
+			name: "dockerconfigjson with provider",
+			secret: corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(quayConfig),
+					providerKey:                []byte("quay.io/team"),
+				},
+			},
+			creds: &pkgregistry.Credentials{Provider: "quay.io/team", Username: "quay", Password: "quaypass"},
+		},
+		{
+			name: "basic-auth",
+			secret: corev1.Secret{
+				Type: corev1.SecretTypeBasicAuth,
+				Data: map[string][]byte{
+					corev1.BasicAuthUsernameKey: []byte("foo"),
+					corev1.BasicAuthPasswordKey: []byte("bar"),
+				},
+			},
+			creds: &pkgregistry.Credentials{Username: "foo", Password: "bar"},
+		},
+		{
+			name: "basic-auth without password",
+			secret: corev1.Secret{
+				Type: corev1.SecretTypeBasicAuth,
+				Data: map[string][]byte{corev1.BasicAuthUsernameKey: []byte("foo")},
+			},
+		},
+		{
+			name: "malformed dockerconfigjson",
+			secret: corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":`)},
+			},
+		},
+		{
+			name: "dockerconfigjson with two registries",
+			secret: corev1.Secret{
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths":{"quay.io":{"auth":"cXVheTpxdWF5cGFzcw=="},` +
+						`"ghcr.io":{"username":"foo","password":"bar"}}}`),
+				},
+			},
+		},
+		{
+			name:   "opaque",
+			secret: corev1.Secret{Type: corev1.SecretTypeOpaque},
+		},
+	}
+
+	for _, testcase := range cases {
+		creds, err := credentialsFromSecret(&testcase.secret)
+
+		switch {
+		case testcase.creds == nil && err == nil:
+			t.Errorf("%s: expected an error, got credentials %+v", testcase.name, creds)
+		case testcase.creds == nil:
+		case err != nil:
+			t.Errorf("%s: failed to read credentials: %v", testcase.name, err)
+		case *creds != *testcase.creds:
+			t.Errorf("%s: expected credentials %+v, got %+v", testcase.name, testcase.creds, creds)
+		}
+	}
+}
+
+func TestCredentialsWatcherUpdate(t *testing.T) {
+	watcher := &CredentialsWatcher{
+		Secret: types.NamespacedName{Namespace: "cloner", Name: "registry"},
+		Store:  &pkgregistry.CredentialsStore{},
+		Log:    logr.Discard(),
+	}
+
+	secret := func(namespace, username, password string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "registry"},
+			Type:       corev1.SecretTypeBasicAuth,
+			Data: map[string][]byte{
+				corev1.BasicAuthUsernameKey: []byte(username),
+				corev1.BasicAuthPasswordKey: []byte(password),
+			},
+		}
+	}
+
+	updates := []struct {
+		secret   *corev1.Secret
+		username string
+	}{
+		{secret: secret("cloner", "foo", "password"), username: "foo"},
+		// Reloaded when the Secret is updated.
+		{secret: secret("cloner", "bar", "password"), username: "bar"},
+		// The invalid credentials and the other Secrets are ignored.
+		{secret: secret("cloner", "baz", ""), username: "bar"},
+		{secret: secret("default", "baz", "password"), username: "bar"},
+	}
+
+	for i, update := range updates {
+		watcher.update(update.secret)
+
+		if creds := watcher.Store.Load(); creds == nil || creds.Username != update.username {
+			t.Errorf("update %d: expected credentials of %q, got %+v", i, update.username, creds)
+		}
+	}
+}
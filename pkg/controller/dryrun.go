@@ -0,0 +1,128 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/impochi/cloner/pkg/metrics"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// reportWorkload reports what reconcileWorkload would do to the object: the images it would
+// back up and the containers it would rewrite. The destination images are only checked,
+// nothing is pushed and the object is left untouched.
+func (cr *ClonerReconciler) reportWorkload(ctx context.Context, obj client.Object,
+	template *corev1.PodTemplateSpec, policy *Policy, opts []pkgregistry.Option) (reconcile.Result, error) {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind, "dryRun", true)
+
+	copies := 0
+	containers := []string{}
+	disallowed := []string{}
+
+	for _, c := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for _, container := range c {
+			if SkipsContainer(obj, container.Name) {
+				continue
+			}
+
+			decision, err := DecideImage(log, container.Image, opts)
+			if err != nil {
+				log.Error(err, "failed to get destination image")
+
+				return reconcile.Result{}, err
+			}
+
+			if decision.Action == pkgregistry.RuleActionDeny {
+				disallowed = append(disallowed, container.Name)
+
+				continue
+			}
+
+			dstImage := decision.Destination
+			if container.Image == dstImage {
+				continue
+			}
+
+			copied, err := cr.wouldCopy(ctx, obj, container, dstImage, opts)
+			if err != nil {
+				return backupFailed(log, err)
+			}
+
+			if copied {
+				copies++
+			}
+
+			containers = append(containers, container.Name)
+		}
+	}
+
+	rewrite := len(containers) != 0 && !cr.Workload.Immutable && policy.Rewrite()
+
+	metrics.DryRunReported(cr.Workload.Kind,
+		types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}, copies, rewrite)
+
+	if rewrite {
+		log.Info("object would be rewritten", "containers", containers)
+	} else {
+		containers = nil
+	}
+
+	cr.recordDryRun(obj, copies, containers, disallowed)
+
+	return reconcile.Result{}, nil
+}
+
+// wouldCopy reports whether the image of the container would be backed up, its destination
+// image being missing or outdated.
+func (cr *ClonerReconciler) wouldCopy(ctx context.Context, obj client.Object, container corev1.Container,
+	dstImage string, opts []pkgregistry.Option) (bool, error) {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind, "dryRun", true)
+
+	backedUp, err := pkgregistry.IsBackedUp(container.Image, dstImage, opts...)
+	if err != nil {
+		log.Error(err, "failed to check destination image", "image", container.Image)
+		cr.Recorder.Eventf(obj, corev1.EventTypeWarning, EventImageCloneFailed,
+			"Dry run: failed to check the backup %s of image %s of container %s: %v",
+			dstImage, container.Image, container.Name, err)
+
+		return false, err
+	}
+
+	if backedUp {
+		log.Info("image already backed up", "image", container.Image, "destination", dstImage)
+	} else {
+		log.Info("image would be backed up", "image", container.Image, "destination", dstImage)
+	}
+
+	return !backedUp, nil
+}
+
+// recordDryRun records what would be done to the object: the number of images backed up, the
+// containers rewritten and the containers whose images are disallowed.
+func (cr *ClonerReconciler) recordDryRun(obj client.Object, copies int, rewritten, disallowed []string) {
+	actions := []string{}
+
+	if copies != 0 {
+		actions = append(actions, fmt.Sprintf("back up %d images", copies))
+	}
+
+	if len(rewritten) != 0 {
+		actions = append(actions, fmt.Sprintf("rewrite the images of containers %s", strings.Join(rewritten, ", ")))
+	}
+
+	if len(disallowed) != 0 {
+		actions = append(actions, fmt.Sprintf("leave the disallowed images of containers %s unchanged",
+			strings.Join(disallowed, ", ")))
+	}
+
+	if len(actions) != 0 {
+		cr.Recorder.Eventf(obj, corev1.EventTypeNormal, EventDryRun, "Dry run: would %s", strings.Join(actions, " and "))
+	}
+}
@@ -0,0 +1,129 @@
+package controller
+
+import (
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+const (
+	// AnnotationSkip excludes a workload from the controller when set to `true`. Otherwise it
+	// holds the comma separated names of the containers whose images are left untouched.
+	AnnotationSkip = "cloner.impochi.io/skip"
+	// AnnotationEnabled includes a workload when set to `true`, the controller only handles
+	// such workloads in opt-in mode.
+	AnnotationEnabled = "cloner.impochi.io/enabled"
+)
+
+// WorkloadFilter selects the workloads handled by the controller.
+type WorkloadFilter struct {
+	// IgnoreNamespaces are the namespaces whose workloads are never handled.
+	IgnoreNamespaces []string
+	// Selector selects the workloads by their labels, all of them when nil.
+	Selector labels.Selector
+	// OptIn only selects the workloads with the AnnotationEnabled annotation.
+	OptIn bool
+}
+
+// IgnoresNamespace reports whether the workloads of the namespace are never handled.
+func (f *WorkloadFilter) IgnoresNamespace(namespace string) bool {
+	for _, ignored := range f.IgnoreNamespaces {
+		if ignored == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Selects reports whether the workload is handled by the controller. Its AnnotationSkip
+// annotation takes precedence over its AnnotationEnabled annotation.
+func (f *WorkloadFilter) Selects(obj client.Object) bool {
+	if f.IgnoresNamespace(obj.GetNamespace()) {
+		return false
+	}
+
+	if f.Selector != nil && !f.Selector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+
+	annotations := obj.GetAnnotations()
+
+	if annotations[AnnotationSkip] == "true" {
+		return false
+	}
+
+	return !f.OptIn || annotations[AnnotationEnabled] == "true"
+}
+
+// SkipsContainer reports whether the image of the container is left untouched, its name being
+// listed by the AnnotationSkip annotation of the workload.
+func SkipsContainer(obj client.Object, container string) bool {
+	value, ok := obj.GetAnnotations()[AnnotationSkip]
+	if !ok {
+		return false
+	}
+
+	for _, name := range strings.Split(value, ",") {
+		if strings.TrimSpace(name) == container {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DecideImage returns whether the source image of a container is mirrored, skipped or denied,
+// logging the decision and its reason. The denied images are logged at the info level, the
+// other decisions at the debug level.
+func DecideImage(log logr.Logger, image string, opts []pkgregistry.Option) (*pkgregistry.Decision, error) {
+	decision, err := pkgregistry.Decide(image, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []interface{}{"image", image, "action", decision.Action, "reason", decision.Reason}
+
+	if decision.Action == pkgregistry.RuleActionDeny {
+		log.Info("source image not allowed", values...)
+	} else {
+		log.V(1).Info("source image decided", values...)
+	}
+
+	return decision, nil
+}
+
+// IsUnmirrored reports whether some containers of the template not skipped by the object run
+// an image to be mirrored, which is neither in the destination repository nor one of the
+// backed up images.
+func IsUnmirrored(obj client.Object, template *corev1.PodTemplateSpec, backedUp []BackedUpImage,
+	opts []pkgregistry.Option) (bool, error) {
+	mirrored := map[string]bool{}
+	for _, image := range backedUp {
+		mirrored[image.Container] = true
+	}
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for _, container := range containers {
+			if SkipsContainer(obj, container.Name) || mirrored[container.Name] {
+				continue
+			}
+
+			decision, err := pkgregistry.Decide(container.Image, opts...)
+			if err != nil {
+				return false, err
+			}
+
+			if decision.Action == pkgregistry.RuleActionMirror && container.Image != decision.Destination {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
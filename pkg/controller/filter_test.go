@@ -0,0 +1,175 @@
+package controller_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"github.com/impochi/cloner/pkg/controller"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+func TestWorkloadFilter(t *testing.T) { //nolint:funlen
+	selector := labels.SelectorFromSet(labels.Set{"team": "platform"})
+
+	cases := []struct {
+		filter      controller.WorkloadFilter
+		namespace   string
+		labels      map[string]string
+		annotations map[string]string
+		selected    bool
+	}{
+		{
+			filter:    controller.WorkloadFilter{},
+			namespace: "default",
+			selected:  true,
+		},
+		{
+			filter:    controller.WorkloadFilter{IgnoreNamespaces: []string{"kube-system"}},
+			namespace: "kube-system",
+			selected:  false,
+		},
+		{
+			filter:      controller.WorkloadFilter{},
+			namespace:   "default",
+			annotations: map[string]string{controller.AnnotationSkip: "true"},
+			selected:    false,
+		},
+		{
+			// Only the containers are skipped.
+			filter:      controller.WorkloadFilter{},
+			namespace:   "default",
+			annotations: map[string]string{controller.AnnotationSkip: "sidecar"},
+			selected:    true,
+		},
+		{
+			filter:    controller.WorkloadFilter{Selector: selector},
+			namespace: "default",
+			labels:    map[string]string{"team": "platform"},
+			selected:  true,
+		},
+		{
+			filter:    controller.WorkloadFilter{Selector: selector},
+			namespace: "default",
+			labels:    map[string]string{"team": "web"},
+			selected:  false,
+		},
+		{
+			filter:    controller.WorkloadFilter{OptIn: true},
+			namespace: "default",
+			selected:  false,
+		},
+		{
+			filter:      controller.WorkloadFilter{OptIn: true},
+			namespace:   "default",
+			annotations: map[string]string{controller.AnnotationEnabled: "true"},
+			selected:    true,
+		},
+		{
+			filter:    controller.WorkloadFilter{OptIn: true},
+			namespace: "default",
+			annotations: map[string]string{
+				controller.AnnotationEnabled: "true",
+				controller.AnnotationSkip:    "true",
+			},
+			selected: false,
+		},
+	}
+
+	for index, testcase := range cases {
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "nginx",
+				Namespace:   testcase.namespace,
+				Labels:      testcase.labels,
+				Annotations: testcase.annotations,
+			},
+		}
+
+		if selected := testcase.filter.Selects(deployment); selected != testcase.selected {
+			t.Errorf("case %d: expected selected to be %t, got %t", index, testcase.selected, selected)
+		}
+	}
+}
+
+func TestSkipsContainer(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{controller.AnnotationSkip: "sidecar, init"},
+		},
+	}
+
+	for container, skipped := range map[string]bool{"sidecar": true, "init": true, "nginx": false} {
+		if controller.SkipsContainer(deployment, container) != skipped {
+			t.Errorf("container %q: expected skipped to be %t", container, skipped)
+		}
+	}
+
+	if controller.SkipsContainer(&appsv1.Deployment{}, "nginx") {
+		t.Errorf("expected no container to be skipped without annotation")
+	}
+}
+
+func TestIsUnmirrored(t *testing.T) {
+	opts := []pkgregistry.Option{
+		pkgregistry.WithCredentials(&pkgregistry.Credentials{Provider: "quay.io", Username: "foo", Password: "bar"}),
+		pkgregistry.WithDestination("quay.io/foo"),
+	}
+
+	cases := []struct {
+		images      []string
+		annotations map[string]string
+		backedUp    []controller.BackedUpImage
+		unmirrored  bool
+	}{
+		{
+			images:     []string{"nginx:1.21"},
+			unmirrored: true,
+		},
+		{
+			// The destination images are mirrored, pinned or not.
+			images:     []string{"quay.io/foo/nginx:1.21", "quay.io/foo/busybox@sha256:" + strings.Repeat("a", 64)},
+			unmirrored: false,
+		},
+		{
+			// The images backed up are not rewritten in place, by policy.
+			images:     []string{"nginx:1.21"},
+			backedUp:   []controller.BackedUpImage{{Container: "container-0"}},
+			unmirrored: false,
+		},
+		{
+			images:     []string{"quay.io/foo/nginx:1.21", "redis:6"},
+			backedUp:   []controller.BackedUpImage{{Container: "container-0"}},
+			unmirrored: true,
+		},
+		{
+			images:      []string{"quay.io/foo/nginx:1.21", "redis:6"},
+			annotations: map[string]string{controller.AnnotationSkip: "container-1"},
+			unmirrored:  false,
+		},
+	}
+
+	for index, testcase := range cases {
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Annotations: testcase.annotations}}
+
+		template := &corev1.PodTemplateSpec{}
+		for container, image := range testcase.images {
+			template.Spec.Containers = append(template.Spec.Containers,
+				corev1.Container{Name: fmt.Sprintf("container-%d", container), Image: image})
+		}
+
+		unmirrored, err := controller.IsUnmirrored(deployment, template, testcase.backedUp, opts)
+		if err != nil {
+			t.Fatalf("case %d: unexpected error: %v", index, err)
+		}
+
+		if unmirrored != testcase.unmirrored {
+			t.Errorf("case %d: expected unmirrored to be %t", index, testcase.unmirrored)
+		}
+	}
+}
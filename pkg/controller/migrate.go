@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// ImageChange is a change of the image of a container.
+type ImageChange struct {
+	Container string
+	From      string
+	To        string
+}
+
+// MigrateOptions selects the workloads migrated by MigrateNames, and the naming schemes their
+// images are moved between.
+type MigrateOptions struct {
+	// RegistrySecret holds the credentials of the destination registry, the REGISTRY_*
+	// environment variables are used when nil.
+	RegistrySecret *types.NamespacedName
+	// From is the naming scheme the images were backed up with, To the one they are moved to.
+	From pkgregistry.NamingScheme
+	To   pkgregistry.NamingScheme
+	// Namespace restricts the workloads to a namespace, all the namespaces when empty.
+	Namespace string
+	// Kind restricts the workloads to a kind, e.g. `Deployment`, all the kinds when empty.
+	Kind string
+	// DryRun only reports the changes, nothing is copied and the workloads are left untouched.
+	DryRun bool
+}
+
+// RenameImages points the rewritten containers of the pod template still using the destination
+// image named after their original image with the from options to the destination image named
+// with the to options, e.g. with another naming scheme. The containers pinned by digest stay
+// pinned to the same digest. The skipped containers and the ones whose image was changed since
+// they were rewritten are left alone. Returns the images changed, the destination images being
+// left unpinned.
+func RenameImages(obj client.Object, template *corev1.PodTemplateSpec, from,
+	to []pkgregistry.Option) ([]ImageChange, error) {
+	originals, err := annotationMap(obj.GetAnnotations(), AnnotationOriginalImages)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []ImageChange{}
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for _, container := range containers {
+			original, ok := originals[container.Name]
+			if !ok || SkipsContainer(obj, container.Name) {
+				continue
+			}
+
+			// The original images denied since are left on their current destination image.
+			oldImage, err := pkgregistry.GetDestinationImage(original, from...)
+			if err != nil || (oldImage != container.Image && oldImage != pkgregistry.UnpinDigest(container.Image)) {
+				continue
+			}
+
+			newImage, err := pkgregistry.GetDestinationImage(original, to...)
+			if err != nil || newImage == oldImage {
+				continue
+			}
+
+			changes = append(changes, ImageChange{Container: container.Name, From: container.Image, To: newImage})
+		}
+	}
+
+	return changes, nil
+}
+
+// MigrateNames moves the images of the rewritten workloads backed up with a naming scheme to the
+// names of another naming scheme, reporting the changes to out. The backed up images are copied
+// within the destination registry, so that the workloads keep running the same images, and the
+// workloads are rewritten to the new names. The old names are left in the destination registry.
+func MigrateNames(ctx context.Context, c client.Client, opts MigrateOptions, out io.Writer) error {
+	if opts.From == opts.To {
+		return fmt.Errorf("the images are already named with the %q naming scheme", opts.To)
+	}
+
+	registryOpts := []pkgregistry.Option{}
+
+	if opts.RegistrySecret != nil {
+		creds, err := readCredentials(ctx, c, *opts.RegistrySecret)
+		if err != nil {
+			return err
+		}
+
+		registryOpts = append(registryOpts, pkgregistry.WithCredentials(creds))
+	}
+
+	// The images are copied from the old names, pulled with the credentials of the destination
+	// registry.
+	config, err := pkgregistry.DestinationDockerConfig(registryOpts...)
+	if err != nil {
+		return err
+	}
+
+	keychain, err := pkgregistry.NewDockerConfigKeychain(config)
+	if err != nil {
+		return err
+	}
+
+	registryOpts = append(registryOpts, pkgregistry.WithSourceKeychain(keychain))
+	found := false
+
+	for _, workload := range Workloads() {
+		if len(opts.Kind) != 0 && !strings.EqualFold(opts.Kind, workload.Kind) {
+			continue
+		}
+
+		found = true
+
+		if err := migrateKind(ctx, c, workload, opts, registryOpts, out); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("unknown kind %q", opts.Kind)
+	}
+
+	return nil
+}
+
+func migrateKind(ctx context.Context, c client.Client, workload Workload, opts MigrateOptions,
+	registryOpts []pkgregistry.Option, out io.Writer) error {
+	list := workload.NewList()
+	if err := c.List(ctx, list, client.InNamespace(opts.Namespace)); err != nil {
+		return fmt.Errorf("failed to list %s: %w", workload.Kind, err)
+	}
+
+	objs, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if opts.DryRun {
+		prefix = "(dry run) "
+	}
+
+	from := append([]pkgregistry.Option{pkgregistry.WithNamingScheme(opts.From)}, registryOpts...)
+	to := append([]pkgregistry.Option{pkgregistry.WithNamingScheme(opts.To)}, registryOpts...)
+
+	for _, item := range objs {
+		obj, ok := item.(client.Object)
+		if !ok || IsOwnedByWorkload(obj) {
+			continue
+		}
+
+		template := workload.PodTemplate(obj)
+
+		changes, err := RenameImages(obj, template, from, to)
+		if err != nil {
+			return fmt.Errorf("%s %s/%s: %w", workload.Kind, obj.GetNamespace(), obj.GetName(), err)
+		}
+
+		if len(changes) == 0 {
+			continue
+		}
+
+		if workload.Immutable {
+			fmt.Fprintf(out, "%s%s %s/%s: pod template is immutable, skipped\n",
+				prefix, workload.Kind, obj.GetNamespace(), obj.GetName())
+
+			continue
+		}
+
+		for _, change := range changes {
+			fmt.Fprintf(out, "%s%s %s/%s: container %s: %s -> %s\n",
+				prefix, workload.Kind, obj.GetNamespace(), obj.GetName(), change.Container, change.From, change.To)
+		}
+
+		if opts.DryRun {
+			continue
+		}
+
+		if err := migrateWorkload(ctx, c, workload, obj, template, changes, to); err != nil {
+			return fmt.Errorf("failed to migrate %s %s/%s: %w", workload.Kind, obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// migrateWorkload copies the images of the containers to their new names and rewrites them.
+func migrateWorkload(ctx context.Context, c client.Client, workload Workload, obj client.Object,
+	template *corev1.PodTemplateSpec, changes []ImageChange, opts []pkgregistry.Option) error {
+	originals, err := annotationMap(obj.GetAnnotations(), AnnotationOriginalImages)
+	if err != nil {
+		return err
+	}
+
+	ref := &clonerv1alpha1.WorkloadReference{Kind: workload.Kind, Namespace: obj.GetNamespace(), Name: obj.GetName()}
+	mirrors := &MirrorRecorder{Client: c}
+	images := []BackedUpImage{}
+
+	for _, change := range changes {
+		// The image pinned by digest is copied, which is the image the pods run.
+		image, err := BackupImage(ctx, mirrors, ref, change.Container, change.From, change.To, opts)
+		if err != nil {
+			return fmt.Errorf("failed to copy image %q: %w", change.From, err)
+		}
+
+		ReplicateImage(ctx, mirrors, change.From, change.To, image.Digest, opts)
+
+		// The containers keep their original image, not the image copied.
+		image.Source = originals[change.Container]
+		pinned := change.From != pkgregistry.UnpinDigest(change.From)
+
+		for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+			for index := range containers {
+				if containers[index].Name == change.Container {
+					containers[index].Image = image.ContainerImage(pinned)
+				}
+			}
+		}
+
+		images = append(images, image)
+	}
+
+	if err := AnnotateRewrite(obj, images, time.Now()); err != nil {
+		return err
+	}
+
+	return c.Update(ctx, obj)
+}
@@ -0,0 +1,126 @@
+package controller_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/impochi/cloner/pkg/controller"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+//nolint:funlen
+func TestRenameImages(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	cases := []struct {
+		name      string
+		originals string
+		skip      string
+		image     string
+		expected  []controller.ImageChange
+	}{
+		{
+			name:      "flat name",
+			originals: `{"app":"nginx:1.21"}`,
+			image:     "quay.io/foo/nginx:1.21",
+			expected: []controller.ImageChange{{
+				Container: "app",
+				From:      "quay.io/foo/nginx:1.21",
+				To:        "quay.io/foo/docker.io/library/nginx:1.21",
+			}},
+		},
+		{
+			// The pods keep running the digest backed up.
+			name:      "pinned",
+			originals: `{"app":"bitnami/nginx:1.21"}`,
+			image:     "quay.io/foo/nginx:1.21@" + digest,
+			expected: []controller.ImageChange{{
+				Container: "app",
+				From:      "quay.io/foo/nginx:1.21@" + digest,
+				To:        "quay.io/foo/docker.io/bitnami/nginx:1.21",
+			}},
+		},
+		{
+			name:      "source pinned",
+			originals: `{"app":"nginx@` + digest + `"}`,
+			image:     "quay.io/foo/nginx@" + digest,
+			expected: []controller.ImageChange{{
+				Container: "app",
+				From:      "quay.io/foo/nginx@" + digest,
+				To:        "quay.io/foo/docker.io/library/nginx@" + digest,
+			}},
+		},
+		{
+			name:      "changed by the user",
+			originals: `{"app":"nginx:1.21"}`,
+			image:     "redis:6",
+			expected:  []controller.ImageChange{},
+		},
+		{
+			name:      "already migrated",
+			originals: `{"app":"nginx:1.21"}`,
+			image:     "quay.io/foo/docker.io/library/nginx:1.21",
+			expected:  []controller.ImageChange{},
+		},
+		{
+			name:      "skipped container",
+			originals: `{"app":"nginx:1.21"}`,
+			skip:      "app",
+			image:     "quay.io/foo/nginx:1.21",
+			expected:  []controller.ImageChange{},
+		},
+		{
+			name:     "not rewritten",
+			image:    "nginx:1.21",
+			expected: []controller.ImageChange{},
+		},
+	}
+
+	for key, value := range map[string]string{
+		"REGISTRY_PROVIDER": "quay.io",
+		"REGISTRY_USERNAME": "foo",
+		"REGISTRY_PASSWORD": "bar",
+	} {
+		if err := os.Setenv(key, value); err != nil {
+			t.Fatalf("Failed to set env variable `%s`: %q", key, err)
+		}
+	}
+
+	from := []pkgregistry.Option{pkgregistry.WithNamingScheme(pkgregistry.NamingSchemeFlat)}
+	to := []pkgregistry.Option{pkgregistry.WithNamingScheme(pkgregistry.NamingSchemePath)}
+
+	for _, testcase := range cases {
+		deployment := &appsv1.Deployment{}
+		deployment.Annotations = map[string]string{}
+
+		if len(testcase.originals) != 0 {
+			deployment.Annotations[controller.AnnotationOriginalImages] = testcase.originals
+		}
+
+		if len(testcase.skip) != 0 {
+			deployment.Annotations[controller.AnnotationSkip] = testcase.skip
+		}
+
+		template := &deployment.Spec.Template
+		template.Spec.Containers = []corev1.Container{{Name: "app", Image: testcase.image}}
+
+		changes, err := controller.RenameImages(deployment, template, from, to)
+		if err != nil {
+			t.Fatalf("%s: failed to rename images: %v", testcase.name, err)
+		}
+
+		if len(changes) != len(testcase.expected) {
+			t.Fatalf("%s: expected %v, got %v", testcase.name, testcase.expected, changes)
+		}
+
+		for index, change := range changes {
+			if change != testcase.expected[index] {
+				t.Errorf("%s: expected %v, got %v", testcase.name, testcase.expected[index], change)
+			}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+const (
+	// maxConflictRetries is the number of attempts to update an ImageMirror modified
+	// concurrently, e.g. by the reconcilers of other kinds backing up the same image.
+	maxConflictRetries = 5
+
+	// mirrorHashLength is the number of bytes of the hash of the images in the name of the
+	// ImageMirrors.
+	mirrorHashLength = 5
+	// maxMirrorPrefixLength is the length of the repository name kept in the name of the
+	// ImageMirrors, which are kept within the 63 characters of a DNS label, the strictest
+	// limit of the names of the objects.
+	maxMirrorPrefixLength = validation.DNS1123LabelMaxLength - len("-") - 2*mirrorHashLength
+)
+
+// MirrorRecorder records the images backed up as ImageMirrors. A nil MirrorRecorder records
+// nothing.
+type MirrorRecorder struct {
+	Client client.Client
+}
+
+// BackupImage backs up the source image of the container as the destination image and
+// records it. The error of the backup is returned, failing to inspect or record the images is
+// only logged. The destination image is not copied to the replica registries, see
+// ReplicateImage, so that the backup doesn't wait for them.
+func BackupImage(ctx context.Context, mirrors *MirrorRecorder, workload *clonerv1alpha1.WorkloadReference,
+	container, src, dst string, opts []pkgregistry.Option) (BackedUpImage, error) {
+	log := pkglog.FromContext(ctx).WithValues("image", src)
+
+	image := BackedUpImage{Container: container, Source: src, Destination: dst}
+
+	var status *clonerv1alpha1.ImageMirrorStatus
+
+	// The copy is given up once the context is done.
+	backupOpts := append([]pkgregistry.Option{pkgregistry.WithContext(ctx)}, opts...)
+
+	desc, err := pkgregistry.Backup(src, dst, backupOpts...)
+	if err == nil {
+		// The digest backed up is known even when the images can't be inspected, so that the
+		// destination image can be pinned by digest.
+		image.Digest = desc.Digest.String()
+
+		var inspectErr error
+
+		if status, inspectErr = InspectMirror(src, dst, backupOpts); inspectErr != nil {
+			log.Error(inspectErr, "failed to inspect backed up image")
+		} else {
+			image.SourceDigest = status.SourceDigest
+		}
+
+	}
+
+	if recordErr := mirrors.Record(ctx, workload, src, dst, status, err); recordErr != nil {
+		log.Error(recordErr, "failed to record image mirror")
+	}
+
+	return image, err
+}
+
+// ReplicateImage copies the backed up destination image to the replica registries and records
+// the copies in the ImageMirror of the source and destination images. The failures are only
+// logged. The replicas already confirmed to hold the digest of the destination image, when
+// known, are not checked again.
+func ReplicateImage(ctx context.Context, mirrors *MirrorRecorder, src, dst, digest string,
+	opts []pkgregistry.Option) {
+	log := pkglog.FromContext(ctx).WithValues("image", src)
+
+	// The copies are given up once the context is done.
+	replicateOpts := append([]pkgregistry.Option{pkgregistry.WithContext(ctx)}, opts...)
+
+	statuses := replicaStatuses(log, pkgregistry.Replicate(dst, digest, replicateOpts...), metav1.Now())
+	if len(statuses) == 0 || mirrors == nil {
+		return
+	}
+
+	err := mirrors.recordReplicas(ctx, MirrorName(src, dst), statuses)
+	if err != nil && !meta.IsNoMatchError(err) {
+		log.Error(err, "failed to record image mirror replicas")
+	}
+}
+
+// InspectMirror returns the digests and platforms of the source image and its backed up
+// destination image.
+func InspectMirror(src, dst string, opts []pkgregistry.Option) (*clonerv1alpha1.ImageMirrorStatus, error) {
+	srcInfo, err := pkgregistry.Inspect(src, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	dstInfo, err := pkgregistry.Inspect(dst, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	now := metav1.Now()
+
+	return &clonerv1alpha1.ImageMirrorStatus{
+		SourceDigest:      srcInfo.Digest,
+		DestinationDigest: dstInfo.Digest,
+		Platforms:         dstInfo.Platforms,
+		LastSyncTime:      &now,
+	}, nil
+}
+
+// Record creates or updates the ImageMirror of the source and destination images, with the
+// status returned by InspectMirror or the error of the backup. The workload is added to the
+// workloads of the ImageMirror when set, the workloads which were deleted or which no longer
+// use the images being removed. Nothing is recorded when the ImageMirror CRD is not installed.
+func (r *MirrorRecorder) Record(ctx context.Context, workload *clonerv1alpha1.WorkloadReference,
+	src, dst string, status *clonerv1alpha1.ImageMirrorStatus, backupErr error) error {
+	if r == nil {
+		return nil
+	}
+
+	if status == nil {
+		status = &clonerv1alpha1.ImageMirrorStatus{}
+	}
+
+	condition := metav1.Condition{
+		Type:    clonerv1alpha1.ImageMirrorReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  clonerv1alpha1.ReasonBackedUp,
+		Message: "image backed up",
+	}
+
+	if backupErr != nil {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = clonerv1alpha1.ReasonBackupFailed
+		condition.Message = backupErr.Error()
+	}
+
+	var err error
+
+	for attempt := 0; attempt < maxConflictRetries; attempt++ {
+		err = r.record(ctx, workload, src, dst, *status, condition)
+		if !errors.IsConflict(err) {
+			break
+		}
+	}
+
+	if meta.IsNoMatchError(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (r *MirrorRecorder) record(ctx context.Context, workload *clonerv1alpha1.WorkloadReference,
+	src, dst string, status clonerv1alpha1.ImageMirrorStatus, condition metav1.Condition) error {
+	mirror := &clonerv1alpha1.ImageMirror{}
+
+	err := r.Client.Get(ctx, types.NamespacedName{Name: MirrorName(src, dst)}, mirror)
+	if errors.IsNotFound(err) {
+		mirror = &clonerv1alpha1.ImageMirror{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: MirrorName(src, dst),
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "cloner",
+				},
+			},
+			Spec: clonerv1alpha1.ImageMirrorSpec{Source: src, Destination: dst},
+		}
+
+		err = r.Client.Create(ctx, mirror)
+
+		// Created concurrently, e.g. by the reconciler of another kind using the same image.
+		if errors.IsAlreadyExists(err) {
+			mirror = &clonerv1alpha1.ImageMirror{}
+			err = r.Client.Get(ctx, types.NamespacedName{Name: MirrorName(src, dst)}, mirror)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// The results of the last successful backup are kept when a backup fails.
+	if len(status.DestinationDigest) != 0 {
+		mirror.Status.SourceDigest = status.SourceDigest
+		mirror.Status.DestinationDigest = status.DestinationDigest
+		mirror.Status.Platforms = status.Platforms
+		mirror.Status.LastSyncTime = status.LastSyncTime
+	}
+
+	mirror.Status.Replicas = mergeReplicas(mirror.Status.Replicas, status.Replicas)
+
+	mirror.Status.Workloads = r.usingWorkloads(ctx, mirror.Status.Workloads, workload, src, dst)
+
+	meta.SetStatusCondition(&mirror.Status.Conditions, condition)
+
+	return r.Client.Status().Update(ctx, mirror)
+}
+
+// usingWorkloads returns the workloads still using the source or destination image, along with
+// the given workload when set. The workloads which can't be read are kept.
+func (r *MirrorRecorder) usingWorkloads(ctx context.Context, workloads []clonerv1alpha1.WorkloadReference,
+	workload *clonerv1alpha1.WorkloadReference, src, dst string) []clonerv1alpha1.WorkloadReference {
+	using := []clonerv1alpha1.WorkloadReference{}
+
+	for _, ref := range workloads {
+		if workload != nil && ref == *workload {
+			continue
+		}
+
+		if r.uses(ctx, ref, src, dst) {
+			using = append(using, ref)
+		}
+	}
+
+	if workload != nil {
+		using = append(using, *workload)
+	}
+
+	return using
+}
+
+// uses reports whether the workload exists and one of its containers runs the source or
+// destination image, pinned by digest or not.
+func (r *MirrorRecorder) uses(ctx context.Context, ref clonerv1alpha1.WorkloadReference, src, dst string) bool {
+	workload, ok := workloadOfKind(ref.Kind)
+	if !ok {
+		return false
+	}
+
+	obj := workload.New()
+
+	err := r.Client.Get(ctx, types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, obj)
+	if errors.IsNotFound(err) {
+		return false
+	}
+
+	if err != nil {
+		pkglog.FromContext(ctx).Error(err, "failed to get workload of image mirror", "workload", ref)
+
+		return true
+	}
+
+	template := workload.PodTemplate(obj)
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for _, container := range containers {
+			image := pkgregistry.UnpinDigest(container.Image)
+			if image == pkgregistry.UnpinDigest(src) || image == pkgregistry.UnpinDigest(dst) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// MirrorName returns the name of the ImageMirror of the source and destination images, made
+// of the name of the destination repository and a hash of both images, e.g. `nginx-1a2b3c4d5e`.
+// The name of the repository is truncated to keep the name within a DNS label, the hash
+// telling apart the repositories truncated to the same name.
+func MirrorName(src, dst string) string {
+	hash := sha256.Sum256([]byte(src + " " + dst))
+
+	prefix := ""
+
+	if ref, err := name.ParseReference(dst); err == nil {
+		// `_` and `.` are valid in repository names but not in the names of the objects, which
+		// start and end with an alphanumeric character.
+		prefix = strings.NewReplacer("_", "-", ".", "-").Replace(path.Base(ref.Context().RepositoryStr()))
+		prefix = strings.Trim(prefix, "-")
+
+		if len(prefix) > maxMirrorPrefixLength {
+			prefix = strings.TrimRight(prefix[:maxMirrorPrefixLength], "-")
+		}
+	}
+
+	if len(prefix) == 0 {
+		prefix = "image"
+	}
+
+	return fmt.Sprintf("%s-%x", prefix, hash[:mirrorHashLength])
+}
@@ -0,0 +1,219 @@
+package controller_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	"github.com/impochi/cloner/pkg/controller"
+)
+
+//nolint:funlen
+func TestMirrorName(t *testing.T) {
+	valid := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	cases := []struct {
+		src    string
+		dst    string
+		prefix string
+	}{
+		{
+			src:    "nginx:1.21",
+			dst:    "quay.io/foo/nginx:1.21",
+			prefix: "nginx-",
+		},
+		{
+			src:    "quay.io/prometheus/node_exporter.v2",
+			dst:    "quay.io/foo/node_exporter.v2",
+			prefix: "node-exporter-v2-",
+		},
+		{
+			src:    "quay.io/prometheus/_exporter_",
+			dst:    "quay.io/foo/_exporter_",
+			prefix: "exporter-",
+		},
+		{
+			src:    "quay.io/prometheus/__",
+			dst:    "quay.io/foo/__",
+			prefix: "image-",
+		},
+		{
+			src:    "invalid",
+			dst:    "quay.io/foo/Invalid",
+			prefix: "image-",
+		},
+		{
+			// Truncated after a separator, which is trimmed.
+			src:    "quay.io/prometheus/" + strings.Repeat("a", 51) + "_" + strings.Repeat("b", 50),
+			dst:    "quay.io/foo/" + strings.Repeat("a", 51) + "_" + strings.Repeat("b", 50),
+			prefix: strings.Repeat("a", 51) + "-",
+		},
+		{
+			src:    "quay.io/prometheus/" + strings.Repeat("a", 200),
+			dst:    "quay.io/foo/" + strings.Repeat("a", 200),
+			prefix: strings.Repeat("a", 52) + "-",
+		},
+	}
+
+	for _, testcase := range cases {
+		mirrorName := controller.MirrorName(testcase.src, testcase.dst)
+
+		if !valid.MatchString(mirrorName) || len(mirrorName) > validation.DNS1123LabelMaxLength ||
+			!strings.HasPrefix(mirrorName, testcase.prefix) {
+			t.Errorf("%q: expected a valid name starting with %q, got %q", testcase.dst, testcase.prefix, mirrorName)
+		}
+
+		if mirrorName != controller.MirrorName(testcase.src, testcase.dst) {
+			t.Errorf("%q: expected the same name for the same images", testcase.dst)
+		}
+	}
+
+	if controller.MirrorName("nginx:1.21", "quay.io/foo/nginx:1.21") ==
+		controller.MirrorName("bitnami/nginx:1.21", "quay.io/foo/nginx:1.21") {
+		t.Errorf("expected different names for different source images")
+	}
+}
+
+// recorderClient serves the given ImageMirror and Deployments, recording the ImageMirror
+// created and the status updated. The ImageMirror is hidden from the first read when hidden is
+// set, as if it was created concurrently.
+type recorderClient struct {
+	client.Client
+
+	mirror      *clonerv1alpha1.ImageMirror
+	hidden      bool
+	deployments map[string]appsv1.Deployment
+	updated     *clonerv1alpha1.ImageMirror
+}
+
+func (c *recorderClient) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	switch obj := obj.(type) {
+	case *clonerv1alpha1.ImageMirror:
+		if c.hidden || c.mirror == nil {
+			c.hidden = false
+
+			return errors.NewNotFound(schema.GroupResource{}, key.Name)
+		}
+
+		c.mirror.DeepCopyInto(obj)
+
+		return nil
+	case *appsv1.Deployment:
+		if deployment, ok := c.deployments[key.Name]; ok {
+			deployment.DeepCopyInto(obj)
+
+			return nil
+		}
+	}
+
+	return errors.NewNotFound(schema.GroupResource{}, key.Name)
+}
+
+func (c *recorderClient) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	if c.mirror != nil {
+		return errors.NewAlreadyExists(schema.GroupResource{}, obj.GetName())
+	}
+
+	c.mirror, _ = obj.DeepCopyObject().(*clonerv1alpha1.ImageMirror)
+
+	return nil
+}
+
+func (c *recorderClient) Status() client.StatusWriter {
+	return c
+}
+
+func (c *recorderClient) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	c.updated, _ = obj.DeepCopyObject().(*clonerv1alpha1.ImageMirror)
+
+	return nil
+}
+
+func (c *recorderClient) Patch(_ context.Context, _ client.Object, _ client.Patch, _ ...client.PatchOption) error {
+	return fmt.Errorf("unexpected patch")
+}
+
+//nolint:funlen
+func TestMirrorRecorderRecord(t *testing.T) {
+	src, dst := "nginx:1.21", "quay.io/foo/nginx:1.21"
+
+	deployment := func(name, image string) appsv1.Deployment {
+		return appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "nginx", Image: image}}},
+				},
+			},
+		}
+	}
+
+	reference := func(name string) clonerv1alpha1.WorkloadReference {
+		return clonerv1alpha1.WorkloadReference{Kind: "Deployment", Namespace: "default", Name: name}
+	}
+
+	existing := &clonerv1alpha1.ImageMirror{
+		ObjectMeta: metav1.ObjectMeta{Name: controller.MirrorName(src, dst)},
+		Spec:       clonerv1alpha1.ImageMirrorSpec{Source: src, Destination: dst},
+		Status: clonerv1alpha1.ImageMirrorStatus{
+			Workloads: []clonerv1alpha1.WorkloadReference{
+				reference("deleted"), reference("updated"), reference("rewritten"), reference("original"),
+			},
+		},
+	}
+
+	cases := []struct {
+		name   string
+		client *recorderClient
+		wanted []clonerv1alpha1.WorkloadReference
+	}{
+		{
+			name:   "new mirror",
+			client: &recorderClient{},
+			wanted: []clonerv1alpha1.WorkloadReference{reference("app")},
+		},
+		{
+			// Created concurrently, the workloads no longer using the images are removed.
+			name: "existing mirror",
+			client: &recorderClient{
+				mirror: existing,
+				hidden: true,
+				deployments: map[string]appsv1.Deployment{
+					"updated":   deployment("updated", "nginx:1.22"),
+					"rewritten": deployment("rewritten", dst+"@sha256:"+strings.Repeat("a", 64)),
+					"original":  deployment("original", src),
+				},
+			},
+			wanted: []clonerv1alpha1.WorkloadReference{reference("rewritten"), reference("original"), reference("app")},
+		},
+	}
+
+	for _, testcase := range cases {
+		recorder := &controller.MirrorRecorder{Client: testcase.client}
+		app := reference("app")
+
+		if err := recorder.Record(context.TODO(), &app, src, dst, nil, nil); err != nil {
+			t.Fatalf("%s: failed to record image mirror: %v", testcase.name, err)
+		}
+
+		if testcase.client.updated == nil {
+			t.Fatalf("%s: expected the status of the image mirror to be updated", testcase.name)
+		}
+
+		if workloads := testcase.client.updated.Status.Workloads; !reflect.DeepEqual(workloads, testcase.wanted) {
+			t.Errorf("%s: expected workloads %v, got %v", testcase.name, testcase.wanted, workloads)
+		}
+	}
+}
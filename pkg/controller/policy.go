@@ -0,0 +1,270 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// Policy is the clone policy applying to a workload, either a ClonePolicy of its namespace or
+// a ClusterClonePolicy. A nil Policy applies the settings of the controller.
+type Policy struct {
+	// Kind is either ClonePolicy or ClusterClonePolicy.
+	Kind string
+	// Name is the name of the policy, prefixed by its namespace for a ClonePolicy.
+	Name string
+	Spec clonerv1alpha1.ClonePolicySpec
+	// secretNamespace is the namespace of the credentials Secret of the destination.
+	secretNamespace string
+}
+
+// ResolvePolicy returns the policy applying to the workload, nil when none does. The
+// ClonePolicies of the namespace of the workload take precedence over the
+// ClusterClonePolicies. When several policies of the same kind select the workload, the first
+// one by name applies.
+func ResolvePolicy(ctx context.Context, reader client.Reader, obj client.Object) (*Policy, error) {
+	policies := &clonerv1alpha1.ClonePolicyList{}
+
+	err := reader.List(ctx, policies, client.InNamespace(obj.GetNamespace()))
+	// The policies are optional, the controller runs without their CRDs.
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ClonePolicies: %w", err)
+	}
+
+	sort.Slice(policies.Items, func(i, j int) bool {
+		return policies.Items[i].Name < policies.Items[j].Name
+	})
+
+	for _, policy := range policies.Items {
+		selected, err := selects(policy.Spec.Selector, obj.GetLabels())
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector of ClonePolicy %s/%s: %w", policy.Namespace, policy.Name, err)
+		}
+
+		if selected {
+			return &Policy{
+				Kind:            "ClonePolicy",
+				Name:            fmt.Sprintf("%s/%s", policy.Namespace, policy.Name),
+				Spec:            policy.Spec,
+				secretNamespace: policy.Namespace,
+			}, nil
+		}
+	}
+
+	return resolveClusterPolicy(ctx, reader, obj)
+}
+
+func resolveClusterPolicy(ctx context.Context, reader client.Reader, obj client.Object) (*Policy, error) {
+	policies := &clonerv1alpha1.ClusterClonePolicyList{}
+
+	err := reader.List(ctx, policies)
+	// The CRD of the ClusterClonePolicies can be missing even if the one of the ClonePolicies is
+	// installed.
+	if meta.IsNoMatchError(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ClusterClonePolicies: %w", err)
+	}
+
+	if len(policies.Items) == 0 {
+		return nil, nil
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := reader.Get(ctx, types.NamespacedName{Name: obj.GetNamespace()}, namespace); err != nil {
+		return nil, fmt.Errorf("failed to get namespace: %w", err)
+	}
+
+	sort.Slice(policies.Items, func(i, j int) bool {
+		return policies.Items[i].Name < policies.Items[j].Name
+	})
+
+	for _, policy := range policies.Items {
+		namespaceSelected, err := selects(policy.Spec.NamespaceSelector, namespace.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespace selector of ClusterClonePolicy %s: %w", policy.Name, err)
+		}
+
+		selected, err := selects(policy.Spec.Selector, obj.GetLabels())
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector of ClusterClonePolicy %s: %w", policy.Name, err)
+		}
+
+		if namespaceSelected && selected {
+			p := &Policy{
+				Kind: "ClusterClonePolicy",
+				Name: policy.Name,
+				Spec: policy.Spec.ClonePolicySpec,
+			}
+
+			if destination := policy.Spec.Destination; destination != nil && destination.CredentialsSecretRef != nil {
+				p.secretNamespace = destination.CredentialsSecretRef.Namespace
+			}
+
+			return p, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// selects reports whether the selector matches the labels, a nil selector matching all of
+// them.
+func selects(selector *metav1.LabelSelector, set map[string]string) (bool, error) {
+	if selector == nil {
+		return true, nil
+	}
+
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return false, err
+	}
+
+	return s.Matches(labels.Set(set)), nil
+}
+
+// Rewrite reports whether the workloads are pointed to the destination images once they are
+// backed up.
+func (p *Policy) Rewrite() bool {
+	return p == nil || p.Spec.Mode != clonerv1alpha1.CloneModeMirrorOnly
+}
+
+// FollowsTags reports whether the backed up tags follow the source tags moving upstream.
+func (p *Policy) FollowsTags() bool {
+	return p == nil || p.Spec.TagUpdates != clonerv1alpha1.TagUpdatesFreeze
+}
+
+// RegistryOptions returns the registry options of the policy, overriding the given ones of
+// the controller. The credentials Secret of the destination is read with the given reader.
+func (p *Policy) RegistryOptions(ctx context.Context, reader client.Reader,
+	base []pkgregistry.Option) ([]pkgregistry.Option, error) {
+	if p == nil {
+		return nil, nil
+	}
+
+	opts := []pkgregistry.Option{}
+
+	if destination := p.Spec.Destination; destination != nil {
+		opts = append(opts, pkgregistry.WithDestination(destination.Repository))
+
+		creds, err := p.destinationCredentials(ctx, reader, base)
+		if err != nil {
+			return nil, err
+		}
+
+		if creds != nil {
+			opts = append(opts, pkgregistry.WithCredentials(creds))
+		}
+	}
+
+	if sources := p.Spec.Sources; sources != nil {
+		filter := pkgregistry.SourceFilter{Include: sources.Include, Exclude: sources.Exclude}
+		if err := filter.Validate(); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", p.Kind, p.Name, err)
+		}
+
+		opts = append(opts, pkgregistry.WithSourceFilter(filter))
+	}
+
+	return opts, nil
+}
+
+// destinationCredentials returns the credentials of the destination of the policy, read from
+// its credentials Secret. Without Secret, the policy keeps the credentials of the controller,
+// which are only handed to the registry the controller backs up the images into.
+func (p *Policy) destinationCredentials(ctx context.Context, reader client.Reader,
+	base []pkgregistry.Option) (*pkgregistry.Credentials, error) {
+	destination := p.Spec.Destination
+
+	ref := destination.CredentialsSecretRef
+	if ref == nil {
+		registry, err := pkgregistry.DestinationRegistry(pkgregistry.WithDestination(destination.Repository))
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", p.Kind, p.Name, err)
+		}
+
+		controllerRegistry, err := pkgregistry.DestinationRegistry(base...)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s: %w", p.Kind, p.Name, err)
+		}
+
+		if registry != controllerRegistry {
+			return nil, fmt.Errorf("%s %s: a credentials Secret is required for the destination registry %s",
+				p.Kind, p.Name, registry)
+		}
+
+		return nil, nil
+	}
+
+	if len(p.secretNamespace) == 0 {
+		return nil, fmt.Errorf("%s %s: the namespace of the credentials Secret must be set", p.Kind, p.Name)
+	}
+
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: p.secretNamespace, Name: ref.Name}, secret); err != nil {
+		return nil, fmt.Errorf("%s %s: failed to get credentials Secret: %w", p.Kind, p.Name, err)
+	}
+
+	creds, err := credentialsFromSecret(secret)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: invalid credentials Secret: %w", p.Kind, p.Name, err)
+	}
+
+	return creds, nil
+}
+
+// PolicyWorkloads returns the function mapping a ClonePolicy or a ClusterClonePolicy to the
+// workloads of the kind selected by the filter which it may apply to: the ones of the namespace
+// of a ClonePolicy, and all of them for a ClusterClonePolicy. The selectors of the policy are
+// not matched, as the workloads it selected before being updated are affected as well.
+func PolicyWorkloads(reader client.Reader, workload Workload, filter WorkloadFilter,
+	log logr.Logger) handler.MapFunc {
+	return func(policy client.Object) []reconcile.Request {
+		list := workload.NewList()
+		if err := reader.List(context.Background(), list, client.InNamespace(policy.GetNamespace())); err != nil {
+			log.Error(err, "failed to list the workloads of the clone policy", "kind", workload.Kind,
+				"policy", policy.GetName(), "namespace", policy.GetNamespace())
+
+			return nil
+		}
+
+		objs, err := meta.ExtractList(list)
+		if err != nil {
+			log.Error(err, "failed to extract the workloads of the clone policy", "kind", workload.Kind)
+
+			return nil
+		}
+
+		requests := []reconcile.Request{}
+
+		for _, item := range objs {
+			obj, ok := item.(client.Object)
+			if !ok || !filter.Selects(obj) || IsOwnedByWorkload(obj) {
+				continue
+			}
+
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(obj)})
+		}
+
+		return requests
+	}
+}
@@ -0,0 +1,257 @@
+package controller_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	"github.com/impochi/cloner/pkg/controller"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// policyReader serves the given policies, namespaces and Deployments, without the CRD of the
+// ClusterClonePolicies when noClusterCRD is set.
+type policyReader struct {
+	deployments     []appsv1.Deployment
+	policies        []clonerv1alpha1.ClonePolicy
+	clusterPolicies []clonerv1alpha1.ClusterClonePolicy
+	namespaces      map[string]map[string]string
+	noClusterCRD    bool
+}
+
+func (r *policyReader) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	namespace, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return errors.NewNotFound(schema.GroupResource{}, key.Name)
+	}
+
+	namespace.Name = key.Name
+	namespace.Labels = r.namespaces[key.Name]
+
+	return nil
+}
+
+func (r *policyReader) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+
+	switch policies := list.(type) {
+	case *appsv1.DeploymentList:
+		for _, deployment := range r.deployments {
+			if len(listOpts.Namespace) == 0 || deployment.Namespace == listOpts.Namespace {
+				policies.Items = append(policies.Items, deployment)
+			}
+		}
+	case *clonerv1alpha1.ClonePolicyList:
+		for _, policy := range r.policies {
+			if policy.Namespace == listOpts.Namespace {
+				policies.Items = append(policies.Items, policy)
+			}
+		}
+	case *clonerv1alpha1.ClusterClonePolicyList:
+		if r.noClusterCRD {
+			return &meta.NoKindMatchError{GroupKind: schema.GroupKind{Group: clonerv1alpha1.GroupVersion.Group}}
+		}
+
+		policies.Items = r.clusterPolicies
+	}
+
+	return nil
+}
+
+//nolint:funlen
+func TestResolvePolicy(t *testing.T) {
+	reader := &policyReader{
+		policies: []clonerv1alpha1.ClonePolicy{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "b-all", Namespace: "team"},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "a-frontend", Namespace: "team"},
+				Spec: clonerv1alpha1.ClonePolicySpec{
+					Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "frontend"}},
+					Mode:     clonerv1alpha1.CloneModeMirrorOnly,
+				},
+			},
+		},
+		clusterPolicies: []clonerv1alpha1.ClusterClonePolicy{
+			{
+				ObjectMeta: metav1.ObjectMeta{Name: "production"},
+				Spec: clonerv1alpha1.ClusterClonePolicySpec{
+					NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"env": "production"}},
+				},
+			},
+		},
+		namespaces: map[string]map[string]string{
+			"shop": {"env": "production"},
+		},
+	}
+
+	cases := []struct {
+		namespace string
+		labels    map[string]string
+		wanted    string
+		rewrite   bool
+	}{
+		{
+			namespace: "team",
+			labels:    map[string]string{"tier": "frontend"},
+			wanted:    "team/a-frontend",
+			rewrite:   false,
+		},
+		{
+			namespace: "team",
+			labels:    map[string]string{"tier": "backend"},
+			wanted:    "team/b-all",
+			rewrite:   true,
+		},
+		{
+			namespace: "shop",
+			wanted:    "production",
+			rewrite:   true,
+		},
+		{
+			namespace: "default",
+			wanted:    "",
+			rewrite:   true,
+		},
+	}
+
+	for _, testcase := range cases {
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: testcase.namespace, Labels: testcase.labels},
+		}
+
+		policy, err := controller.ResolvePolicy(context.TODO(), reader, deployment)
+		if err != nil {
+			t.Fatalf("%s %v: failed to resolve policy: %v", testcase.namespace, testcase.labels, err)
+		}
+
+		name := ""
+		if policy != nil {
+			name = policy.Name
+		}
+
+		if name != testcase.wanted {
+			t.Errorf("%s %v: expected policy %q, got %q", testcase.namespace, testcase.labels, testcase.wanted, name)
+		}
+
+		if policy.Rewrite() != testcase.rewrite {
+			t.Errorf("%s %v: expected rewrite to be %t", testcase.namespace, testcase.labels, testcase.rewrite)
+		}
+	}
+}
+
+func TestResolvePolicyWithoutClusterCRD(t *testing.T) {
+	deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team"}}
+
+	policy, err := controller.ResolvePolicy(context.TODO(), &policyReader{noClusterCRD: true}, deployment)
+	if err != nil {
+		t.Fatalf("expected the missing CRD to be ignored, got %v", err)
+	}
+
+	if policy != nil {
+		t.Errorf("expected no policy, got %s", policy.Name)
+	}
+}
+
+func TestPolicyWorkloads(t *testing.T) {
+	reader := &policyReader{
+		deployments: []appsv1.Deployment{
+			{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "shop"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "kube-system"}},
+		},
+	}
+
+	deployments := controller.Workloads()[0]
+	filter := controller.WorkloadFilter{IgnoreNamespaces: []string{"kube-system"}}
+	workloads := controller.PolicyWorkloads(reader, deployments, filter, logr.Discard())
+
+	cases := []struct {
+		policy client.Object
+		wanted []string
+	}{
+		{
+			policy: &clonerv1alpha1.ClonePolicy{ObjectMeta: metav1.ObjectMeta{Name: "policy", Namespace: "team"}},
+			wanted: []string{"team/app"},
+		},
+		{
+			policy: &clonerv1alpha1.ClusterClonePolicy{ObjectMeta: metav1.ObjectMeta{Name: "policy"}},
+			wanted: []string{"team/app", "shop/app"},
+		},
+	}
+
+	for _, testcase := range cases {
+		requests := []string{}
+		for _, request := range workloads(testcase.policy) {
+			requests = append(requests, request.String())
+		}
+
+		if !reflect.DeepEqual(requests, testcase.wanted) {
+			t.Errorf("%T: expected requests %v, got %v", testcase.policy, testcase.wanted, requests)
+		}
+	}
+}
+
+func TestFollowsTags(t *testing.T) {
+	var none *controller.Policy
+	if !none.FollowsTags() {
+		t.Errorf("expected the tags to follow upstream without policy")
+	}
+
+	for updates, follows := range map[clonerv1alpha1.TagUpdatePolicy]bool{
+		"":                              true,
+		clonerv1alpha1.TagUpdatesFollow: true,
+		clonerv1alpha1.TagUpdatesFreeze: false,
+	} {
+		policy := &controller.Policy{Spec: clonerv1alpha1.ClonePolicySpec{TagUpdates: updates}}
+		if policy.FollowsTags() != follows {
+			t.Errorf("%q: expected follows to be %t", updates, follows)
+		}
+	}
+}
+
+func TestPolicyRegistryOptions(t *testing.T) {
+	base := []pkgregistry.Option{
+		pkgregistry.WithCredentials(&pkgregistry.Credentials{
+			Provider: "registry.example.com",
+			Username: "backup",
+			Password: "secret",
+		}),
+	}
+
+	cases := []struct {
+		repository string
+		rejected   bool
+	}{
+		{repository: "registry.example.com/team", rejected: false},
+		{repository: "quay.io/team", rejected: true},
+		{repository: "team", rejected: true},
+	}
+
+	for _, testcase := range cases {
+		policy := &controller.Policy{
+			Kind: "ClonePolicy",
+			Name: "team/policy",
+			Spec: clonerv1alpha1.ClonePolicySpec{
+				Destination: &clonerv1alpha1.Destination{Repository: testcase.repository},
+			},
+		}
+
+		_, err := policy.RegistryOptions(context.TODO(), &policyReader{}, base)
+		if rejected := err != nil; rejected != testcase.rejected {
+			t.Errorf("%s: expected rejected to be %t, got error %v", testcase.repository, testcase.rejected, err)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+const (
+	// BackupPullSecretName is the name of the image pull Secret of the destination registry,
+	// created in the namespaces of the workloads using image pull secrets.
+	BackupPullSecretName = "cloner-backup-registry"
+
+	defaultServiceAccountName = "default"
+)
+
+// pullSecrets returns the names of the image pull secrets used by the pods of the template,
+// either set in the template itself or in its ServiceAccount.
+func (cr *ClonerReconciler) pullSecrets(ctx context.Context, namespace string,
+	template *corev1.PodTemplateSpec) ([]string, error) {
+	secrets := []string{}
+
+	for _, secret := range template.Spec.ImagePullSecrets {
+		secrets = append(secrets, secret.Name)
+	}
+
+	serviceAccountName := template.Spec.ServiceAccountName
+	if len(serviceAccountName) == 0 {
+		serviceAccountName = defaultServiceAccountName
+	}
+
+	serviceAccount := &corev1.ServiceAccount{}
+
+	err := cr.APIReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: serviceAccountName}, serviceAccount)
+	if errors.IsNotFound(err) {
+		return secrets, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, secret := range serviceAccount.ImagePullSecrets {
+		secrets = append(secrets, secret.Name)
+	}
+
+	return secrets, nil
+}
+
+// sourceKeychain returns the keychain of the given `kubernetes.io/dockerconfigjson` image
+// pull secrets, used to pull the source images.
+func (cr *ClonerReconciler) sourceKeychain(ctx context.Context, namespace string,
+	secrets []string) (authn.Keychain, error) {
+	log := pkglog.FromContext(ctx)
+
+	configs := [][]byte{}
+
+	for _, name := range secrets {
+		// Only holds the credentials of the destination registry.
+		if name == BackupPullSecretName {
+			continue
+		}
+
+		secret := &corev1.Secret{}
+
+		err := cr.APIReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret)
+		if errors.IsNotFound(err) {
+			log.Info("image pull secret not found", "secret", name)
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if secret.Type != corev1.SecretTypeDockerConfigJson {
+			log.Info("ignoring image pull secret", "secret", name, "type", secret.Type)
+
+			continue
+		}
+
+		configs = append(configs, secret.Data[corev1.DockerConfigJsonKey])
+	}
+
+	return pkgregistry.NewDockerConfigKeychain(configs...)
+}
+
+// replacePullSecrets replaces the image pull secrets of the template by the BackupPullSecretName
+// Secret, as all the images are now pulled from the destination registry, which needs its own
+// credentials instead of the ones of the source registries. Only the pull-only credentials of
+// the destination registry are copied to the namespace of the object, the image pull secrets
+// are left untouched without them.
+func (cr *ClonerReconciler) replacePullSecrets(ctx context.Context, obj client.Object,
+	template *corev1.PodTemplateSpec, opts []pkgregistry.Option) error {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind)
+
+	pull := cr.PullCredentials.Load()
+	if pull == nil {
+		log.Info("keeping image pull secrets, no pull credentials of the destination registry")
+
+		return nil
+	}
+
+	dockerConfig, err := pkgregistry.PullDockerConfig(pull, opts...)
+	if err != nil {
+		log.Error(err, "invalid pull credentials of the destination registry")
+
+		return err
+	}
+
+	// The destination of a clone policy can be in another registry.
+	if dockerConfig == nil {
+		log.Info("keeping image pull secrets, the pull credentials are for another registry")
+
+		return nil
+	}
+
+	if err := cr.ensureBackupPullSecret(ctx, obj.GetNamespace(), dockerConfig); err != nil {
+		log.Error(err, "failed to create image pull secret of the destination registry")
+
+		return err
+	}
+
+	if err := AnnotatePullSecrets(obj, template); err != nil {
+		log.Error(err, "failed to annotate object")
+
+		return err
+	}
+
+	template.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: BackupPullSecretName}}
+
+	return nil
+}
+
+// ensureBackupPullSecret creates or updates the image pull Secret of the destination registry
+// in the given namespace, holding the given docker config.
+func (cr *ClonerReconciler) ensureBackupPullSecret(ctx context.Context, namespace string,
+	dockerConfig []byte) error {
+	secret := &corev1.Secret{}
+
+	err := cr.APIReader.Get(ctx, types.NamespacedName{Namespace: namespace, Name: BackupPullSecretName}, secret)
+	if errors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      BackupPullSecretName,
+				Namespace: namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "cloner",
+				},
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: dockerConfig,
+			},
+		}
+
+		return cr.Client.Create(ctx, secret)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(secret.Data[corev1.DockerConfigJsonKey], dockerConfig) {
+		return nil
+	}
+
+	secret.Data = map[string][]byte{
+		corev1.DockerConfigJsonKey: dockerConfig,
+	}
+
+	return cr.Client.Update(ctx, secret)
+}
@@ -0,0 +1,288 @@
+//nolint:testpackage
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+const quayConfig = `{"auths":{"quay.io":{"auth":"cXVheTpxdWF5cGFzcw=="}}}`
+
+// secretReader serves the given ServiceAccounts and Secrets, failing the reads of the objects
+// named `broken`.
+type secretReader struct {
+	serviceAccounts map[string]corev1.ServiceAccount
+	secrets         map[string]corev1.Secret
+}
+
+func (r *secretReader) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	if key.Name == "broken" {
+		return fmt.Errorf("failed to read %s", key.Name)
+	}
+
+	switch obj := obj.(type) {
+	case *corev1.ServiceAccount:
+		if serviceAccount, ok := r.serviceAccounts[key.Name]; ok {
+			serviceAccount.DeepCopyInto(obj)
+
+			return nil
+		}
+	case *corev1.Secret:
+		if secret, ok := r.secrets[key.Name]; ok {
+			secret.DeepCopyInto(obj)
+
+			return nil
+		}
+	}
+
+	return errors.NewNotFound(schema.GroupResource{}, key.Name)
+}
+
+func (r *secretReader) List(_ context.Context, _ client.ObjectList, _ ...client.ListOption) error {
+	return nil
+}
+
+func TestPullSecrets(t *testing.T) {
+	reader := &secretReader{
+		serviceAccounts: map[string]corev1.ServiceAccount{
+			"default": {ImagePullSecrets: []corev1.LocalObjectReference{{Name: "default-registry"}}},
+			"app":     {ImagePullSecrets: []corev1.LocalObjectReference{{Name: "app-registry"}}},
+		},
+	}
+
+	cases := []struct {
+		name           string
+		serviceAccount string
+		secrets        []string
+		expected       []string
+		err            bool
+	}{
+		{
+			name:     "default service account",
+			expected: []string{"default-registry"},
+		},
+		{
+			name:           "template and service account",
+			serviceAccount: "app",
+			secrets:        []string{"private"},
+			expected:       []string{"private", "app-registry"},
+		},
+		{
+			name:           "missing service account",
+			serviceAccount: "missing",
+			secrets:        []string{"private"},
+			expected:       []string{"private"},
+		},
+		{
+			name:           "unreadable service account",
+			serviceAccount: "broken",
+			err:            true,
+		},
+	}
+
+	for _, testcase := range cases {
+		template := &corev1.PodTemplateSpec{}
+		template.Spec.ServiceAccountName = testcase.serviceAccount
+
+		for _, secret := range testcase.secrets {
+			template.Spec.ImagePullSecrets = append(template.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: secret})
+		}
+
+		cr := &ClonerReconciler{APIReader: reader}
+
+		secrets, err := cr.pullSecrets(context.TODO(), "default", template)
+		if (err != nil) != testcase.err {
+			t.Fatalf("%s: expected error to be %t, got %v", testcase.name, testcase.err, err)
+		}
+
+		if fmt.Sprint(secrets) != fmt.Sprint(testcase.expected) {
+			t.Errorf("%s: expected secrets %v, got %v", testcase.name, testcase.expected, secrets)
+		}
+	}
+}
+
+//nolint:funlen
+func TestSourceKeychain(t *testing.T) {
+	reader := &secretReader{
+		secrets: map[string]corev1.Secret{
+			"quay": {
+				Type: corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(quayConfig)},
+			},
+			"opaque": {
+				Type: corev1.SecretTypeOpaque,
+				Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(quayConfig)},
+			},
+			BackupPullSecretName: {
+				ObjectMeta: metav1.ObjectMeta{Name: BackupPullSecretName},
+				Type:       corev1.SecretTypeDockerConfigJson,
+				Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(quayConfig)},
+			},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		secrets  []string
+		expected authn.AuthConfig
+		err      bool
+	}{
+		{
+			name:     "image pull secret",
+			secrets:  []string{"quay"},
+			expected: authn.AuthConfig{Auth: "cXVheTpxdWF5cGFzcw=="},
+		},
+		{
+			// The missing secrets are skipped, the pods failing to pull their images anyway.
+			name:     "missing secret",
+			secrets:  []string{"missing", "quay"},
+			expected: authn.AuthConfig{Auth: "cXVheTpxdWF5cGFzcw=="},
+		},
+		{
+			name:    "not a docker config",
+			secrets: []string{"opaque"},
+		},
+		{
+			// Only holds the credentials of the destination registry.
+			name:    "backup pull secret",
+			secrets: []string{BackupPullSecretName},
+		},
+		{
+			name:    "unreadable secret",
+			secrets: []string{"broken"},
+			err:     true,
+		},
+	}
+
+	ref, err := name.ParseReference("quay.io/prometheus/node-exporter")
+	if err != nil {
+		t.Fatalf("failed parsing reference: %v", err)
+	}
+
+	for _, testcase := range cases {
+		cr := &ClonerReconciler{APIReader: reader}
+
+		keychain, err := cr.sourceKeychain(context.TODO(), "default", testcase.secrets)
+		if (err != nil) != testcase.err {
+			t.Fatalf("%s: expected error to be %t, got %v", testcase.name, testcase.err, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		auth, err := keychain.Resolve(ref.Context())
+		if err != nil {
+			t.Fatalf("%s: failed to resolve credentials: %v", testcase.name, err)
+		}
+
+		config, err := auth.Authorization()
+		if err != nil {
+			t.Fatalf("%s: failed to get authorization: %v", testcase.name, err)
+		}
+
+		if *config != testcase.expected {
+			t.Errorf("%s: expected credentials %v, got %v", testcase.name, testcase.expected, *config)
+		}
+	}
+}
+
+// secretWriter records the Secrets created, the other writes are not expected.
+type secretWriter struct {
+	client.Client
+	created []*corev1.Secret
+}
+
+func (w *secretWriter) Create(_ context.Context, obj client.Object, _ ...client.CreateOption) error {
+	secret, ok := obj.(*corev1.Secret)
+	if !ok {
+		return fmt.Errorf("unexpected object %T", obj)
+	}
+
+	w.created = append(w.created, secret)
+
+	return nil
+}
+
+//nolint:funlen
+func TestReplacePullSecrets(t *testing.T) {
+	destination := pkgregistry.WithCredentials(&pkgregistry.Credentials{
+		Provider: "quay.io",
+		Username: "pusher",
+		Password: "pushpass",
+	})
+
+	cases := []struct {
+		name     string
+		pull     *pkgregistry.Credentials
+		replaced bool
+	}{
+		{
+			name:     "no pull credentials",
+			replaced: false,
+		},
+		{
+			name:     "pull credentials of another registry",
+			pull:     &pkgregistry.Credentials{Provider: "myregistry:5000", Username: "puller", Password: "pullpass"},
+			replaced: false,
+		},
+		{
+			name:     "pull credentials of the destination registry",
+			pull:     &pkgregistry.Credentials{Provider: "quay.io", Username: "puller", Password: "pullpass"},
+			replaced: true,
+		},
+	}
+
+	for _, testcase := range cases {
+		pull := &pkgregistry.CredentialsStore{}
+		if testcase.pull != nil {
+			pull.Store(testcase.pull)
+		}
+
+		writer := &secretWriter{}
+		cr := &ClonerReconciler{
+			Client:          writer,
+			APIReader:       &secretReader{},
+			Workload:        Workloads()[0],
+			PullCredentials: pull,
+		}
+
+		deployment := &appsv1.Deployment{}
+		template := &deployment.Spec.Template
+		template.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "quay"}}
+
+		err := cr.replacePullSecrets(context.TODO(), deployment, template, []pkgregistry.Option{destination})
+		if err != nil {
+			t.Fatalf("%s: failed to replace image pull secrets: %v", testcase.name, err)
+		}
+
+		replaced := template.Spec.ImagePullSecrets[0].Name == BackupPullSecretName
+		if replaced != testcase.replaced {
+			t.Errorf("%s: expected replaced to be %t, got secrets %v", testcase.name, testcase.replaced,
+				template.Spec.ImagePullSecrets)
+		}
+
+		for _, secret := range writer.created {
+			if strings.Contains(string(secret.Data[corev1.DockerConfigJsonKey]), "pushpass") {
+				t.Errorf("%s: expected the push credentials not to be copied", testcase.name)
+			}
+		}
+
+		if testcase.replaced && len(writer.created) != 1 {
+			t.Errorf("%s: expected the backup pull secret to be created", testcase.name)
+		}
+	}
+}
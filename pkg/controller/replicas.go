@@ -0,0 +1,222 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// replicaStatuses returns the status of the replicas copied at the given time. The replicas
+// which couldn't be copied are logged.
+func replicaStatuses(log logr.Logger, results []pkgregistry.ReplicaResult,
+	now metav1.Time) []clonerv1alpha1.ReplicaStatus {
+	statuses := []clonerv1alpha1.ReplicaStatus{}
+
+	for _, result := range results {
+		if result.Err != nil {
+			log.Error(result.Err, "failed to copy image to replica", "replica", result.Image)
+		}
+
+		// The replicas which couldn't be named are only logged.
+		if len(result.Image) == 0 {
+			continue
+		}
+
+		status := clonerv1alpha1.ReplicaStatus{Image: result.Image}
+
+		if result.Err != nil {
+			status.Error = result.Err.Error()
+		} else {
+			status.Digest = result.Digest
+			status.LastSyncTime = &now
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+// mergeReplicas returns the current replicas updated with the given ones. The digest and time
+// of the last successful copy of a replica are kept when it fails.
+func mergeReplicas(current, updates []clonerv1alpha1.ReplicaStatus) []clonerv1alpha1.ReplicaStatus {
+	for _, update := range updates {
+		found := false
+
+		for i := range current {
+			if current[i].Image != update.Image {
+				continue
+			}
+
+			found = true
+
+			if len(update.Error) != 0 {
+				current[i].Error = update.Error
+			} else {
+				current[i] = update
+			}
+		}
+
+		if !found {
+			current = append(current, update)
+		}
+	}
+
+	return current
+}
+
+// recordReplicas updates the replicas of the ImageMirror.
+func (r *MirrorRecorder) recordReplicas(ctx context.Context, name string,
+	replicas []clonerv1alpha1.ReplicaStatus) error {
+	var err error
+
+	for attempt := 0; attempt < maxConflictRetries; attempt++ {
+		mirror := &clonerv1alpha1.ImageMirror{}
+
+		if err = r.Client.Get(ctx, types.NamespacedName{Name: name}, mirror); err != nil {
+			return err
+		}
+
+		mirror.Status.Replicas = mergeReplicas(mirror.Status.Replicas, replicas)
+
+		err = r.Client.Status().Update(ctx, mirror)
+		if !apierrors.IsConflict(err) {
+			break
+		}
+	}
+
+	return err
+}
+
+// ReplicaOptions are the registries of ResyncReplicas.
+type ReplicaOptions struct {
+	// RegistrySecret holds the credentials of the destination registry, the REGISTRY_*
+	// environment variables are used when nil.
+	RegistrySecret *types.NamespacedName
+	// ReplicaSecrets hold the credentials of the replica registries.
+	ReplicaSecrets []types.NamespacedName
+	// DryRun only reports the replicas behind, nothing is copied.
+	DryRun bool
+}
+
+// ResyncReplicas copies the destination images recorded by the ImageMirrors to the replicas
+// which fell behind, e.g. after a replica registry was unavailable or added, reporting the
+// copies to out. Only the images of the destination repository of the controller are copied,
+// not the images backed up into the destinations of the clone policies.
+func ResyncReplicas(ctx context.Context, c client.Client, opts ReplicaOptions, out io.Writer) error {
+	if len(opts.ReplicaSecrets) == 0 {
+		return fmt.Errorf("no replica registry set")
+	}
+
+	registryOpts, err := replicaRegistryOptions(ctx, c, opts)
+	if err != nil {
+		return err
+	}
+
+	registryOpts = append(registryOpts, pkgregistry.WithContext(ctx))
+
+	mirrors := &clonerv1alpha1.ImageMirrorList{}
+	if err := c.List(ctx, mirrors); err != nil {
+		return fmt.Errorf("failed to list ImageMirrors: %w", err)
+	}
+
+	prefix := ""
+	if opts.DryRun {
+		prefix = "(dry run) "
+	}
+
+	recorder := &MirrorRecorder{Client: c}
+	failed := 0
+
+	for _, mirror := range mirrors.Items {
+		// The images never backed up have nothing to copy.
+		if len(mirror.Status.DestinationDigest) == 0 {
+			continue
+		}
+
+		dst := mirror.Spec.Destination
+
+		if opts.DryRun {
+			results := pkgregistry.CheckReplicas(dst, registryOpts...)
+			failed += reportReplicas(out, prefix, dst, results)
+
+			continue
+		}
+
+		results := pkgregistry.Replicate(dst, "", registryOpts...)
+		failed += reportReplicas(out, prefix, dst, results)
+
+		err := recorder.recordReplicas(ctx, mirror.Name, replicaStatuses(logr.Discard(), results, metav1.Now()))
+		if err != nil {
+			return fmt.Errorf("failed to record replicas of ImageMirror %s: %w", mirror.Name, err)
+		}
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("failed to copy %d images to their replicas", failed)
+	}
+
+	return nil
+}
+
+// reportReplicas writes the replicas copied to out, returning the number of failed copies.
+func reportReplicas(out io.Writer, prefix, dst string, results []pkgregistry.ReplicaResult) int {
+	failed := 0
+
+	for _, result := range results {
+		switch {
+		case errors.Is(result.Err, pkgregistry.ErrNotInDestination):
+			// The images of the destinations of the clone policies are not replicated.
+			continue
+		case result.Err != nil:
+			failed++
+
+			fmt.Fprintf(out, "%s%s: failed to copy to replica %s: %v\n", prefix, dst, result.Image, result.Err)
+		case result.Outdated:
+			fmt.Fprintf(out, "%s%s -> %s\n", prefix, dst, result.Image)
+		}
+	}
+
+	return failed
+}
+
+// replicaRegistryOptions returns the registry options of the destination and replica
+// registries, reading their credentials from their Secrets.
+func replicaRegistryOptions(ctx context.Context, c client.Client, opts ReplicaOptions) ([]pkgregistry.Option, error) {
+	registryOpts := []pkgregistry.Option{}
+
+	if opts.RegistrySecret != nil {
+		creds, err := readCredentials(ctx, c, *opts.RegistrySecret)
+		if err != nil {
+			return nil, err
+		}
+
+		registryOpts = append(registryOpts, pkgregistry.WithCredentials(creds))
+	}
+
+	replicas := []*pkgregistry.CredentialsStore{}
+
+	for _, secret := range opts.ReplicaSecrets {
+		creds, err := readCredentials(ctx, c, secret)
+		if err != nil {
+			return nil, err
+		}
+
+		store := &pkgregistry.CredentialsStore{}
+		store.Store(creds)
+
+		replicas = append(replicas, store)
+	}
+
+	return append(registryOpts, pkgregistry.WithReplicas(replicas...)), nil
+}
@@ -0,0 +1,231 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	"github.com/impochi/cloner/pkg/controller"
+)
+
+const staleIndex = `{"schemaVersion":2,"mediaType":"application/vnd.docker.distribution.manifest.list.v2+json",` +
+	`"manifests":[],"annotations":{"stale":"true"}}`
+
+// mirrorClient serves the given Secrets and ImageMirrors, recording the updates of the status of
+// the ImageMirrors.
+type mirrorClient struct {
+	client.Client
+
+	secrets map[string]corev1.Secret
+	mirrors []clonerv1alpha1.ImageMirror
+	updated []clonerv1alpha1.ImageMirror
+}
+
+func (c *mirrorClient) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	switch obj := obj.(type) {
+	case *corev1.Secret:
+		if secret, ok := c.secrets[key.Name]; ok {
+			secret.DeepCopyInto(obj)
+
+			return nil
+		}
+	case *clonerv1alpha1.ImageMirror:
+		for _, mirror := range c.mirrors {
+			if mirror.Name == key.Name {
+				mirror.DeepCopyInto(obj)
+
+				return nil
+			}
+		}
+	}
+
+	return errors.NewNotFound(schema.GroupResource{}, key.Name)
+}
+
+func (c *mirrorClient) List(_ context.Context, list client.ObjectList, _ ...client.ListOption) error {
+	if mirrors, ok := list.(*clonerv1alpha1.ImageMirrorList); ok {
+		mirrors.Items = c.mirrors
+	}
+
+	return nil
+}
+
+func (c *mirrorClient) Status() client.StatusWriter {
+	return c
+}
+
+func (c *mirrorClient) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	if mirror, ok := obj.(*clonerv1alpha1.ImageMirror); ok {
+		c.updated = append(c.updated, *mirror)
+	}
+
+	return nil
+}
+
+func (c *mirrorClient) Patch(_ context.Context, _ client.Object, _ client.Patch, _ ...client.PatchOption) error {
+	return fmt.Errorf("unexpected patch")
+}
+
+// newReplicaRegistry serves the destination image of the `foo` repository, the same image in
+// the `current` replica, another image in the `stale` replica and no image in the `missing`
+// replica, recording the manifests pushed.
+func newReplicaRegistry(pushed *[]string, mu *sync.Mutex) *httptest.Server {
+	serve := func(w http.ResponseWriter, r *http.Request, index string) {
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.list.v2+json")
+		w.Header().Set("Content-Length", fmt.Sprint(len(index)))
+		w.Header().Set("Docker-Content-Digest", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(index))))
+
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(index))
+		}
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/v2/":
+			w.WriteHeader(http.StatusOK)
+		case r.Method == http.MethodPut:
+			mu.Lock()
+			*pushed = append(*pushed, r.URL.Path)
+			mu.Unlock()
+
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasPrefix(r.URL.Path, "/v2/foo/"), strings.HasPrefix(r.URL.Path, "/v2/current/"):
+			serve(w, r, sourceIndex)
+		case strings.HasPrefix(r.URL.Path, "/v2/stale/"):
+			serve(w, r, staleIndex)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func basicAuthSecret(host, username string) corev1.Secret {
+	return corev1.Secret{
+		Type: corev1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			corev1.BasicAuthUsernameKey: []byte(username),
+			corev1.BasicAuthPasswordKey: []byte("password"),
+			"provider":                  []byte(host),
+		},
+	}
+}
+
+//nolint:funlen
+func TestResyncReplicas(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushed []string
+	)
+
+	server := newReplicaRegistry(&pushed, &mu)
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(sourceIndex)))
+
+	cases := []struct {
+		dryRun bool
+		output string
+		pushed []string
+	}{
+		{
+			dryRun: true,
+			output: fmt.Sprintf("(dry run) %[1]s/foo/nginx:1.21 -> %[1]s/missing/nginx:1.21\n"+
+				"(dry run) %[1]s/foo/nginx:1.21 -> %[1]s/stale/nginx:1.21\n", host),
+			pushed: []string{},
+		},
+		{
+			output: fmt.Sprintf("%[1]s/foo/nginx:1.21 -> %[1]s/missing/nginx:1.21\n"+
+				"%[1]s/foo/nginx:1.21 -> %[1]s/stale/nginx:1.21\n", host),
+			pushed: []string{"/v2/missing/nginx/manifests/1.21", "/v2/stale/nginx/manifests/1.21"},
+		},
+	}
+
+	for _, testcase := range cases {
+		pushed = []string{}
+		c := &mirrorClient{
+			secrets: map[string]corev1.Secret{
+				"registry": basicAuthSecret(host, "foo"),
+				"current":  basicAuthSecret(host, "current"),
+				"missing":  basicAuthSecret(host, "missing"),
+				"stale":    basicAuthSecret(host, "stale"),
+			},
+			mirrors: []clonerv1alpha1.ImageMirror{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+					Spec: clonerv1alpha1.ImageMirrorSpec{
+						Source:      "nginx:1.21",
+						Destination: host + "/foo/nginx:1.21",
+					},
+					Status: clonerv1alpha1.ImageMirrorStatus{DestinationDigest: digest},
+				},
+				{
+					// Never backed up, nothing is copied.
+					ObjectMeta: metav1.ObjectMeta{Name: "redis"},
+					Spec: clonerv1alpha1.ImageMirrorSpec{
+						Source:      "redis:6",
+						Destination: host + "/foo/redis:6",
+					},
+				},
+			},
+		}
+
+		opts := controller.ReplicaOptions{
+			RegistrySecret: &types.NamespacedName{Name: "registry"},
+			ReplicaSecrets: []types.NamespacedName{{Name: "current"}, {Name: "missing"}, {Name: "stale"}},
+			DryRun:         testcase.dryRun,
+		}
+
+		out := &bytes.Buffer{}
+		if err := controller.ResyncReplicas(context.TODO(), c, opts, out); err != nil {
+			t.Fatalf("dry run %t: failed to resync replicas: %v", testcase.dryRun, err)
+		}
+
+		if out.String() != testcase.output {
+			t.Errorf("dry run %t: expected output %q, got %q", testcase.dryRun, testcase.output, out.String())
+		}
+
+		mu.Lock()
+		// The replicas are copied at the same time.
+		sort.Strings(pushed)
+
+		if strings.Join(pushed, ",") != strings.Join(testcase.pushed, ",") {
+			t.Errorf("dry run %t: expected %v to be pushed, got %v", testcase.dryRun, testcase.pushed, pushed)
+		}
+		mu.Unlock()
+
+		if testcase.dryRun {
+			if len(c.updated) != 0 {
+				t.Errorf("dry run: expected no ImageMirror to be updated, got %v", c.updated)
+			}
+
+			continue
+		}
+
+		if len(c.updated) != 1 || len(c.updated[0].Status.Replicas) != 3 {
+			t.Fatalf("expected the replicas of the ImageMirror to be recorded, got %v", c.updated)
+		}
+
+		for _, replica := range c.updated[0].Status.Replicas {
+			if replica.Digest != digest || len(replica.Error) != 0 {
+				t.Errorf("expected replica %s to hold %s, got %+v", replica.Image, digest, replica)
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// Mode is the mode the controller runs in.
+type Mode string
+
+const (
+	// ModeClone backs up the images of the workloads and rewrites them. This is the default.
+	ModeClone Mode = "clone"
+	// ModeRestore puts back the original images of the workloads rewritten by the controller.
+	ModeRestore Mode = "restore"
+)
+
+// ParseMode parses the mode provided by the user.
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(mode) {
+	case ModeClone, ModeRestore:
+		return Mode(mode), nil
+	default:
+		return "", fmt.Errorf("invalid mode %q, must be one of %q or %q", mode, ModeClone, ModeRestore)
+	}
+}
+
+// RestoreWorkload puts back the original images and image pull secrets of the pod template of
+// the object, and removes the annotations of the rewrite. Only the containers still using the
+// destination image they were rewritten to are restored, the containers whose image was changed
+// since are left alone. Returns the images changed, and whether the object was changed at all.
+func RestoreWorkload(obj client.Object, template *corev1.PodTemplateSpec) ([]ImageChange, bool, error) {
+	annotations := obj.GetAnnotations()
+
+	if _, ok := annotations[AnnotationOriginalImages]; !ok {
+		return nil, false, nil
+	}
+
+	originals, err := annotationMap(annotations, AnnotationOriginalImages)
+	if err != nil {
+		return nil, false, err
+	}
+
+	mirrors, err := annotationMap(annotations, AnnotationMirrorImages)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The destination images are not known for the workloads rewritten before they were
+	// recorded, all their rewritten containers are restored.
+	_, recorded := annotations[AnnotationMirrorImages]
+
+	changes := []ImageChange{}
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for index, container := range containers {
+			original, ok := originals[container.Name]
+			if !ok || original == container.Image {
+				continue
+			}
+
+			mirror, ok := mirrors[container.Name]
+			if recorded && (!ok || pkgregistry.UnpinDigest(container.Image) != pkgregistry.UnpinDigest(mirror)) {
+				continue
+			}
+
+			changes = append(changes, ImageChange{Container: container.Name, From: container.Image, To: original})
+			containers[index].Image = original
+		}
+	}
+
+	if err := restorePullSecrets(annotations, template); err != nil {
+		return nil, false, err
+	}
+
+	for _, key := range []string{
+		AnnotationOriginalImages, AnnotationMirrorDigests, AnnotationMirrorImages, AnnotationLastCloned,
+		AnnotationOriginalPullSecrets,
+	} {
+		delete(annotations, key)
+	}
+
+	obj.SetAnnotations(annotations)
+
+	return changes, true, nil
+}
+
+// restorePullSecrets puts back the original image pull secrets of the pod template, unless they
+// were changed since.
+func restorePullSecrets(annotations map[string]string, template *corev1.PodTemplateSpec) error {
+	secrets, ok, err := originalPullSecrets(annotations)
+	if err != nil {
+		return err
+	}
+
+	if !ok || !isBackupPullSecret(template.Spec.ImagePullSecrets) {
+		return nil
+	}
+
+	template.Spec.ImagePullSecrets = nil
+	for _, secret := range secrets {
+		template.Spec.ImagePullSecrets = append(template.Spec.ImagePullSecrets,
+			corev1.LocalObjectReference{Name: secret})
+	}
+
+	return nil
+}
+
+// RestoreOptions selects the workloads restored by Restore.
+type RestoreOptions struct {
+	// Namespace restricts the workloads to a namespace, all the namespaces when empty.
+	Namespace string
+	// Kind restricts the workloads to a kind, e.g. `Deployment`, all the kinds when empty.
+	Kind string
+	// Name restricts the workloads to a single workload, Namespace and Kind must be set.
+	Name string
+	// DryRun only reports the changes, the workloads are left untouched.
+	DryRun bool
+}
+
+// Restore puts back the original images of the selected workloads, reporting the changes to
+// out.
+func Restore(ctx context.Context, c client.Client, opts RestoreOptions, out io.Writer) error {
+	if len(opts.Name) != 0 && (len(opts.Namespace) == 0 || len(opts.Kind) == 0) {
+		return fmt.Errorf("the namespace and kind must be set to restore a single workload")
+	}
+
+	found := false
+
+	for _, workload := range Workloads() {
+		if len(opts.Kind) != 0 && !strings.EqualFold(opts.Kind, workload.Kind) {
+			continue
+		}
+
+		found = true
+
+		if err := restoreKind(ctx, c, workload, opts, out); err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("unknown kind %q", opts.Kind)
+	}
+
+	return nil
+}
+
+func restoreKind(ctx context.Context, c client.Client, workload Workload, opts RestoreOptions, out io.Writer) error {
+	list := workload.NewList()
+	if err := c.List(ctx, list, client.InNamespace(opts.Namespace)); err != nil {
+		return fmt.Errorf("failed to list %s: %w", workload.Kind, err)
+	}
+
+	objs, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+
+	prefix := ""
+	if opts.DryRun {
+		prefix = "(dry run) "
+	}
+
+	for _, item := range objs {
+		obj, ok := item.(client.Object)
+		if !ok || IsOwnedByWorkload(obj) || (len(opts.Name) != 0 && obj.GetName() != opts.Name) {
+			continue
+		}
+
+		changes, changed, err := RestoreWorkload(obj, workload.PodTemplate(obj))
+		if err != nil {
+			return fmt.Errorf("%s %s/%s: %w", workload.Kind, obj.GetNamespace(), obj.GetName(), err)
+		}
+
+		if !changed {
+			continue
+		}
+
+		if workload.Immutable {
+			fmt.Fprintf(out, "%s%s %s/%s: pod template is immutable, skipped\n",
+				prefix, workload.Kind, obj.GetNamespace(), obj.GetName())
+
+			continue
+		}
+
+		if len(changes) == 0 {
+			fmt.Fprintf(out, "%s%s %s/%s: images already restored, removing annotations\n",
+				prefix, workload.Kind, obj.GetNamespace(), obj.GetName())
+		}
+
+		for _, change := range changes {
+			fmt.Fprintf(out, "%s%s %s/%s: container %s: %s -> %s\n",
+				prefix, workload.Kind, obj.GetNamespace(), obj.GetName(), change.Container, change.From, change.To)
+		}
+
+		if opts.DryRun {
+			continue
+		}
+
+		if err := c.Update(ctx, obj); err != nil {
+			return fmt.Errorf("failed to update %s %s/%s: %w", workload.Kind, obj.GetNamespace(), obj.GetName(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,288 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/impochi/cloner/pkg/controller"
+)
+
+func TestRestoreWorkload(t *testing.T) {
+	deployment := &appsv1.Deployment{}
+	template := &deployment.Spec.Template
+	template.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "private"}}
+	template.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "quay.io/foo/busybox"}}
+	template.Spec.Containers = []corev1.Container{
+		{Name: "nginx", Image: "quay.io/foo/nginx:1.21@sha256:" + strings.Repeat("a", 64)},
+		{Name: "added", Image: "alpine"},
+		{Name: "changed", Image: "quay.io/foo/redis:6"},
+	}
+
+	if err := controller.AnnotatePullSecrets(deployment, template); err != nil {
+		t.Fatalf("failed to annotate pull secrets: %v", err)
+	}
+
+	template.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: controller.BackupPullSecretName}}
+
+	if err := controller.AnnotateRewrite(deployment, []controller.BackedUpImage{
+		{Container: "init", Source: "busybox", Destination: "quay.io/foo/busybox"},
+		{Container: "nginx", Source: "nginx:1.21", Destination: "quay.io/foo/nginx:1.21"},
+		{Container: "changed", Source: "redis:6", Destination: "quay.io/foo/redis:6"},
+	}, time.Now()); err != nil {
+		t.Fatalf("failed to annotate: %v", err)
+	}
+
+	// The user pointed the container at another image after it was backed up.
+	template.Spec.Containers[2].Image = "redis:7"
+
+	deployment.Annotations["unrelated"] = "kept"
+
+	changes, changed, err := controller.RestoreWorkload(deployment, template)
+	if err != nil {
+		t.Fatalf("failed to restore: %v", err)
+	}
+
+	if !changed || len(changes) != 2 {
+		t.Fatalf("expected 2 changes, got %v", changes)
+	}
+
+	if template.Spec.InitContainers[0].Image != "busybox" || template.Spec.Containers[0].Image != "nginx:1.21" ||
+		template.Spec.Containers[1].Image != "alpine" || template.Spec.Containers[2].Image != "redis:7" {
+		t.Errorf("unexpected images after restore: %v %v", template.Spec.InitContainers, template.Spec.Containers)
+	}
+
+	if len(template.Spec.ImagePullSecrets) != 1 || template.Spec.ImagePullSecrets[0].Name != "private" {
+		t.Errorf("expected the original image pull secrets, got %v", template.Spec.ImagePullSecrets)
+	}
+
+	if len(deployment.Annotations) != 1 || deployment.Annotations["unrelated"] != "kept" {
+		t.Errorf("expected only the unrelated annotation to be left, got %v", deployment.Annotations)
+	}
+
+	if _, changed, _ := controller.RestoreWorkload(deployment, template); changed {
+		t.Errorf("expected a restored workload to be left unchanged")
+	}
+}
+
+func TestRestoreWorkloadWithoutMirrorImages(t *testing.T) {
+	deployment := &appsv1.Deployment{}
+	deployment.Annotations = map[string]string{controller.AnnotationOriginalImages: `{"nginx":"nginx:1.21"}`}
+
+	template := &deployment.Spec.Template
+	template.Spec.Containers = []corev1.Container{{Name: "nginx", Image: "quay.io/foo/nginx:1.21"}}
+
+	// The workloads rewritten before the destination images were recorded are restored.
+	changes, changed, err := controller.RestoreWorkload(deployment, template)
+	if err != nil || !changed || len(changes) != 1 || template.Spec.Containers[0].Image != "nginx:1.21" {
+		t.Errorf("expected nginx to be restored, got %v (%v)", changes, err)
+	}
+}
+
+// restoreClient lists the given Deployments, ReplicaSets and Jobs in the namespace of the
+// request, recording the workloads updated.
+type restoreClient struct {
+	client.Client
+
+	deployments []appsv1.Deployment
+	replicaSets []appsv1.ReplicaSet
+	jobs        []batchv1.Job
+	updated     []string
+}
+
+func (c *restoreClient) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	listOpts := &client.ListOptions{}
+	listOpts.ApplyOptions(opts)
+
+	inNamespace := func(obj metav1.Object) bool {
+		return len(listOpts.Namespace) == 0 || obj.GetNamespace() == listOpts.Namespace
+	}
+
+	switch list := list.(type) {
+	case *appsv1.DeploymentList:
+		for _, deployment := range c.deployments {
+			if inNamespace(&deployment) {
+				list.Items = append(list.Items, deployment)
+			}
+		}
+	case *appsv1.ReplicaSetList:
+		for _, replicaSet := range c.replicaSets {
+			if inNamespace(&replicaSet) {
+				list.Items = append(list.Items, replicaSet)
+			}
+		}
+	case *batchv1.JobList:
+		for _, job := range c.jobs {
+			if inNamespace(&job) {
+				list.Items = append(list.Items, job)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *restoreClient) Update(_ context.Context, obj client.Object, _ ...client.UpdateOption) error {
+	c.updated = append(c.updated, fmt.Sprintf("%s/%s", obj.GetNamespace(), obj.GetName()))
+
+	return nil
+}
+
+// rewrittenTemplate returns the pod template of a container rewritten from image to its copy in
+// quay.io, annotating obj with the rewrite.
+func rewrittenTemplate(t *testing.T, obj client.Object, image string) corev1.PodTemplateSpec {
+	t.Helper()
+
+	destination := "quay.io/foo/" + image
+
+	if err := controller.AnnotateRewrite(obj, []controller.BackedUpImage{
+		{Container: "main", Source: image, Destination: destination},
+	}, time.Now()); err != nil {
+		t.Fatalf("failed to annotate: %v", err)
+	}
+
+	template := corev1.PodTemplateSpec{}
+	template.Spec.Containers = []corev1.Container{{Name: "main", Image: destination}}
+
+	return template
+}
+
+// newRestoreClient serves the rewritten Deployments default/web and other/api with their
+// ReplicaSets, the Deployment default/plain never rewritten and the rewritten Job default/batch.
+func newRestoreClient(t *testing.T) *restoreClient {
+	t.Helper()
+
+	c := &restoreClient{}
+
+	for _, workload := range []struct{ namespace, name, image string }{
+		{namespace: "default", name: "web", image: "nginx:1.21"},
+		{namespace: "other", name: "api", image: "redis:6"},
+	} {
+		deployment := appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: workload.namespace, Name: workload.name}}
+		deployment.Spec.Template = rewrittenTemplate(t, &deployment, workload.image)
+
+		controllerRef := true
+		replicaSet := appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{
+			Namespace: workload.namespace,
+			Name:      workload.name + "-5d4f8",
+			OwnerReferences: []metav1.OwnerReference{
+				{APIVersion: "apps/v1", Kind: "Deployment", Name: workload.name, Controller: &controllerRef},
+			},
+		}}
+		replicaSet.Spec.Template = rewrittenTemplate(t, &replicaSet, workload.image)
+
+		c.deployments = append(c.deployments, deployment)
+		c.replicaSets = append(c.replicaSets, replicaSet)
+	}
+
+	plain := appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "plain"}}
+	plain.Spec.Template.Spec.Containers = []corev1.Container{{Name: "main", Image: "alpine"}}
+	c.deployments = append(c.deployments, plain)
+
+	job := batchv1.Job{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "batch"}}
+	job.Spec.Template = rewrittenTemplate(t, &job, "busybox")
+	c.jobs = append(c.jobs, job)
+
+	return c
+}
+
+//nolint:funlen
+func TestRestore(t *testing.T) {
+	web := "Deployment default/web: container main: quay.io/foo/nginx:1.21 -> nginx:1.21\n"
+	api := "Deployment other/api: container main: quay.io/foo/redis:6 -> redis:6\n"
+	batch := "Job default/batch: pod template is immutable, skipped\n"
+
+	cases := []struct {
+		name    string
+		opts    controller.RestoreOptions
+		output  string
+		updated []string
+		err     bool
+	}{
+		{
+			name:    "all namespaces",
+			output:  web + api + batch,
+			updated: []string{"default/web", "other/api"},
+		},
+		{
+			name:    "namespace",
+			opts:    controller.RestoreOptions{Namespace: "other"},
+			output:  api,
+			updated: []string{"other/api"},
+		},
+		{
+			name:    "kind",
+			opts:    controller.RestoreOptions{Namespace: "default", Kind: "deployment"},
+			output:  web,
+			updated: []string{"default/web"},
+		},
+		{
+			name:    "workload",
+			opts:    controller.RestoreOptions{Namespace: "other", Kind: "Deployment", Name: "api"},
+			output:  api,
+			updated: []string{"other/api"},
+		},
+		{
+			name:   "dry run",
+			opts:   controller.RestoreOptions{Namespace: "default", DryRun: true},
+			output: "(dry run) " + web + "(dry run) " + batch,
+		},
+		{
+			name: "workload without kind",
+			opts: controller.RestoreOptions{Namespace: "other", Name: "api"},
+			err:  true,
+		},
+		{
+			name: "unknown kind",
+			opts: controller.RestoreOptions{Kind: "Pod"},
+			err:  true,
+		},
+	}
+
+	for _, testcase := range cases {
+		c := newRestoreClient(t)
+		out := &bytes.Buffer{}
+
+		err := controller.Restore(context.TODO(), c, testcase.opts, out)
+		if testcase.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", testcase.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: failed to restore: %v", testcase.name, err)
+		}
+
+		if out.String() != testcase.output {
+			t.Errorf("%s: expected output %q, got %q", testcase.name, testcase.output, out.String())
+		}
+
+		if strings.Join(c.updated, ",") != strings.Join(testcase.updated, ",") {
+			t.Errorf("%s: expected %v to be updated, got %v", testcase.name, testcase.updated, c.updated)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range []string{"clone", "restore"} {
+		if _, err := controller.ParseMode(mode); err != nil {
+			t.Errorf("expected %q to be valid: %v", mode, err)
+		}
+	}
+
+	if _, err := controller.ParseMode("uninstall"); err == nil {
+		t.Errorf("expected `uninstall` to be invalid")
+	}
+}
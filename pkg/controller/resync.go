@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/google/go-containerregistry/pkg/name"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	"github.com/impochi/cloner/pkg/metrics"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// resyncWorkload backs up again the original images of the rewritten containers of the object
+// whose source tags moved upstream, unless the policy freezes the backed up tags. The
+// containers pinned by digest are pinned to the new digest. Nothing is done when the resync is
+// disabled, otherwise the object is reconciled again after ResyncPeriod, unless it is retried
+// sooner. The frozen tags are only reported once, until they are in sync again.
+func (cr *ClonerReconciler) resyncWorkload(ctx context.Context, obj client.Object, template *corev1.PodTemplateSpec,
+	workload *clonerv1alpha1.WorkloadReference, scope string, policy *Policy,
+	opts []pkgregistry.Option) (reconcile.Result, error) {
+	if cr.ResyncPeriod <= 0 {
+		return reconcile.Result{}, nil
+	}
+
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind)
+
+	originals, err := annotationMap(obj.GetAnnotations(), AnnotationOriginalImages)
+	if err != nil {
+		log.Error(err, "failed to read original images")
+
+		return reconcile.Result{RequeueAfter: cr.ResyncPeriod}, nil
+	}
+
+	images, pending, repinned, err := cr.resyncContainers(ctx, obj, template, originals, workload, scope, policy, opts)
+	if err != nil {
+		return cr.resyncFailed(log, err)
+	}
+
+	if pending {
+		log.Info("waiting for images changed upstream to be backed up")
+
+		return reconcile.Result{RequeueAfter: cr.Copier.pollInterval()}, nil
+	}
+
+	if len(images) == 0 {
+		return reconcile.Result{RequeueAfter: cr.ResyncPeriod}, nil
+	}
+
+	// The pod template is left unchanged unless containers are pinned by digest, the
+	// annotations record the new digests.
+	if err := AnnotateRewrite(obj, images, time.Now()); err != nil {
+		log.Error(err, "failed to annotate object")
+
+		return reconcile.Result{}, err
+	}
+
+	if err := cr.Client.Update(ctx, obj); err != nil {
+		log.Error(err, "failed to update object")
+
+		return reconcile.Result{}, err
+	}
+
+	containers := []string{}
+	for _, image := range images {
+		containers = append(containers, image.Container)
+	}
+
+	pinned := ""
+	if repinned {
+		pinned = ", pinned to their new digests"
+	}
+
+	cr.Recorder.Eventf(obj, corev1.EventTypeNormal, EventImageResynced,
+		"Backed up again the images of containers %s changed upstream%s", strings.Join(containers, ", "), pinned)
+
+	return reconcile.Result{RequeueAfter: cr.ResyncPeriod}, nil
+}
+
+// resyncContainers backs up again the original images of the rewritten containers of the
+// template changed upstream, as resyncWorkload. Returns the images backed up again, whether some
+// of them are still being backed up by the Copier, and whether containers were pinned to their
+// new digest.
+func (cr *ClonerReconciler) resyncContainers(ctx context.Context, obj client.Object, template *corev1.PodTemplateSpec,
+	originals map[string]string, workload *clonerv1alpha1.WorkloadReference, scope string, policy *Policy,
+	opts []pkgregistry.Option) ([]BackedUpImage, bool, bool, error) {
+	images := []BackedUpImage{}
+	pending := false
+	repinned := false
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for index, container := range containers {
+			original, ok := originals[container.Name]
+			if !ok || SkipsContainer(obj, container.Name) || isPinned(original) {
+				continue
+			}
+
+			// Only the containers still using the backup of their original image are resynced,
+			// pinned by digest or not.
+			dstImage, err := pkgregistry.GetDestinationImage(original, opts...)
+			if err != nil || dstImage != pkgregistry.UnpinDigest(container.Image) {
+				continue
+			}
+
+			image, waiting, err := cr.resyncImage(ctx, obj, policy, CopyRequest{
+				Workload:    workload,
+				Container:   container.Name,
+				Source:      original,
+				Destination: dstImage,
+				Scope:       scope,
+				Options:     opts,
+			})
+			if err != nil {
+				return nil, false, false, err
+			}
+
+			pending = pending || waiting
+
+			if image == nil {
+				continue
+			}
+
+			if container.Image != dstImage {
+				containers[index].Image = image.ContainerImage(true)
+				repinned = true
+			}
+
+			images = append(images, *image)
+		}
+	}
+
+	return images, pending, repinned, nil
+}
+
+// resyncImage backs up again the original image of a container if it changed upstream and the
+// policy follows the source tags. Returns the image backed up again, nil when unchanged, frozen
+// or still being backed up by the Copier, and whether it is still being backed up.
+func (cr *ClonerReconciler) resyncImage(ctx context.Context, obj client.Object, policy *Policy,
+	request CopyRequest) (*BackedUpImage, bool, error) {
+	log := pkglog.FromContext(ctx).WithValues("kind", cr.Workload.Kind, "image", request.Source)
+
+	backedUp, err := pkgregistry.IsBackedUp(request.Source, request.Destination, request.Options...)
+	if err != nil {
+		log.Error(err, "failed to check source image")
+
+		return nil, false, err
+	}
+
+	tag := frozenTag{
+		workload:  types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()},
+		container: request.Container,
+	}
+
+	if backedUp {
+		cr.frozen.unfreeze(tag)
+
+		return nil, false, nil
+	}
+
+	if !policy.FollowsTags() {
+		if cr.frozen.freeze(tag, request.Source) {
+			log.Info("source tag moved upstream, backed up tag kept frozen")
+			metrics.UpstreamChanged(cr.Workload.Kind, "frozen")
+			cr.Recorder.Eventf(obj, corev1.EventTypeNormal, EventUpstreamChanged,
+				"Image %s of container %s changed upstream, %s kept frozen", request.Source, request.Container,
+				request.Destination)
+		}
+
+		return nil, false, nil
+	}
+
+	cr.frozen.unfreeze(tag)
+
+	image, done, err := cr.backupImage(ctx, request)
+	if err != nil {
+		log.Error(err, "failed to push image")
+		cr.Recorder.Eventf(obj, corev1.EventTypeWarning, EventImageCloneFailed,
+			"Failed to back up image %s of container %s changed upstream: %v", request.Source, request.Container, err)
+
+		return nil, false, err
+	}
+
+	if !done {
+		return nil, true, nil
+	}
+
+	log.Info("source tag moved upstream, backed up again", "digest", image.SourceDigest)
+	metrics.UpstreamChanged(cr.Workload.Kind, "resynced")
+
+	return &image, false, nil
+}
+
+// resyncFailed returns the result of a resync whose images couldn't be checked or backed up,
+// as backupFailed. The object is resynced again after ResyncPeriod when it is not retried.
+func (cr *ClonerReconciler) resyncFailed(log logr.Logger, err error) (reconcile.Result, error) {
+	result, err := backupFailed(log, err)
+	if err == nil && result.RequeueAfter <= 0 {
+		result.RequeueAfter = cr.ResyncPeriod
+	}
+
+	return result, err
+}
+
+// frozenTags remembers the source tags of the containers found moved upstream and kept frozen,
+// so that they are only reported once.
+type frozenTags struct {
+	mu   sync.Mutex
+	tags map[frozenTag]string
+}
+
+type frozenTag struct {
+	workload  types.NamespacedName
+	container string
+}
+
+// freeze records the source image of the container as kept frozen. Returns whether it was not
+// frozen yet.
+func (f *frozenTags) freeze(tag frozenTag, image string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.tags == nil {
+		f.tags = map[frozenTag]string{}
+	}
+
+	if f.tags[tag] == image {
+		return false
+	}
+
+	f.tags[tag] = image
+
+	return true
+}
+
+// unfreeze forgets the source image of the container, in sync with its backup again.
+func (f *frozenTags) unfreeze(tag frozenTag) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.tags, tag)
+}
+
+// forget forgets the source images of the containers of a deleted workload.
+func (f *frozenTags) forget(workload types.NamespacedName) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for tag := range f.tags {
+		if tag.workload == workload {
+			delete(f.tags, tag)
+		}
+	}
+}
+
+// isPinned reports whether the image is pinned by digest, and can't change upstream.
+func isPinned(image string) bool {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return false
+	}
+
+	_, ok := ref.(name.Digest)
+
+	return ok
+}
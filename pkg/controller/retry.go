@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// backupFailed returns the result of a reconciliation whose images couldn't be backed up. The
+// object is reconciled again once the delay requested by a throttling registry is over, and not
+// retried at all on permanent errors. The other errors are retried with backoff.
+func backupFailed(log logr.Logger, err error) (reconcile.Result, error) {
+	var registryErr *pkgregistry.Error
+	if !errors.As(err, &registryErr) {
+		return reconcile.Result{}, err
+	}
+
+	switch {
+	case registryErr.Kind == pkgregistry.ErrorRateLimited:
+		log.Info("registry rate limit reached, retrying later",
+			"registry", registryErr.Registry, "retryAfter", registryErr.RetryAfter)
+
+		return reconcile.Result{RequeueAfter: registryErr.RetryAfter}, nil
+	case isPermanent(err):
+		log.Info("not retrying until the object changes", "reason", registryErr.Kind)
+
+		return reconcile.Result{}, nil
+	default:
+		return reconcile.Result{}, err
+	}
+}
+
+// resultTTL returns how long the result of a copy is kept: until the delay requested by a
+// throttling registry is over, or copyResultTTL.
+func resultTTL(err error) time.Duration {
+	var registryErr *pkgregistry.Error
+	if errors.As(err, &registryErr) && registryErr.Kind == pkgregistry.ErrorRateLimited {
+		return registryErr.RetryAfter
+	}
+
+	return copyResultTTL
+}
+
+// isPermanent reports whether retrying to back up the image doesn't help.
+func isPermanent(err error) bool {
+	var registryErr *pkgregistry.Error
+
+	return errors.As(err, &registryErr) && registryErr.Permanent()
+}
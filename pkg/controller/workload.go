@@ -0,0 +1,180 @@
+package controller
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Workload describes a kind of object that embeds a pod template, so that all of them can
+// be reconciled by the same code path.
+type Workload struct {
+	// Kind is the name of the kind, e.g. `Deployment`.
+	Kind string
+	// APIVersion is the group version of the kind, e.g. `apps/v1`.
+	APIVersion string
+	// New returns an empty object of the kind.
+	New func() client.Object
+	// NewList returns an empty list of the kind.
+	NewList func() client.ObjectList
+	// PodTemplate returns the pod template embedded in the object.
+	PodTemplate func(obj client.Object) *corev1.PodTemplateSpec
+	// IsReady reports whether the object is in a state where its images can be replaced.
+	IsReady func(obj client.Object) bool
+	// Immutable is set for the kinds whose pod template can't be updated after creation.
+	// The images of such objects are backed up but the object itself is left untouched.
+	Immutable bool
+}
+
+// Workloads returns all the kinds handled by the controller.
+func Workloads() []Workload {
+	return append(appsWorkloads(), batchWorkloads()...)
+}
+
+// appsWorkloads returns the kinds of the apps API group.
+func appsWorkloads() []Workload {
+	return []Workload{
+		{
+			Kind:       "Deployment",
+			APIVersion: "apps/v1",
+			New:        func() client.Object { return &appsv1.Deployment{} },
+			NewList:    func() client.ObjectList { return &appsv1.DeploymentList{} },
+			PodTemplate: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*appsv1.Deployment).Spec.Template
+			},
+			IsReady: func(obj client.Object) bool {
+				status := obj.(*appsv1.Deployment).Status
+
+				return isReady(status.Replicas, status.ReadyReplicas)
+			},
+		},
+		{
+			Kind:       "DaemonSet",
+			APIVersion: "apps/v1",
+			New:        func() client.Object { return &appsv1.DaemonSet{} },
+			NewList:    func() client.ObjectList { return &appsv1.DaemonSetList{} },
+			PodTemplate: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*appsv1.DaemonSet).Spec.Template
+			},
+			IsReady: func(obj client.Object) bool {
+				status := obj.(*appsv1.DaemonSet).Status
+
+				return isReady(status.DesiredNumberScheduled, status.NumberReady)
+			},
+		},
+		{
+			Kind:       "StatefulSet",
+			APIVersion: "apps/v1",
+			New:        func() client.Object { return &appsv1.StatefulSet{} },
+			NewList:    func() client.ObjectList { return &appsv1.StatefulSetList{} },
+			PodTemplate: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*appsv1.StatefulSet).Spec.Template
+			},
+			IsReady: func(obj client.Object) bool {
+				status := obj.(*appsv1.StatefulSet).Status
+
+				return isReady(status.Replicas, status.ReadyReplicas)
+			},
+		},
+		{
+			Kind:       "ReplicaSet",
+			APIVersion: "apps/v1",
+			New:        func() client.Object { return &appsv1.ReplicaSet{} },
+			NewList:    func() client.ObjectList { return &appsv1.ReplicaSetList{} },
+			PodTemplate: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*appsv1.ReplicaSet).Spec.Template
+			},
+			IsReady: func(obj client.Object) bool {
+				status := obj.(*appsv1.ReplicaSet).Status
+
+				return isReady(status.Replicas, status.ReadyReplicas)
+			},
+		},
+	}
+}
+
+// batchWorkloads returns the kinds of the batch API group.
+func batchWorkloads() []Workload {
+	return []Workload{
+		{
+			// Job pod templates are immutable, so there is no rollout to wait for.
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+			New:        func() client.Object { return &batchv1.Job{} },
+			NewList:    func() client.ObjectList { return &batchv1.JobList{} },
+			PodTemplate: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*batchv1.Job).Spec.Template
+			},
+			IsReady:   func(client.Object) bool { return true },
+			Immutable: true,
+		},
+		{
+			// CronJobs don't run any pods themselves, the next scheduled Job picks up the
+			// new images.
+			Kind:       "CronJob",
+			APIVersion: "batch/v1beta1",
+			New:        func() client.Object { return &batchv1beta1.CronJob{} },
+			NewList:    func() client.ObjectList { return &batchv1beta1.CronJobList{} },
+			PodTemplate: func(obj client.Object) *corev1.PodTemplateSpec {
+				return &obj.(*batchv1beta1.CronJob).Spec.JobTemplate.Spec.Template
+			},
+			IsReady: func(client.Object) bool { return true },
+		},
+	}
+}
+
+// WorkloadFor returns the workload of the given group and kind. The version is not compared
+// as the same kind may be served under several versions.
+func WorkloadFor(group, kind string) (Workload, bool) {
+	for _, workload := range Workloads() {
+		gv, err := schema.ParseGroupVersion(workload.APIVersion)
+		if err != nil {
+			continue
+		}
+
+		if kind == workload.Kind && group == gv.Group {
+			return workload, true
+		}
+	}
+
+	return Workload{}, false
+}
+
+// IsOwnedByWorkload reports whether the object is controlled by another workload handled by
+// the controller, e.g. a ReplicaSet of a Deployment or a Job of a CronJob. Such objects are
+// updated through their owner and must not be rewritten directly.
+func IsOwnedByWorkload(obj client.Object) bool {
+	owner := metav1.GetControllerOf(obj)
+	if owner == nil {
+		return false
+	}
+
+	ownerGV, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil {
+		return false
+	}
+
+	_, ok := WorkloadFor(ownerGV.Group, owner.Kind)
+
+	return ok
+}
+
+// workloadOfKind returns the workload of the given kind, whatever its group, as in the
+// WorkloadReferences.
+func workloadOfKind(kind string) (Workload, bool) {
+	for _, workload := range Workloads() {
+		if workload.Kind == kind {
+			return workload, true
+		}
+	}
+
+	return Workload{}, false
+}
+
+func isReady(desired, ready int32) bool {
+	return desired == ready && desired > 0
+}
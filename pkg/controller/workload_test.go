@@ -0,0 +1,56 @@
+package controller_test
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/impochi/cloner/pkg/controller"
+)
+
+func TestIsOwnedByWorkload(t *testing.T) {
+	controllerRef := true
+
+	cases := []struct {
+		owner  *metav1.OwnerReference
+		wanted bool
+	}{
+		{
+			owner:  nil,
+			wanted: false,
+		},
+		{
+			owner:  &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment", Controller: &controllerRef},
+			wanted: true,
+		},
+		{
+			owner:  &metav1.OwnerReference{APIVersion: "batch/v1", Kind: "CronJob", Controller: &controllerRef},
+			wanted: true,
+		},
+		{
+			owner:  &metav1.OwnerReference{APIVersion: "apps/v1", Kind: "Deployment"},
+			wanted: false,
+		},
+		{
+			owner:  &metav1.OwnerReference{APIVersion: "example.com/v1", Kind: "Deployment", Controller: &controllerRef},
+			wanted: false,
+		},
+	}
+
+	for _, testcase := range cases {
+		for _, workload := range controller.Workloads() {
+			obj := workload.New()
+			if testcase.owner != nil {
+				obj.SetOwnerReferences([]metav1.OwnerReference{*testcase.owner})
+			}
+
+			if got := controller.IsOwnedByWorkload(obj); got != testcase.wanted {
+				t.Errorf("%s with owner %v: expected %t, got %t", workload.Kind, testcase.owner, testcase.wanted, got)
+			}
+
+			if workload.PodTemplate(obj) == nil {
+				t.Errorf("%s: expected a pod template", workload.Kind)
+			}
+		}
+	}
+}
@@ -2,94 +2,359 @@
 package manager
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"strings"
 
-	appsv1 "k8s.io/api/apps/v1"
-
+	"github.com/go-logr/logr"
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
 	clonercontroller "github.com/impochi/cloner/pkg/controller"
+	clonerwebhook "github.com/impochi/cloner/pkg/webhook"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	controllerruntime "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/source"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	"github.com/impochi/cloner/cli/config"
+	"github.com/impochi/cloner/pkg/metrics"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
 )
 
 const leaderElectionID = "cloner-leader-election-id"
 
 // Run starts the manager.
-func Run(config *config.Config) { //nolint:funlen
+func Run(config *config.Config) {
 	controllerruntime.SetLogger(config.Logger)
 	log := controllerruntime.Log.WithName("manager")
 
-	mgr, err := controllerruntime.NewManager(
-		controllerruntime.GetConfigOrDie(),
-		controllerruntime.Options{
-			LeaderElection:   config.EnableLeaderElection,
-			LeaderElectionID: leaderElectionID,
-		},
-	)
+	// The metrics are served by the metrics endpoint of the manager.
+	metrics.Register()
+
+	mgr, err := newManager(config)
 	if err != nil {
 		log.Error(err, "failed to create manager")
 		os.Exit(1)
 	}
 
-	// Setup Cloner controller
-	log.Info("setting up Cloner controller")
+	ctx := signals.SetupSignalHandler()
 
-	ctrller, err := controller.New("cloner", mgr,
-		controller.Options{
-			Reconciler: &clonercontroller.ClonerReconciler{
-				Client: mgr.GetClient(),
-			},
-			Log: log,
-		})
+	shared, err := setupShared(mgr, config, log)
 	if err != nil {
+		log.Error(err, "failed to set up the registries")
+		os.Exit(1)
+	}
+
+	if err := setupControllers(mgr, config, shared, log); err != nil {
 		log.Error(err, "failed to create controller")
+		os.Exit(1)
 	}
 
-	if err := ctrller.Watch(
-		&source.Kind{Type: &appsv1.Deployment{}},
-		&handler.EnqueueRequestForObject{},
-		predicate.NewPredicateFuncs(func(obj client.Object) bool {
-			deployment := obj.(*appsv1.Deployment)
-			for _, namespace := range config.IgnoreNamespaces {
-				if namespace == deployment.Namespace {
-					return false
-				}
-			}
-
-			return true
-		}),
-	); err != nil {
-		log.Error(err, "failed to watch Deployment")
-	}
-
-	if err := ctrller.Watch(
-		&source.Kind{Type: &appsv1.DaemonSet{}},
-		&handler.EnqueueRequestForObject{},
-		predicate.NewPredicateFuncs(func(obj client.Object) bool {
-			daemonset := obj.(*appsv1.DaemonSet)
-			for _, namespace := range config.IgnoreNamespaces {
-				if namespace == daemonset.Namespace {
-					return false
-				}
-			}
-
-			return true
-		}),
-	); err != nil {
-		log.Error(err, "failed to watch DaemonSet")
+	// Setup the mutating webhook, served by all the replicas regardless of the leader election
+	if config.Webhook.Enabled {
+		setupMutatingWebhook(mgr, config, shared, log)
+	}
+
+	// Setup the validating webhook, served by all the replicas as well
+	if len(config.Webhook.ValidationMode) != 0 {
+		setupValidatingWebhook(mgr, config, shared, log)
 	}
 
 	// Starting the controller manager
 	log.Info("starting the controller manager")
 
-	if err := mgr.Start(signals.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		log.Error(err, "failed to start controller manager")
 		os.Exit(1)
 	}
 }
+
+// newManager returns the manager of the controllers and the webhooks.
+func newManager(config *config.Config) (manager.Manager, error) {
+	scheme := runtime.NewScheme()
+
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to register Kubernetes objects: %w", err)
+	}
+
+	if err := clonerv1alpha1.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("failed to register cloner objects: %w", err)
+	}
+
+	return controllerruntime.NewManager(
+		controllerruntime.GetConfigOrDie(),
+		controllerruntime.Options{
+			Scheme:           scheme,
+			LeaderElection:   config.EnableLeaderElection,
+			LeaderElectionID: leaderElectionID,
+			Port:             config.Webhook.Port,
+			CertDir:          config.Webhook.CertDir,
+		},
+	)
+}
+
+// shared is shared by the controllers and the webhooks.
+type shared struct {
+	// credentials of the destination registry, nil without registry Secret.
+	credentials *pkgregistry.CredentialsStore
+	// pullCredentials of the destination registry, nil without backup pull Secret.
+	pullCredentials *pkgregistry.CredentialsStore
+	mirrors         *clonercontroller.MirrorRecorder
+	copier          *clonercontroller.Copier
+	registryOptions []pkgregistry.Option
+	filter          clonercontroller.WorkloadFilter
+}
+
+// setupShared watches the credentials of the registries and starts the image copier.
+func setupShared(mgr manager.Manager, config *config.Config, log logr.Logger) (*shared, error) {
+	credentials, replicas, err := watchCredentials(mgr, config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	var pullCredentials *pkgregistry.CredentialsStore
+
+	if config.BackupPullSecret != nil {
+		log.Info("watching backup pull credentials", "secret", config.BackupPullSecret)
+
+		if pullCredentials, err = watchSecret(mgr, *config.BackupPullSecret, log); err != nil {
+			return nil, fmt.Errorf("failed to watch backup pull credentials: %w", err)
+		}
+	}
+
+	mirrors := &clonercontroller.MirrorRecorder{Client: mgr.GetClient()}
+
+	// The images are backed up in the background, so that the reconciliation of the other
+	// workloads doesn't wait for large images.
+	copier := &clonercontroller.Copier{Workers: config.CopyWorkers, Mirrors: mirrors}
+	if err := mgr.Add(copier); err != nil {
+		return nil, fmt.Errorf("failed to add image copier: %w", err)
+	}
+
+	return &shared{
+		credentials:     credentials,
+		pullCredentials: pullCredentials,
+		mirrors:         mirrors,
+		copier:          copier,
+		registryOptions: []pkgregistry.Option{
+			pkgregistry.WithPlatforms(config.Platforms),
+			pkgregistry.WithNamingScheme(config.NamingScheme),
+			pkgregistry.WithRateLimiter(pkgregistry.NewRateLimiter(config.RegistryQPS, config.RegistryBurst)),
+			pkgregistry.WithTransferLimiter(pkgregistry.NewTransferLimiter(config.LayerParallelism,
+				config.MaxConcurrentCopies, config.BandwidthLimit)),
+			pkgregistry.WithSourceRules(config.SourceRules),
+			pkgregistry.WithReplicas(replicas...),
+		},
+		filter: clonercontroller.WorkloadFilter{
+			IgnoreNamespaces: config.IgnoreNamespaces,
+			Selector:         config.WorkloadSelector,
+			OptIn:            config.OptIn,
+		},
+	}, nil
+}
+
+// watchCredentials reloads the credentials of the destination registry and of the replica
+// registries from their Secrets when they change. The REGISTRY_* environment variables are used
+// without registry Secret, in which case the returned credentials are nil.
+func watchCredentials(mgr manager.Manager, config *config.Config,
+	log logr.Logger) (*pkgregistry.CredentialsStore, []*pkgregistry.CredentialsStore, error) {
+	var credentials *pkgregistry.CredentialsStore
+
+	if config.RegistrySecret != nil {
+		log.Info("watching registry credentials", "secret", config.RegistrySecret)
+
+		var err error
+		if credentials, err = watchSecret(mgr, *config.RegistrySecret, log); err != nil {
+			return nil, nil, fmt.Errorf("failed to watch registry credentials: %w", err)
+		}
+	}
+
+	replicas := []*pkgregistry.CredentialsStore{}
+
+	for _, secret := range config.ReplicaSecrets {
+		log.Info("watching replica credentials", "secret", secret)
+
+		store, err := watchSecret(mgr, secret, log)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to watch replica credentials %s: %w", secret, err)
+		}
+
+		replicas = append(replicas, store)
+	}
+
+	return credentials, replicas, nil
+}
+
+// watchSecret returns the credentials of the Secret, reloaded when it changes.
+func watchSecret(mgr manager.Manager, secret types.NamespacedName,
+	log logr.Logger) (*pkgregistry.CredentialsStore, error) {
+	store := &pkgregistry.CredentialsStore{}
+	watcher := &clonercontroller.CredentialsWatcher{
+		Secret: secret,
+		Store:  store,
+		Log:    log.WithName("credentials"),
+	}
+
+	if err := watcher.SetupWithManager(mgr); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// setupControllers sets up a Cloner controller for each of the workload kinds.
+func setupControllers(mgr manager.Manager, config *config.Config, shared *shared, log logr.Logger) error {
+	// The workloads excluded after being rewritten are restored as well.
+	filter := shared.filter
+	if config.Mode == clonercontroller.ModeRestore {
+		filter = clonercontroller.WorkloadFilter{IgnoreNamespaces: config.IgnoreNamespaces}
+	}
+
+	for _, workload := range clonercontroller.Workloads() {
+		log.Info("setting up Cloner controller", "kind", workload.Kind)
+
+		ctrller, err := controller.New(fmt.Sprintf("cloner-%s", strings.ToLower(workload.Kind)), mgr,
+			controller.Options{
+				Reconciler: &clonercontroller.ClonerReconciler{
+					Client:          mgr.GetClient(),
+					APIReader:       mgr.GetAPIReader(),
+					Workload:        workload,
+					RegistryOptions: shared.registryOptions,
+					Credentials:     shared.credentials,
+					PullCredentials: shared.pullCredentials,
+					Mirrors:         shared.mirrors,
+					Recorder:        mgr.GetEventRecorderFor("cloner"),
+					Mode:            config.Mode,
+					DryRun:          config.DryRun,
+					Copier:          shared.copier,
+					ResyncPeriod:    config.ResyncPeriod,
+					PinDigests:      config.PinDigests,
+				},
+				Log: log,
+			})
+		if err != nil {
+			return fmt.Errorf("kind %s: %w", workload.Kind, err)
+		}
+
+		if err := ctrller.Watch(
+			&source.Kind{Type: workload.New()},
+			&handler.EnqueueRequestForObject{},
+			predicate.NewPredicateFuncs(func(obj client.Object) bool {
+				return filter.Selects(obj) && !clonercontroller.IsOwnedByWorkload(obj)
+			}),
+		); err != nil {
+			log.Error(err, "failed to watch", "kind", workload.Kind)
+		}
+
+		watchPolicies(mgr, ctrller, workload, filter, log)
+	}
+
+	return nil
+}
+
+// watchPolicies enqueues the workloads of the kind which a ClonePolicy or a ClusterClonePolicy
+// may apply to when it changes. The policies are optional, they are not watched when their CRD
+// is not installed.
+func watchPolicies(mgr manager.Manager, ctrller controller.Controller, workload clonercontroller.Workload,
+	filter clonercontroller.WorkloadFilter, log logr.Logger) {
+	policies := []client.Object{&clonerv1alpha1.ClonePolicy{}, &clonerv1alpha1.ClusterClonePolicy{}}
+
+	for _, policy := range policies {
+		gvk, err := apiutil.GVKForObject(policy, mgr.GetScheme())
+		if err != nil {
+			log.Error(err, "failed to get the kind of the clone policy")
+
+			continue
+		}
+
+		if _, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); err != nil {
+			log.Info("not watching clone policies", "policyKind", gvk.Kind, "reason", err.Error())
+
+			continue
+		}
+
+		if err := ctrller.Watch(
+			&source.Kind{Type: policy},
+			handler.EnqueueRequestsFromMapFunc(
+				clonercontroller.PolicyWorkloads(mgr.GetClient(), workload, filter, log)),
+		); err != nil {
+			log.Error(err, "failed to watch", "kind", workload.Kind, "policyKind", gvk.Kind)
+		}
+	}
+}
+
+// setupMutatingWebhook registers the mutating webhook on the webhook server.
+func setupMutatingWebhook(mgr manager.Manager, config *config.Config, shared *shared, log logr.Logger) {
+	log.Info("setting up mutating webhook", "path", clonerwebhook.MutatePath)
+
+	var admissionHandler admission.Handler = &clonerwebhook.Mutator{
+		Timeout:         config.Webhook.Timeout,
+		FailurePolicy:   config.Webhook.FailurePolicy,
+		Filter:          shared.filter,
+		RegistryOptions: shared.registryOptions,
+		Credentials:     shared.credentials,
+		Client:          mgr.GetClient(),
+		APIReader:       mgr.GetAPIReader(),
+		Mirrors:         shared.mirrors,
+		Copier:          shared.copier,
+		PinDigests:      config.PinDigests,
+	}
+
+	// The webhook keeps being served in restore mode, so that the workloads are still
+	// admitted while its configuration is being removed.
+	if config.Mode == clonercontroller.ModeRestore {
+		admissionHandler = allowed("restore mode")
+	}
+
+	// The dry run only reports what the controller would do, the workloads are admitted
+	// unchanged.
+	if config.DryRun {
+		admissionHandler = allowed("dry run")
+	}
+
+	mgr.GetWebhookServer().Register(clonerwebhook.MutatePath, &webhook.Admission{Handler: admissionHandler})
+}
+
+// setupValidatingWebhook registers the validating webhook on the webhook server.
+func setupValidatingWebhook(mgr manager.Manager, config *config.Config, shared *shared, log logr.Logger) {
+	// The dry run only reports the workloads which would be rejected.
+	mode := config.Webhook.ValidationMode
+	if config.DryRun {
+		mode = clonerwebhook.ValidationModeAudit
+	}
+
+	log.Info("setting up validating webhook", "path", clonerwebhook.ValidatePath, "mode", mode)
+
+	var admissionHandler admission.Handler = &clonerwebhook.Validator{
+		Mode:             mode,
+		IgnoreNamespaces: config.IgnoreNamespaces,
+		RegistryOptions:  shared.registryOptions,
+		Credentials:      shared.credentials,
+		Client:           mgr.GetClient(),
+		APIReader:        mgr.GetAPIReader(),
+	}
+
+	// The original images put back in restore mode are not in the destination registry.
+	if config.Mode == clonercontroller.ModeRestore {
+		admissionHandler = allowed("restore mode")
+	}
+
+	mgr.GetWebhookServer().Register(clonerwebhook.ValidatePath, &webhook.Admission{Handler: admissionHandler})
+}
+
+// allowed returns an admission handler admitting all the objects unchanged.
+func allowed(reason string) admission.Handler {
+	return admission.HandlerFunc(func(context.Context, admission.Request) admission.Response {
+		return admission.Allowed(reason)
+	})
+}
@@ -0,0 +1,208 @@
+// Package metrics holds the Prometheus metrics of the controller, served by the metrics
+// endpoint of the manager.
+package metrics
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	namespace = "cloner"
+
+	labelSourceRegistry = "source_registry"
+	labelReason         = "reason"
+	labelKind           = "kind"
+	labelAction         = "action"
+	labelMode           = "mode"
+)
+
+var (
+	imagesCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "images_copied_total",
+		Help:      "Number of images pushed to the destination registry.",
+	}, []string{labelSourceRegistry})
+
+	bytesTransferred = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_transferred_total",
+		Help:      "Number of bytes uploaded to the destination registry.",
+	}, []string{labelSourceRegistry})
+
+	copyDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "copy_duration_seconds",
+		Help:      "Time taken to copy an image to the destination registry.",
+		// From 1 second to about 17 minutes.
+		Buckets: prometheus.ExponentialBuckets(1, 2, 11), //nolint:gomnd
+	}, []string{labelSourceRegistry})
+
+	cacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_hits_total",
+		Help:      "Number of images not copied because the destination image was already up to date.",
+	}, []string{labelSourceRegistry})
+
+	copyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "copy_failures_total",
+		Help:      "Number of images which couldn't be copied, by reason.",
+	}, []string{labelReason, labelSourceRegistry})
+
+	workloadsRewritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "workloads_rewritten_total",
+		Help:      "Number of workloads whose images were rewritten to the destination images.",
+	}, []string{labelKind})
+
+	upstreamChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_changes_total",
+		Help:      "Number of source tags of rewritten workloads found moved upstream by the resync, by action taken.",
+	}, []string{labelKind, labelAction})
+
+	admissionViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admission_violations_total",
+		Help:      "Number of images admitted with a warning or rejected by the validating webhook, by validation mode.",
+	}, []string{labelKind, labelMode})
+
+	workloadsUnmirrored = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "workloads_unmirrored",
+		Help:      "Number of workloads running images which were not backed up at their last reconciliation.",
+	}, []string{labelKind})
+
+	dryRunPendingCopies = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dry_run_pending_copies",
+		Help:      "Number of images the workloads would have copied to the destination registry, in dry run mode.",
+	}, []string{labelKind})
+
+	dryRunPendingRewrites = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dry_run_pending_rewrites",
+		Help:      "Number of workloads which would have been rewritten, in dry run mode.",
+	}, []string{labelKind})
+
+	unmirrored      = newWorkloadGauge(workloadsUnmirrored)
+	pendingCopies   = newWorkloadGauge(dryRunPendingCopies)
+	pendingRewrites = newWorkloadGauge(dryRunPendingRewrites)
+)
+
+// Register registers the metrics on the registry of the manager.
+func Register() {
+	ctrlmetrics.Registry.MustRegister(
+		imagesCopied,
+		bytesTransferred,
+		copyDuration,
+		cacheHits,
+		copyFailures,
+		workloadsRewritten,
+		upstreamChanges,
+		admissionViolations,
+		workloadsUnmirrored,
+		dryRunPendingCopies,
+		dryRunPendingRewrites,
+	)
+}
+
+// ImageCopied records an image pushed to the destination registry.
+func ImageCopied(sourceRegistry string, bytes int64, seconds float64) {
+	imagesCopied.WithLabelValues(sourceRegistry).Inc()
+	bytesTransferred.WithLabelValues(sourceRegistry).Add(float64(bytes))
+	copyDuration.WithLabelValues(sourceRegistry).Observe(seconds)
+}
+
+// CacheHit records an image whose destination image was already up to date.
+func CacheHit(sourceRegistry string) {
+	cacheHits.WithLabelValues(sourceRegistry).Inc()
+}
+
+// CopyFailed records an image which couldn't be copied.
+func CopyFailed(reason, sourceRegistry string) {
+	copyFailures.WithLabelValues(reason, sourceRegistry).Inc()
+}
+
+// WorkloadRewritten records a workload whose images were rewritten.
+func WorkloadRewritten(kind string) {
+	workloadsRewritten.WithLabelValues(kind).Inc()
+}
+
+// UpstreamChanged records a source tag moved upstream, and the action taken: `resynced` or
+// `frozen`.
+func UpstreamChanged(kind, action string) {
+	upstreamChanges.WithLabelValues(kind, action).Inc()
+}
+
+// AdmissionViolations records the images of a workload which are not in the destination
+// registry, found by the validating webhook in the given mode: `enforce` or `audit`.
+func AdmissionViolations(kind, mode string, images int) {
+	admissionViolations.WithLabelValues(kind, mode).Add(float64(images))
+}
+
+// SetUnmirrored records whether the workload runs images which are not backed up.
+func SetUnmirrored(kind string, workload types.NamespacedName, isUnmirrored bool) {
+	unmirrored.set(kind, workload, boolValue(isUnmirrored))
+}
+
+// DryRunReported records the images the workload would have copied, and whether it would have
+// been rewritten.
+func DryRunReported(kind string, workload types.NamespacedName, copies int, rewrite bool) {
+	pendingCopies.set(kind, workload, float64(copies))
+	pendingRewrites.set(kind, workload, boolValue(rewrite))
+}
+
+// DeleteWorkload forgets a deleted workload.
+func DeleteWorkload(kind string, workload types.NamespacedName) {
+	for _, gauge := range []*workloadGauge{unmirrored, pendingCopies, pendingRewrites} {
+		gauge.set(kind, workload, 0)
+	}
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+// workloadGauge sets a gauge by kind to the sum of the values of the workloads of the kind, so
+// that each workload is only counted once.
+type workloadGauge struct {
+	gauge *prometheus.GaugeVec
+
+	mu     sync.Mutex
+	values map[string]map[types.NamespacedName]float64
+}
+
+func newWorkloadGauge(gauge *prometheus.GaugeVec) *workloadGauge {
+	return &workloadGauge{gauge: gauge, values: map[string]map[types.NamespacedName]float64{}}
+}
+
+func (g *workloadGauge) set(kind string, workload types.NamespacedName, value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.values[kind]; !ok {
+		g.values[kind] = map[types.NamespacedName]float64{}
+	}
+
+	if value != 0 {
+		g.values[kind][workload] = value
+	} else {
+		delete(g.values[kind], workload)
+	}
+
+	sum := 0.0
+	for _, v := range g.values[kind] {
+		sum += v
+	}
+
+	g.gauge.WithLabelValues(kind).Set(sum)
+}
@@ -0,0 +1,66 @@
+//nolint:testpackage
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSetUnmirrored(t *testing.T) {
+	const kind = "Deployment"
+
+	first := types.NamespacedName{Namespace: "default", Name: "first"}
+	second := types.NamespacedName{Namespace: "default", Name: "second"}
+
+	cases := []struct {
+		update     func()
+		unmirrored float64
+	}{
+		{update: func() { SetUnmirrored(kind, first, true) }, unmirrored: 1},
+		// Each workload is only counted once.
+		{update: func() { SetUnmirrored(kind, first, true) }, unmirrored: 1},
+		{update: func() { SetUnmirrored(kind, second, true) }, unmirrored: 2},
+		{update: func() { SetUnmirrored(kind, first, false) }, unmirrored: 1},
+		{update: func() { DeleteWorkload(kind, second) }, unmirrored: 0},
+	}
+
+	for index, testcase := range cases {
+		testcase.update()
+
+		metric := &dto.Metric{}
+		if err := workloadsUnmirrored.WithLabelValues(kind).Write(metric); err != nil {
+			t.Fatalf("failed to read gauge: %v", err)
+		}
+
+		if value := metric.GetGauge().GetValue(); value != testcase.unmirrored {
+			t.Errorf("step %d: expected %v unmirrored workloads, got %v", index, testcase.unmirrored, value)
+		}
+	}
+}
+
+func TestDryRunReported(t *testing.T) {
+	const kind = "StatefulSet"
+
+	first := types.NamespacedName{Namespace: "default", Name: "first"}
+	second := types.NamespacedName{Namespace: "default", Name: "second"}
+
+	DryRunReported(kind, first, 2, true)
+	DryRunReported(kind, second, 1, true)
+	// Reporting a workload again replaces its previous report.
+	DryRunReported(kind, first, 0, true)
+	DeleteWorkload(kind, second)
+
+	for gauge, wanted := range map[*prometheus.GaugeVec]float64{dryRunPendingCopies: 0, dryRunPendingRewrites: 1} {
+		metric := &dto.Metric{}
+		if err := gauge.WithLabelValues(kind).Write(metric); err != nil {
+			t.Fatalf("failed to read gauge: %v", err)
+		}
+
+		if value := metric.GetGauge().GetValue(); value != wanted {
+			t.Errorf("expected %v, got %v", wanted, value)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+//nolint:testpackage
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestIsBackedUp(t *testing.T) { //nolint:funlen
+	srcHash, err := v1.NewHash(testDigest)
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+
+	cases := []struct {
+		status    int
+		digest    string
+		backedUp  bool
+		expectErr bool
+	}{
+		{
+			status:   http.StatusOK,
+			digest:   testDigest,
+			backedUp: true,
+		},
+		{
+			status:   http.StatusOK,
+			digest:   "sha256:" + strings.Repeat("0", 64), //nolint:gomnd
+			backedUp: false,
+		},
+		{
+			status:   http.StatusNotFound,
+			backedUp: false,
+		},
+		{
+			status:    http.StatusUnauthorized,
+			expectErr: true,
+		},
+		{
+			status:    http.StatusInternalServerError,
+			expectErr: true,
+		},
+	}
+
+	for _, testcase := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/" {
+				w.WriteHeader(http.StatusOK)
+
+				return
+			}
+
+			if r.Method != http.MethodHead {
+				t.Errorf("expected a HEAD request, got %s %s", r.Method, r.URL.Path)
+			}
+
+			w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+			w.Header().Set("Content-Length", "100")
+			w.Header().Set("Docker-Content-Digest", testcase.digest)
+			w.WriteHeader(testcase.status)
+		}))
+
+		dstRef, err := name.ParseReference(strings.TrimPrefix(server.URL, "http://") + "/foo/nginx:1.21")
+		if err != nil {
+			t.Fatalf("failed parsing reference: %v", err)
+		}
+
+		backedUp, err := isBackedUp(dstRef, srcHash, remote.WithAuthFromKeychain(Keychain{}))
+
+		server.Close()
+
+		if testcase.expectErr {
+			if err == nil {
+				t.Errorf("status %d: expected error", testcase.status)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("status %d: failed to check destination image: %v", testcase.status, err)
+		}
+
+		if backedUp != testcase.backedUp {
+			t.Errorf("status %d: expected backed up to be %t, got %t", testcase.status, testcase.backedUp, backedUp)
+		}
+	}
+}
+
+func TestIsBackedUpNeverPushes(t *testing.T) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testIndex)))
+
+	for _, dstDigest := range []string{"", digest} {
+		dstDigest := dstDigest
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case r.URL.Path == "/v2/":
+				w.WriteHeader(http.StatusOK)
+			case r.Method != http.MethodGet && r.Method != http.MethodHead:
+				t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			case strings.HasPrefix(r.URL.Path, "/v2/library/nginx/"):
+				w.Header().Set("Content-Type", string(types.DockerManifestList))
+				w.Header().Set("Docker-Content-Digest", digest)
+				_, _ = w.Write([]byte(testIndex))
+			case len(dstDigest) == 0:
+				w.WriteHeader(http.StatusNotFound)
+			default:
+				w.Header().Set("Content-Type", string(types.DockerManifestList))
+				w.Header().Set("Content-Length", fmt.Sprint(len(testIndex)))
+				w.Header().Set("Docker-Content-Digest", dstDigest)
+			}
+		}))
+
+		host := strings.TrimPrefix(server.URL, "http://")
+		creds := &Credentials{Provider: host, Username: username, Password: password}
+
+		backedUp, err := IsBackedUp(host+"/library/nginx:1.21", host+"/foo/nginx:1.21", WithCredentials(creds))
+
+		server.Close()
+
+		if err != nil {
+			t.Fatalf("destination digest %q: unexpected error: %v", dstDigest, err)
+		}
+
+		if wanted := len(dstDigest) != 0; backedUp != wanted {
+			t.Errorf("destination digest %q: expected backed up to be %t, got %t", dstDigest, wanted, backedUp)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package registry
+
+import (
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+// maxBlobs is the number of blobs remembered by a BlobCache, the oldest ones being forgotten
+// first.
+const maxBlobs = 100000
+
+// defaultBlobCache is shared by the calls without WithBlobCache.
+var defaultBlobCache = NewBlobCache()
+
+// BlobCache remembers the repositories of the destination registries the layers were pushed
+// to, so that pushing the same layers to another repository of the registry mounts them from
+// the first one instead of uploading them again, e.g. the layers of a common base image. The
+// registries not supporting cross-repository mounts fall back to uploading the layers.
+type BlobCache struct {
+	mu sync.Mutex
+	// repositories is the last repository each blob was pushed to, by registry and digest.
+	repositories map[blobKey]name.Repository
+	// order is the order the blobs were added in, to forget the oldest ones.
+	order []blobKey
+}
+
+type blobKey struct {
+	registry string
+	digest   v1.Hash
+}
+
+// NewBlobCache returns an empty BlobCache.
+func NewBlobCache() *BlobCache {
+	return &BlobCache{repositories: map[blobKey]name.Repository{}}
+}
+
+// WithBlobCache sets the cache of the layers pushed, the calls without BlobCache share the
+// same cache.
+func WithBlobCache(cache *BlobCache) Option {
+	return func(o *options) {
+		o.blobs = cache
+	}
+}
+
+// add records that the blobs are in the repository.
+func (c *BlobCache) add(repo name.Repository, digests []v1.Hash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, digest := range digests {
+		key := blobKey{registry: repo.RegistryStr(), digest: digest}
+
+		if _, ok := c.repositories[key]; !ok {
+			c.order = append(c.order, key)
+		}
+
+		c.repositories[key] = repo
+	}
+
+	for len(c.order) > maxBlobs {
+		delete(c.repositories, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// mountFrom returns another repository of the registry holding the blob, if any.
+func (c *BlobCache) mountFrom(repo name.Repository, digest v1.Hash) (name.Repository, bool) {
+	c.mu.Lock()
+	from, ok := c.repositories[blobKey{registry: repo.RegistryStr(), digest: digest}]
+	c.mu.Unlock()
+
+	if !ok || from.RepositoryStr() == repo.RepositoryStr() {
+		return name.Repository{}, false
+	}
+
+	return from, true
+}
+
+// mounter makes the layers of the images pushed to a repository mountable from the other
+// repositories holding them, and collects the layers so that they can be added to the cache
+// once pushed. The layers uploaded are transferred within the limits of the copy, if any.
+type mounter struct {
+	cache    *BlobCache
+	repo     name.Repository
+	transfer *copyLimiter
+
+	mu      sync.Mutex
+	digests []v1.Hash
+}
+
+func newMounter(cache *BlobCache, repo name.Repository, transfer *copyLimiter) *mounter {
+	return &mounter{cache: cache, repo: repo, transfer: transfer}
+}
+
+// pushed adds the layers of the images pushed to the cache.
+func (m *mounter) pushed() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.cache.add(m.repo, m.digests)
+}
+
+func (m *mounter) layers(layers []v1.Layer) []v1.Layer {
+	mountable := make([]v1.Layer, 0, len(layers))
+
+	for _, layer := range layers {
+		if m.transfer != nil {
+			layer = m.transfer.layer(layer)
+		}
+
+		// The layers whose digest is not known yet are uploaded.
+		digest, err := layer.Digest()
+		if err != nil {
+			mountable = append(mountable, layer)
+
+			continue
+		}
+
+		m.mu.Lock()
+		m.digests = append(m.digests, digest)
+		m.mu.Unlock()
+
+		if from, ok := m.cache.mountFrom(m.repo, digest); ok {
+			layer = &remote.MountableLayer{Layer: layer, Reference: from.Digest(digest.String())}
+		}
+
+		mountable = append(mountable, layer)
+	}
+
+	return mountable
+}
+
+func (m *mounter) image(img v1.Image) v1.Image {
+	return &mountingImage{Image: img, mounter: m}
+}
+
+func (m *mounter) index(index v1.ImageIndex) v1.ImageIndex {
+	mounting := &mountingIndex{base: index, mounter: m}
+
+	// The non-image manifests of an index are pushed as layers by remote.WriteIndex.
+	if layers, ok := index.(withLayer); ok {
+		return &mountingLayerIndex{mountingIndex: mounting, layers: layers}
+	}
+
+	return mounting
+}
+
+// mountingImage is an image whose layers are mountable.
+type mountingImage struct {
+	v1.Image
+
+	mounter *mounter
+}
+
+// Layers implements v1.Image.
+func (mi *mountingImage) Layers() ([]v1.Layer, error) {
+	layers, err := mi.Image.Layers()
+	if err != nil {
+		return nil, err
+	}
+
+	return mi.mounter.layers(layers), nil
+}
+
+// mountingIndex is an index whose images have mountable layers.
+type mountingIndex struct {
+	base    v1.ImageIndex
+	mounter *mounter
+}
+
+// MediaType implements v1.ImageIndex.
+func (mi *mountingIndex) MediaType() (types.MediaType, error) {
+	return mi.base.MediaType()
+}
+
+// Digest implements v1.ImageIndex.
+func (mi *mountingIndex) Digest() (v1.Hash, error) {
+	return mi.base.Digest()
+}
+
+// Size implements v1.ImageIndex.
+func (mi *mountingIndex) Size() (int64, error) {
+	return mi.base.Size()
+}
+
+// IndexManifest implements v1.ImageIndex.
+func (mi *mountingIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return mi.base.IndexManifest()
+}
+
+// RawManifest implements v1.ImageIndex.
+func (mi *mountingIndex) RawManifest() ([]byte, error) {
+	return mi.base.RawManifest()
+}
+
+// Image implements v1.ImageIndex.
+func (mi *mountingIndex) Image(h v1.Hash) (v1.Image, error) {
+	img, err := mi.base.Image(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return mi.mounter.image(img), nil
+}
+
+// ImageIndex implements v1.ImageIndex.
+func (mi *mountingIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	index, err := mi.base.ImageIndex(h)
+	if err != nil {
+		return nil, err
+	}
+
+	return mi.mounter.index(index), nil
+}
+
+type withLayer interface {
+	Layer(v1.Hash) (v1.Layer, error)
+}
+
+// mountingLayerIndex is a mountingIndex whose non-image manifests are pushed as layers.
+type mountingLayerIndex struct {
+	*mountingIndex
+
+	layers withLayer
+}
+
+// Layer returns the blob of a non-image manifest of the index.
+func (mi *mountingLayerIndex) Layer(h v1.Hash) (v1.Layer, error) {
+	return mi.layers.Layer(h)
+}
@@ -0,0 +1,75 @@
+//nolint:testpackage
+package registry
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// digestLayer is a layer whose only known property is its digest.
+type digestLayer struct {
+	v1.Layer
+
+	digest v1.Hash
+}
+
+func (l *digestLayer) Digest() (v1.Hash, error) {
+	return l.digest, nil
+}
+
+func TestMounterLayers(t *testing.T) {
+	base, err := v1.NewHash(testDigest)
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+
+	top, err := v1.NewHash("sha256:" + strings.Repeat("1", 64)) //nolint:gomnd
+	if err != nil {
+		t.Fatalf("failed parsing digest: %v", err)
+	}
+
+	repository := func(repo string) name.Repository {
+		r, err := name.NewRepository(repo)
+		if err != nil {
+			t.Fatalf("failed parsing repository: %v", err)
+		}
+
+		return r
+	}
+
+	cache := NewBlobCache()
+	cache.add(repository("quay.io/foo/debian"), []v1.Hash{base})
+
+	layers := []v1.Layer{&digestLayer{digest: base}, &digestLayer{digest: top}}
+
+	mounter := newMounter(cache, repository("quay.io/foo/nginx"), nil)
+	mountable := mounter.layers(layers)
+
+	ml, ok := mountable[0].(*remote.MountableLayer)
+	if !ok || ml.Reference.Context().String() != "quay.io/foo/debian" {
+		t.Errorf("expected the base layer to be mounted from quay.io/foo/debian, got %v", mountable[0])
+	}
+
+	if _, ok := mountable[1].(*remote.MountableLayer); ok {
+		t.Errorf("expected the top layer to be uploaded, got %v", mountable[1])
+	}
+
+	// The layers are only mountable from the same registry, and not into their own repository.
+	for _, repo := range []string{"eu.quay.io/foo/nginx", "quay.io/foo/debian"} {
+		for _, layer := range newMounter(cache, repository(repo), nil).layers(layers) {
+			if _, ok := layer.(*remote.MountableLayer); ok {
+				t.Errorf("%s: expected no layer to be mounted, got %v", repo, layer)
+			}
+		}
+	}
+
+	mounter.pushed()
+
+	if from, ok := cache.mountFrom(repository("quay.io/foo/redis"), top); !ok || from.String() != "quay.io/foo/nginx" {
+		t.Errorf("expected the top layer to be mountable from quay.io/foo/nginx, got %v", from)
+	}
+}
@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// Credentials are the credentials of the destination registry. The images are backed up into
+// the `<Provider>/<Username>` repository.
+type Credentials struct {
+	// Provider is the destination registry, e.g. `quay.io`, Docker Hub when empty.
+	Provider string
+	Username string
+	Password string
+}
+
+// Validate checks that the credentials are complete.
+func (c *Credentials) Validate() error {
+	if len(c.Username) == 0 || len(c.Password) == 0 {
+		return fmt.Errorf("registry username or password cannot be empty")
+	}
+
+	return nil
+}
+
+// CredentialsFromDockerConfig returns the credentials of the only registry of a docker config
+// file, as found in the `kubernetes.io/dockerconfigjson` Secrets.
+func CredentialsFromDockerConfig(config []byte) (*Credentials, error) {
+	keychain, err := NewDockerConfigKeychain(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(keychain) != 1 {
+		return nil, fmt.Errorf("expected the credentials of exactly one registry, got %d", len(keychain))
+	}
+
+	creds := &Credentials{}
+
+	for registry, auth := range keychain {
+		if registry != name.DefaultRegistry {
+			creds.Provider = registry
+		}
+
+		creds.Username = auth.Username
+		creds.Password = auth.Password
+
+		if len(auth.Auth) != 0 {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode auth of registry %q: %v", registry, err)
+			}
+
+			if index := strings.Index(string(decoded), ":"); index != -1 {
+				creds.Username, creds.Password = string(decoded[:index]), string(decoded[index+1:])
+			}
+		}
+	}
+
+	if err := creds.Validate(); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+func fetchCredentials() (*Credentials, error) {
+	creds := &Credentials{
+		Provider: os.Getenv("REGISTRY_PROVIDER"),
+		Username: os.Getenv("REGISTRY_USERNAME"),
+		Password: os.Getenv("REGISTRY_PASSWORD"),
+	}
+
+	if err := creds.Validate(); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+// destination returns the repository the images are backed up into.
+func (c *Credentials) destination() string {
+	if len(c.Provider) != 0 {
+		return fmt.Sprintf("%s/%s", c.Provider, c.Username)
+	}
+
+	return c.Username
+}
+
+// repositoryRegistry returns the host of the registry of the destination repository.
+func repositoryRegistry(destination string) (string, error) {
+	repo, err := name.NewRepository(destination)
+	if err != nil {
+		return "", fmt.Errorf("failed parsing destination repository: %v", err)
+	}
+
+	return repo.RegistryStr(), nil
+}
+
+// DestinationRegistry returns the host of the registry the images are backed up into with
+// the given options. The credentials are only required when no destination is set.
+func DestinationRegistry(opts ...Option) (string, error) {
+	o := makeOptions(opts...)
+	if len(o.destination) != 0 {
+		return repositoryRegistry(o.destination)
+	}
+
+	creds, err := o.credentials()
+	if err != nil {
+		return "", err
+	}
+
+	return repositoryRegistry(creds.destination())
+}
+
+// CredentialsStore holds the current credentials of the destination registry, which can be
+// swapped while they are in use.
+type CredentialsStore struct {
+	mu    sync.RWMutex
+	creds *Credentials
+}
+
+// Load returns the current credentials, nil if none were stored yet. The returned credentials
+// are never modified, so they can be used for the whole duration of an operation even if new
+// credentials are stored in the meantime.
+func (s *CredentialsStore) Load() *Credentials {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.creds
+}
+
+// Store replaces the current credentials.
+func (s *CredentialsStore) Store(creds *Credentials) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.creds = creds
+}
@@ -0,0 +1,87 @@
+//nolint:testpackage
+package registry
+
+import (
+	"testing"
+)
+
+func TestCredentialsFromDockerConfig(t *testing.T) {
+	cases := []struct {
+		config  string
+		wanted  Credentials
+		isError bool
+	}{
+		{
+			config: dockerHubConfig,
+			wanted: Credentials{Username: "hub", Password: "hubpass"},
+		},
+		{
+			config: `{"auths":{"quay.io":{"auth":"cXVheTpxdWF5cGFzcw=="}}}`,
+			wanted: Credentials{Provider: "quay.io", Username: "quay", Password: "quaypass"},
+		},
+		{
+			// The credentials of a single registry are expected.
+			config:  quayConfig,
+			isError: true,
+		},
+		{
+			config:  `{"auths":{"quay.io":{"username":"quay"}}}`,
+			isError: true,
+		},
+		{
+			config:  "not json",
+			isError: true,
+		},
+	}
+
+	for _, testcase := range cases {
+		creds, err := CredentialsFromDockerConfig([]byte(testcase.config))
+		if testcase.isError {
+			if err == nil {
+				t.Errorf("%s: expected error", testcase.config)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", testcase.config, err)
+		}
+
+		if *creds != testcase.wanted {
+			t.Errorf("%s: expected credentials %v, got %v", testcase.config, testcase.wanted, *creds)
+		}
+	}
+}
+
+func TestCredentialsStore(t *testing.T) {
+	var nilStore *CredentialsStore
+	if creds := nilStore.Load(); creds != nil {
+		t.Errorf("expected no credentials from nil store, got %v", creds)
+	}
+
+	store := &CredentialsStore{}
+	if creds := store.Load(); creds != nil {
+		t.Errorf("expected no credentials from empty store, got %v", creds)
+	}
+
+	old := &Credentials{Username: username, Password: password}
+	store.Store(old)
+
+	snapshot := store.Load()
+
+	store.Store(&Credentials{Provider: "quay.io", Username: username, Password: "rotated"})
+
+	if snapshot != old || snapshot.Password != password {
+		t.Errorf("expected loaded credentials to be left untouched, got %v", snapshot)
+	}
+
+	dst, err := GetDestinationImage("nginx", WithCredentials(store.Load()))
+	if err != nil {
+		t.Fatalf("failed to get destination image: %v", err)
+	}
+
+	if wanted := "quay.io/foo/nginx"; dst != wanted {
+		t.Errorf("expected destination image %q, got %q", wanted, dst)
+	}
+}
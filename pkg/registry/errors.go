@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+// ErrorKind classifies the errors returned by the registries.
+type ErrorKind string
+
+const (
+	// ErrorRateLimited is returned when the registry throttles the requests, the request must
+	// be retried after Error.RetryAfter.
+	ErrorRateLimited ErrorKind = "rate_limited"
+	// ErrorUnauthorized is returned when the credentials are missing or not allowed to pull or
+	// push the image. Retrying doesn't help until the credentials are changed.
+	ErrorUnauthorized ErrorKind = "unauthorized"
+	// ErrorNotFound is returned when the image doesn't exist. Retrying doesn't help until the
+	// image is pushed.
+	ErrorNotFound ErrorKind = "not_found"
+	// ErrorTransient is returned for the server and network errors, the request may succeed
+	// when retried.
+	ErrorTransient ErrorKind = "transient"
+	// ErrorDisallowed is returned for the source images denied by the source rules, which are
+	// not backed up until the rules change.
+	ErrorDisallowed ErrorKind = "disallowed"
+)
+
+// defaultRetryAfter is the delay before retrying a throttled request, when the registry
+// doesn't set the Retry-After header.
+const defaultRetryAfter = time.Minute
+
+// Error is an error returned by a registry, classified by kind.
+type Error struct {
+	Kind ErrorKind
+	// Registry is the host of the registry which returned the error.
+	Registry string
+	// RetryAfter is the delay requested by the registry before retrying, for ErrorRateLimited.
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.Kind == ErrorRateLimited {
+		return fmt.Sprintf("%v (rate limited by %s, retry after %s)", e.Err, e.Registry, e.RetryAfter)
+	}
+
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Permanent reports whether retrying doesn't help, the cause of the error having to be fixed
+// first.
+func (e *Error) Permanent() bool {
+	return e.Kind == ErrorUnauthorized || e.Kind == ErrorNotFound || e.Kind == ErrorDisallowed
+}
+
+// classifyError wraps the errors returned by the registries into an Error. retryAfter is the
+// delay requested by the registry, if any. Other errors, such as invalid image names, are
+// returned unchanged.
+func classifyError(err error, registry string, retryAfter time.Duration) error {
+	var registryErr *Error
+	if err == nil || errors.As(err, &registryErr) {
+		return err
+	}
+
+	kind := ErrorKind("")
+
+	var (
+		terr   *transport.Error
+		netErr net.Error
+	)
+
+	switch {
+	case errors.As(err, &terr):
+		kind = transportErrorKind(terr)
+	case errors.As(err, &netErr):
+		kind = ErrorTransient
+	}
+
+	if len(kind) == 0 {
+		return err
+	}
+
+	if kind == ErrorRateLimited && retryAfter <= 0 {
+		retryAfter = defaultRetryAfter
+	}
+
+	if kind != ErrorRateLimited {
+		retryAfter = 0
+	}
+
+	return &Error{Kind: kind, Registry: registry, RetryAfter: retryAfter, Err: err}
+}
+
+func transportErrorKind(terr *transport.Error) ErrorKind {
+	switch {
+	case terr.StatusCode == http.StatusTooManyRequests:
+		return ErrorRateLimited
+	case terr.StatusCode == http.StatusUnauthorized || terr.StatusCode == http.StatusForbidden:
+		return ErrorUnauthorized
+	case isNotFound(terr):
+		return ErrorNotFound
+	case terr.StatusCode >= http.StatusInternalServerError:
+		return ErrorTransient
+	}
+
+	for _, diagnostic := range terr.Errors {
+		switch diagnostic.Code { //nolint:exhaustive
+		case transport.TooManyRequestsErrorCode:
+			return ErrorRateLimited
+		case transport.UnauthorizedErrorCode, transport.DeniedErrorCode:
+			return ErrorUnauthorized
+		}
+	}
+
+	return ""
+}
+
+// errorKind returns the kind of the error, `other` when it is not classified.
+func errorKind(err error) string {
+	var registryErr *Error
+	if errors.As(err, &registryErr) {
+		return string(registryErr.Kind)
+	}
+
+	return "other"
+}
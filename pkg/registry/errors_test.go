@@ -0,0 +1,109 @@
+//nolint:testpackage
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+)
+
+func TestClassifyError(t *testing.T) { //nolint:funlen
+	cases := []struct {
+		err        error
+		retryAfter time.Duration
+		kind       ErrorKind
+		wanted     time.Duration
+		permanent  bool
+	}{
+		{
+			err:        &transport.Error{StatusCode: http.StatusTooManyRequests},
+			retryAfter: 30 * time.Second,
+			kind:       ErrorRateLimited,
+			wanted:     30 * time.Second,
+		},
+		{
+			// The registry didn't set Retry-After.
+			err:    fmt.Errorf("failed to fetch image: %w", &transport.Error{StatusCode: http.StatusTooManyRequests}),
+			kind:   ErrorRateLimited,
+			wanted: defaultRetryAfter,
+		},
+		{
+			err: &transport.Error{
+				StatusCode: http.StatusBadRequest,
+				Errors:     []transport.Diagnostic{{Code: transport.TooManyRequestsErrorCode}},
+			},
+			kind:   ErrorRateLimited,
+			wanted: defaultRetryAfter,
+		},
+		{
+			err:       fmt.Errorf("failed to push image: %w", &transport.Error{StatusCode: http.StatusUnauthorized}),
+			kind:      ErrorUnauthorized,
+			permanent: true,
+		},
+		{
+			err:       &transport.Error{StatusCode: http.StatusForbidden},
+			kind:      ErrorUnauthorized,
+			permanent: true,
+		},
+		{
+			err:       &transport.Error{StatusCode: http.StatusNotFound},
+			kind:      ErrorNotFound,
+			permanent: true,
+		},
+		{
+			err:        &transport.Error{StatusCode: http.StatusBadGateway},
+			retryAfter: time.Second,
+			kind:       ErrorTransient,
+		},
+		{
+			err:  &net.OpError{Op: "dial", Err: errors.New("connection refused")},
+			kind: ErrorTransient,
+		},
+		{
+			err: &transport.Error{StatusCode: http.StatusBadRequest},
+		},
+		{
+			err: errors.New("invalid image name"),
+		},
+	}
+
+	for _, testcase := range cases {
+		err := classifyError(testcase.err, "registry.example.com", testcase.retryAfter)
+
+		var registryErr *Error
+		if !errors.As(err, &registryErr) {
+			if len(testcase.kind) != 0 {
+				t.Errorf("%v: expected %s error, got %v", testcase.err, testcase.kind, err)
+			}
+
+			continue
+		}
+
+		if len(testcase.kind) == 0 {
+			t.Errorf("%v: expected unclassified error, got %s", testcase.err, registryErr.Kind)
+
+			continue
+		}
+
+		if registryErr.Kind != testcase.kind {
+			t.Errorf("%v: expected %s error, got %s", testcase.err, testcase.kind, registryErr.Kind)
+		}
+
+		if registryErr.RetryAfter != testcase.wanted {
+			t.Errorf("%v: expected retry after %s, got %s", testcase.err, testcase.wanted, registryErr.RetryAfter)
+		}
+
+		if registryErr.Permanent() != testcase.permanent {
+			t.Errorf("%v: expected permanent to be %t", testcase.err, testcase.permanent)
+		}
+
+		if !errors.Is(err, testcase.err) {
+			t.Errorf("%v: expected the error to be wrapped", testcase.err)
+		}
+	}
+}
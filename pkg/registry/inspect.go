@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// ImageInfo describes an image of a registry.
+type ImageInfo struct {
+	// Digest is the digest of the manifest or index of the image.
+	Digest string
+	// Platforms are the platforms of a multi-architecture image, formatted as
+	// `<os>/<arch>[/<variant>]`. Empty for the other images.
+	Platforms []string
+}
+
+// Inspect returns the digest and platforms of the image, only fetching its manifest. Images of
+// the destination registry are read with its credentials, the other images with the source
+// credentials set by WithSourceKeychain. The requests are sent within the limits of the
+// RateLimiter, and the errors of the registries are returned as Error.
+func Inspect(image string, opts ...Option) (*ImageInfo, error) {
+	o := makeOptions(opts...)
+	limited := &rateLimitedTransport{inner: http.DefaultTransport, limiter: o.rateLimiter}
+
+	info, err := inspect(image, o, limited)
+	if err != nil {
+		return nil, limited.classifyError(err)
+	}
+
+	return info, nil
+}
+
+func inspect(image string, o *options, transport http.RoundTripper) (*ImageInfo, error) {
+	ref, err := parseImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := o.credentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch credentials: %w", err)
+	}
+
+	dstKeychain, err := destinationKeychain(o.destinationRepository(creds), creds)
+	if err != nil {
+		return nil, err
+	}
+
+	keychain := authn.NewMultiKeychain(dstKeychain, o.sourceKeychain)
+
+	desc, err := remote.Get(ref.sourceReference(), remote.WithAuthFromKeychain(keychain), remote.WithTransport(transport))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image %q: %w", image, err)
+	}
+
+	info := &ImageInfo{Digest: desc.Digest.String()}
+
+	if !desc.MediaType.IsIndex() {
+		return info, nil
+	}
+
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch image index %q: %w", image, err)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse image index %q: %w", image, err)
+	}
+
+	for _, m := range manifest.Manifests {
+		if m.Platform != nil {
+			info.Platforms = append(info.Platforms, formatPlatform(*m.Platform))
+		}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,99 @@
+//nolint:testpackage
+package registry
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const testIndex = `{
+  "schemaVersion": 2,
+  "mediaType": "application/vnd.docker.distribution.manifest.list.v2+json",
+  "manifests": [
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "size": 1,
+      "digest": "sha256:0000000000000000000000000000000000000000000000000000000000000000",
+      "platform": {"os": "linux", "architecture": "amd64"}
+    },
+    {
+      "mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+      "size": 1,
+      "digest": "sha256:1111111111111111111111111111111111111111111111111111111111111111",
+      "platform": {"os": "linux", "architecture": "arm", "variant": "v7"}
+    }
+  ]
+}`
+
+func TestInspect(t *testing.T) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testIndex)))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", string(types.DockerManifestList))
+		w.Header().Set("Docker-Content-Digest", digest)
+		_, _ = w.Write([]byte(testIndex))
+	}))
+	defer server.Close()
+
+	image := strings.TrimPrefix(server.URL, "http://") + "/library/nginx:1.21"
+	creds := &Credentials{Provider: provider, Username: username, Password: password}
+
+	info, err := Inspect(image, WithCredentials(creds))
+	if err != nil {
+		t.Fatalf("failed to inspect image: %v", err)
+	}
+
+	if info.Digest != digest {
+		t.Errorf("expected digest %q, got %q", digest, info.Digest)
+	}
+
+	wanted := []string{"linux/amd64", "linux/arm/v7"}
+	if strings.Join(info.Platforms, ",") != strings.Join(wanted, ",") {
+		t.Errorf("expected platforms %v, got %v", wanted, info.Platforms)
+	}
+}
+
+func TestInspectRateLimited(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	image := strings.TrimPrefix(server.URL, "http://") + "/library/nginx:1.21"
+	opts := []Option{
+		WithCredentials(&Credentials{Provider: provider, Username: username, Password: password}),
+		WithRateLimiter(NewRateLimiter(DefaultRateLimit, DefaultRateBurst)),
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := Inspect(image, opts...)
+
+		var registryErr *Error
+		if !errors.As(err, &registryErr) || registryErr.Kind != ErrorRateLimited {
+			t.Errorf("expected a rate limited error, got %v", err)
+		}
+	}
+
+	// The throttled registry is not sent the second request.
+	if requests != 1 {
+		t.Errorf("expected 1 request sent to the registry, got %d", requests)
+	}
+}
@@ -0,0 +1,161 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// dockerConfigJSON is the content of the `.dockerconfigjson` key of the
+// `kubernetes.io/dockerconfigjson` Secrets.
+type dockerConfigJSON struct {
+	Auths map[string]authn.AuthConfig `json:"auths"`
+}
+
+// Keychain holds the credentials of registries, keyed by registry host, so that credentials
+// are only ever sent to the registry they belong to. Registries without credentials are
+// accessed anonymously.
+type Keychain map[string]authn.AuthConfig
+
+// Add sets the credentials of the registry, either a host or a docker config key such as
+// `https://index.docker.io/v1/`. Credentials already set for the registry are kept.
+func (k Keychain) Add(registry string, auth authn.AuthConfig) error {
+	host, err := normalizeRegistry(registry)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := k[host]; !ok {
+		k[host] = auth
+	}
+
+	return nil
+}
+
+// Resolve returns the credentials of the registry of the resource.
+func (k Keychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	if auth, ok := k[target.RegistryStr()]; ok {
+		return authn.FromConfig(auth), nil
+	}
+
+	return authn.Anonymous, nil
+}
+
+// NewDockerConfigKeychain returns a keychain from the content of docker config files, as
+// found in the `kubernetes.io/dockerconfigjson` Secrets. When several configs have
+// credentials for the same registry, the first one is used.
+func NewDockerConfigKeychain(configs ...[]byte) (Keychain, error) {
+	keychain := Keychain{}
+
+	for _, config := range configs {
+		dockerConfig := &dockerConfigJSON{}
+
+		if err := json.Unmarshal(config, dockerConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse docker config: %v", err)
+		}
+
+		for registry, auth := range dockerConfig.Auths {
+			if err := keychain.Add(registry, auth); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return keychain, nil
+}
+
+// normalizeRegistry returns the host of the registry keys of the docker config files, which
+// may be URLs such as `https://index.docker.io/v1/`.
+func normalizeRegistry(registry string) (string, error) {
+	host := strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	if index := strings.Index(host, "/"); index != -1 {
+		host = host[:index]
+	}
+
+	reg, err := name.NewRegistry(host)
+	if err != nil {
+		return "", fmt.Errorf("invalid registry %q: %v", registry, err)
+	}
+
+	return reg.RegistryStr(), nil
+}
+
+// DestinationDockerConfig returns the credentials of the destination registry as the content
+// of a `kubernetes.io/dockerconfigjson` Secret.
+func DestinationDockerConfig(opts ...Option) ([]byte, error) {
+	o := makeOptions(opts...)
+
+	creds, err := o.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	registry, err := repositoryRegistry(o.destinationRepository(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return dockerConfig(registry, creds)
+}
+
+// PullDockerConfig returns the pull-only credentials of the destination registry as the
+// content of a `kubernetes.io/dockerconfigjson` Secret, nil when they are the credentials of
+// another registry than the destination registry of the options. Like the credentials of the
+// destination registry, their provider is their registry, Docker Hub when not set.
+func PullDockerConfig(pull *Credentials, opts ...Option) ([]byte, error) {
+	if err := pull.Validate(); err != nil {
+		return nil, err
+	}
+
+	registry, err := DestinationRegistry(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	pullRegistry, err := repositoryRegistry(pull.destination())
+	if err != nil {
+		return nil, err
+	}
+
+	if pullRegistry != registry {
+		return nil, nil
+	}
+
+	return dockerConfig(registry, pull)
+}
+
+// dockerConfig returns the credentials of the registry as the content of a
+// `kubernetes.io/dockerconfigjson` Secret.
+func dockerConfig(registry string, creds *Credentials) ([]byte, error) {
+	if registry == name.DefaultRegistry {
+		registry = authn.DefaultAuthKey
+	}
+
+	return json.Marshal(dockerConfigJSON{
+		Auths: map[string]authn.AuthConfig{
+			registry: {
+				Username: creds.Username,
+				Password: creds.Password,
+			},
+		},
+	})
+}
+
+// destinationKeychain returns the keychain holding the credentials of the registry of the
+// destination repository only.
+func destinationKeychain(destination string, creds *Credentials) (Keychain, error) {
+	registry, err := repositoryRegistry(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	return Keychain{
+		registry: {
+			Username: creds.Username,
+			Password: creds.Password,
+		},
+	}, nil
+}
@@ -0,0 +1,213 @@
+//nolint:testpackage
+package registry
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	dockerHubConfig = `{"auths":{"https://index.docker.io/v1/":{"username":"hub","password":"hubpass"}}}`
+	quayConfig      = `{"auths":{"quay.io":{"auth":"cXVheTpxdWF5cGFzcw=="},"docker.io":{"username":"other"}}}`
+)
+
+func TestDockerConfigKeychain(t *testing.T) {
+	keychain, err := NewDockerConfigKeychain([]byte(dockerHubConfig), []byte(quayConfig))
+	if err != nil {
+		t.Fatalf("failed to create keychain: %v", err)
+	}
+
+	cases := []struct {
+		image  string
+		wanted authn.AuthConfig
+	}{
+		{
+			image:  "nginx",
+			wanted: authn.AuthConfig{Username: "hub", Password: "hubpass"},
+		},
+		{
+			image:  "quay.io/prometheus/node-exporter",
+			wanted: authn.AuthConfig{Auth: "cXVheTpxdWF5cGFzcw=="},
+		},
+		{
+			image:  "gcr.io/distroless/static",
+			wanted: authn.AuthConfig{},
+		},
+	}
+
+	for _, testcase := range cases {
+		ref, err := name.ParseReference(testcase.image)
+		if err != nil {
+			t.Fatalf("failed parsing reference: %v", err)
+		}
+
+		auth, err := keychain.Resolve(ref.Context())
+		if err != nil {
+			t.Fatalf("failed to resolve credentials: %v", err)
+		}
+
+		config, err := auth.Authorization()
+		if err != nil {
+			t.Fatalf("failed to get authorization: %v", err)
+		}
+
+		if *config != testcase.wanted {
+			t.Errorf("%q: expected credentials %v, got %v", testcase.image, testcase.wanted, *config)
+		}
+	}
+
+	if _, err := NewDockerConfigKeychain([]byte("not json")); err == nil {
+		t.Errorf("expected error for invalid docker config")
+	}
+}
+
+func TestDestinationDockerConfig(t *testing.T) {
+	cases := []struct {
+		provider string
+		registry string
+	}{
+		{
+			provider: "",
+			registry: authn.DefaultAuthKey,
+		},
+		{
+			provider: "docker.io",
+			registry: authn.DefaultAuthKey,
+		},
+		{
+			provider: "quay.io",
+			registry: "quay.io",
+		},
+		{
+			provider: "myregistry:5000/team",
+			registry: "myregistry:5000",
+		},
+	}
+
+	for _, testcase := range cases {
+		if err := os.Setenv("REGISTRY_PROVIDER", testcase.provider); err != nil {
+			t.Fatalf("Failed to set env variable `REGISTRY_PROVIDER`: %q", err)
+		}
+
+		if err := os.Setenv("REGISTRY_USERNAME", username); err != nil {
+			t.Fatalf("Failed to set env variable `REGISTRY_USERNAME`: %q", err)
+		}
+
+		if err := os.Setenv("REGISTRY_PASSWORD", password); err != nil {
+			t.Fatalf("Failed to set env variable `REGISTRY_PASSWORD`: %q", err)
+		}
+
+		data, err := DestinationDockerConfig()
+		if err != nil {
+			t.Fatalf("failed to get docker config: %v", err)
+		}
+
+		config := &dockerConfigJSON{}
+		if err := json.Unmarshal(data, config); err != nil {
+			t.Fatalf("failed to parse docker config: %v", err)
+		}
+
+		auth, ok := config.Auths[testcase.registry]
+		if !ok || len(config.Auths) != 1 {
+			t.Errorf("%q: expected credentials of %q, got %v", testcase.provider, testcase.registry, config.Auths)
+		}
+
+		if auth.Username != username || auth.Password != password {
+			t.Errorf("%q: expected credentials %s/%s, got %s/%s",
+				testcase.provider, username, password, auth.Username, auth.Password)
+		}
+	}
+}
+
+func TestPullDockerConfig(t *testing.T) {
+	destination := WithCredentials(&Credentials{Provider: "quay.io", Username: username, Password: password})
+
+	cases := []struct {
+		provider string
+		wanted   bool
+	}{
+		{provider: "quay.io", wanted: true},
+		{provider: "quay.io/other", wanted: true},
+		{provider: "", wanted: false},
+		{provider: "myregistry:5000", wanted: false},
+	}
+
+	for _, testcase := range cases {
+		pull := &Credentials{Provider: testcase.provider, Username: "puller", Password: "pullpass"}
+
+		data, err := PullDockerConfig(pull, destination)
+		if err != nil {
+			t.Fatalf("%q: failed to get docker config: %v", testcase.provider, err)
+		}
+
+		if !testcase.wanted {
+			if data != nil {
+				t.Errorf("%q: expected no docker config, got %s", testcase.provider, data)
+			}
+
+			continue
+		}
+
+		config := &dockerConfigJSON{}
+		if err := json.Unmarshal(data, config); err != nil {
+			t.Fatalf("%q: failed to parse docker config: %v", testcase.provider, err)
+		}
+
+		if auth := config.Auths["quay.io"]; auth.Username != "puller" || auth.Password != "pullpass" {
+			t.Errorf("%q: expected the pull credentials of quay.io, got %v", testcase.provider, config.Auths)
+		}
+	}
+}
+
+func TestDestinationKeychain(t *testing.T) {
+	creds := &Credentials{Provider: "quay.io", Username: username, Password: password}
+
+	keychain, err := destinationKeychain(creds.destination(), creds)
+	if err != nil {
+		t.Fatalf("failed to create keychain: %v", err)
+	}
+
+	cases := []struct {
+		image  string
+		wanted authn.AuthConfig
+	}{
+		{
+			image:  "quay.io/foo/nginx",
+			wanted: authn.AuthConfig{Username: username, Password: password},
+		},
+		{
+			// Source registries never get the credentials of the destination registry.
+			image:  "nginx",
+			wanted: authn.AuthConfig{},
+		},
+		{
+			image:  "quay.io.example.com/foo/nginx",
+			wanted: authn.AuthConfig{},
+		},
+	}
+
+	for _, testcase := range cases {
+		ref, err := name.ParseReference(testcase.image)
+		if err != nil {
+			t.Fatalf("failed parsing reference: %v", err)
+		}
+
+		auth, err := keychain.Resolve(ref.Context())
+		if err != nil {
+			t.Fatalf("failed to resolve credentials: %v", err)
+		}
+
+		config, err := auth.Authorization()
+		if err != nil {
+			t.Fatalf("failed to get authorization: %v", err)
+		}
+
+		if *config != testcase.wanted {
+			t.Errorf("%q: expected credentials %v, got %v", testcase.image, testcase.wanted, *config)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// countingTransport counts the bytes of the bodies of the requests sent through it.
+type countingTransport struct {
+	inner http.RoundTripper
+	bytes int64
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(req.Context())
+		req.Body = &countingReader{ReadCloser: req.Body, bytes: &t.bytes}
+	}
+
+	return t.inner.RoundTrip(req)
+}
+
+func (t *countingTransport) count() int64 {
+	return atomic.LoadInt64(&t.bytes)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	bytes *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.bytes, int64(n))
+
+	return n, err
+}
+
+// sourceRegistry returns the registry of the image, as reported by the metrics.
+func sourceRegistry(image string) string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "unknown"
+	}
+
+	return ref.Context().RegistryStr()
+}
@@ -0,0 +1,40 @@
+//nolint:testpackage
+package registry
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCountingTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	uploads := &countingTransport{inner: http.DefaultTransport}
+	client := &http.Client{Transport: uploads}
+
+	for _, body := range []string{"layer", "manifest"} {
+		resp, err := client.Post(server.URL, "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+
+		resp.Body.Close()
+	}
+
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+
+	resp.Body.Close()
+
+	if wanted := int64(len("layer") + len("manifest")); uploads.count() != wanted {
+		t.Errorf("expected %d bytes, got %d", wanted, uploads.count())
+	}
+}
@@ -0,0 +1,80 @@
+package registry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// dockerHubRegistry is the name used for the images of Docker Hub in the destination
+// repository, instead of the `index.docker.io` host.
+const dockerHubRegistry = "docker.io"
+
+// NamingScheme defines how the destination repository is named after the source repository.
+type NamingScheme string
+
+const (
+	// NamingSchemeFlat only keeps the last path segment of the source repository, e.g.
+	// `quay.io/bitnami/nginx:1.2` is backed up as `<provider>/<username>/nginx:1.2`.
+	// Repositories with the same name in different registries or organizations collide.
+	NamingSchemeFlat NamingScheme = "flat"
+	// NamingSchemePath keeps the source registry host and the full repository path, e.g.
+	// `quay.io/bitnami/nginx:1.2` is backed up as
+	// `<provider>/<username>/quay.io/bitnami/nginx:1.2`. The destination registry must
+	// support nested repositories.
+	NamingSchemePath NamingScheme = "path"
+)
+
+// ParseNamingScheme parses the naming scheme provided by the user.
+func ParseNamingScheme(scheme string) (NamingScheme, error) {
+	switch NamingScheme(scheme) {
+	case NamingSchemeFlat, NamingSchemePath:
+		return NamingScheme(scheme), nil
+	default:
+		return "", fmt.Errorf("invalid naming scheme %q, must be one of %q or %q",
+			scheme, NamingSchemeFlat, NamingSchemePath)
+	}
+}
+
+// repositoryPath returns the path of the source repository as used in the destination
+// repository by the path naming scheme.
+func repositoryPath(repo name.Repository) string {
+	registry := repo.RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = dockerHubRegistry
+	}
+
+	// The port of the registry is not a valid repository path component.
+	registry = strings.ReplaceAll(registry, ":", "_")
+
+	return path.Join(registry, repo.RepositoryStr())
+}
+
+// isDestinationRepository reports whether the repository is already in the destination
+// repository, whatever naming scheme it was backed up with.
+func isDestinationRepository(repo name.Repository, destination string) (bool, error) {
+	dst, err := name.NewRepository(destination)
+	if err != nil {
+		return false, fmt.Errorf("failed parsing destination repository: %v", err)
+	}
+
+	if repo.RegistryStr() != dst.RegistryStr() {
+		return false, nil
+	}
+
+	return strings.HasPrefix(repo.RepositoryStr(), destinationPath(destination)+"/"), nil
+}
+
+// destinationPath returns the path of the repository without its registry. Unlike
+// RepositoryStr, the path of a Docker Hub repository made of a single segment, e.g. the
+// `<username>` destination repository, is not prefixed by `library/`.
+func destinationPath(repository string) string {
+	parts := strings.SplitN(repository, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		return parts[1]
+	}
+
+	return repository
+}
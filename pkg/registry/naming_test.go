@@ -0,0 +1,45 @@
+//nolint:testpackage
+package registry
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestIsDestinationRepository(t *testing.T) {
+	cases := []struct {
+		repository  string
+		destination string
+		wanted      bool
+	}{
+		{repository: "quay.io/team/nginx", destination: "quay.io/team", wanted: true},
+		{repository: "quay.io/team/docker.io/library/nginx", destination: "quay.io/team", wanted: true},
+		{repository: "quay.io/other/nginx", destination: "quay.io/team", wanted: false},
+		{repository: "quay.io/teammate/nginx", destination: "quay.io/team", wanted: false},
+		{repository: "myregistry:5000/team/nginx", destination: "quay.io/team", wanted: false},
+		// Docker Hub destinations are made of the username only.
+		{repository: "myuser/nginx", destination: "myuser", wanted: true},
+		{repository: "docker.io/myuser/nginx", destination: "myuser", wanted: true},
+		{repository: "index.docker.io/myuser/nginx", destination: "docker.io/myuser", wanted: true},
+		{repository: "nginx", destination: "myuser", wanted: false},
+		{repository: "otheruser/nginx", destination: "myuser", wanted: false},
+		{repository: "quay.io/myuser/nginx", destination: "myuser", wanted: false},
+	}
+
+	for _, testcase := range cases {
+		repo, err := name.NewRepository(testcase.repository)
+		if err != nil {
+			t.Fatalf("%q: failed parsing repository: %v", testcase.repository, err)
+		}
+
+		got, err := isDestinationRepository(repo, testcase.destination)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", testcase.repository, err)
+		}
+
+		if got != testcase.wanted {
+			t.Errorf("%q in %q: expected %t, got %t", testcase.repository, testcase.destination, testcase.wanted, got)
+		}
+	}
+}
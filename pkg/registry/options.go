@@ -0,0 +1,135 @@
+package registry
+
+import (
+	"context"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+)
+
+// Option configures GetDestinationImage and Backup.
+type Option func(*options)
+
+type options struct {
+	platforms      PlatformFilter
+	namingScheme   NamingScheme
+	sourceKeychain authn.Keychain
+	creds          *Credentials
+	destination    string
+	sources        SourceFilter
+	rules          SourceRules
+	replicas       []*CredentialsStore
+	rateLimiter    *RateLimiter
+	blobs          *BlobCache
+	transfers      *TransferLimiter
+	confirmed      *replicaCache
+	ctx            context.Context
+}
+
+func makeOptions(opts ...Option) *options {
+	o := &options{
+		namingScheme:   NamingSchemeFlat,
+		sourceKeychain: Keychain{},
+		rateLimiter:    defaultRateLimiter,
+		blobs:          defaultBlobCache,
+		transfers:      defaultTransferLimiter,
+		confirmed:      defaultReplicaCache,
+		ctx:            context.Background(),
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// credentials returns the credentials set by WithCredentials, falling back to the
+// `REGISTRY_PROVIDER`, `REGISTRY_USERNAME` and `REGISTRY_PASSWORD` environment variables.
+func (o *options) credentials() (*Credentials, error) {
+	if o.creds != nil {
+		return o.creds, o.creds.Validate()
+	}
+
+	return fetchCredentials()
+}
+
+// destinationRepository returns the repository the images are backed up into, set by
+// WithDestination or made of the provider and username of the credentials.
+func (o *options) destinationRepository(creds *Credentials) string {
+	if len(o.destination) != 0 {
+		return o.destination
+	}
+
+	return creds.destination()
+}
+
+// WithPlatforms restricts the platforms of the multi-architecture images being backed up.
+func WithPlatforms(platforms PlatformFilter) Option {
+	return func(o *options) {
+		o.platforms = platforms
+	}
+}
+
+// WithNamingScheme sets the naming scheme of the destination images, NamingSchemeFlat by
+// default.
+func WithNamingScheme(scheme NamingScheme) Option {
+	return func(o *options) {
+		o.namingScheme = scheme
+	}
+}
+
+// WithSourceKeychain sets the credentials used to pull the source images, e.g. from the image
+// pull secrets of a workload. The source images are pulled anonymously by default.
+func WithSourceKeychain(keychain authn.Keychain) Option {
+	return func(o *options) {
+		o.sourceKeychain = keychain
+	}
+}
+
+// WithCredentials sets the credentials of the destination registry, read from the
+// environment variables by default.
+func WithCredentials(creds *Credentials) Option {
+	return func(o *options) {
+		o.creds = creds
+	}
+}
+
+// WithDestination sets the repository the images are backed up into, e.g. `quay.io/team`,
+// instead of the `<provider>/<username>` repository of the credentials.
+func WithDestination(repository string) Option {
+	return func(o *options) {
+		o.destination = repository
+	}
+}
+
+// WithSourceFilter restricts the source images being backed up, all the images are backed up
+// by default.
+func WithSourceFilter(filter SourceFilter) Option {
+	return func(o *options) {
+		o.sources = filter
+	}
+}
+
+// WithRateLimiter sets the limits of the requests sent to the registries. The calls without
+// RateLimiter share the limits of DefaultRateLimit and DefaultRateBurst.
+func WithRateLimiter(limiter *RateLimiter) Option {
+	return func(o *options) {
+		o.rateLimiter = limiter
+	}
+}
+
+// WithContext sets the context of the requests sent by Backup and of its waits for the limits
+// of the TransferLimiter, which are given up once the context is done.
+func WithContext(ctx context.Context) Option {
+	return func(o *options) {
+		o.ctx = ctx
+	}
+}
+
+// WithSourceRules sets the ordered rules deciding whether the source images are mirrored,
+// skipped or denied, all the images are mirrored by default.
+func WithSourceRules(rules SourceRules) Option {
+	return func(o *options) {
+		o.rules = rules
+	}
+}
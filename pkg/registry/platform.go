@@ -0,0 +1,199 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+const (
+	// anyImage is the key of the PlatformFilter entry applying to all the images.
+	anyImage = "*"
+
+	// Number of `=` separated fields of a PlatformFilter entry.
+	filterEntryFields = 2
+
+	// Number of `/` separated fields of a platform without and with variant.
+	platformFields            = 2
+	platformFieldsWithVariant = 3
+)
+
+// PlatformFilter is an allow-list of platforms per source repository. Only the listed
+// platforms of a multi-architecture image are backed up.
+type PlatformFilter map[string][]v1.Platform
+
+// ParsePlatformFilter parses the platforms provided by the user in the following format:
+// `<image>=<os>/<arch>[/<variant>],...;<image>=...`, e.g.
+// `nginx=linux/amd64,linux/arm64;quay.io/prometheus/node-exporter=linux/amd64`.
+// The image `*` applies to all the images without an entry of their own.
+func ParsePlatformFilter(platforms string) (PlatformFilter, error) {
+	filter := PlatformFilter{}
+
+	for _, entry := range strings.Split(platforms, ";") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		str := strings.Split(entry, "=")
+		if len(str) != filterEntryFields {
+			return nil, fmt.Errorf("invalid platforms %q, expected <image>=<platforms>", entry)
+		}
+
+		image := strings.TrimSpace(str[0])
+
+		if image != anyImage {
+			repo, err := name.NewRepository(image)
+			if err != nil {
+				return nil, fmt.Errorf("invalid image %q: %v", image, err)
+			}
+
+			image = repo.Name()
+		}
+
+		for _, platform := range strings.Split(str[1], ",") {
+			p, err := parsePlatform(strings.TrimSpace(platform))
+			if err != nil {
+				return nil, err
+			}
+
+			filter[image] = append(filter[image], p)
+		}
+	}
+
+	return filter, nil
+}
+
+func parsePlatform(platform string) (v1.Platform, error) {
+	str := strings.Split(platform, "/")
+
+	switch len(str) {
+	case platformFields:
+		return v1.Platform{OS: str[0], Architecture: str[1]}, nil
+	case platformFieldsWithVariant:
+		return v1.Platform{OS: str[0], Architecture: str[1], Variant: str[2]}, nil
+	default:
+		return v1.Platform{}, fmt.Errorf("invalid platform %q, expected <os>/<arch>[/<variant>]", platform)
+	}
+}
+
+// formatPlatform formats the platform as parsed by parsePlatform, `<os>/<arch>[/<variant>]`.
+func formatPlatform(platform v1.Platform) string {
+	if len(platform.Variant) != 0 {
+		return fmt.Sprintf("%s/%s/%s", platform.OS, platform.Architecture, platform.Variant)
+	}
+
+	return fmt.Sprintf("%s/%s", platform.OS, platform.Architecture)
+}
+
+// platformsFor returns the platforms allowed for the given repository, nil means all the
+// platforms are allowed.
+func (f PlatformFilter) platformsFor(repo name.Repository) []v1.Platform {
+	if platforms, ok := f[repo.Name()]; ok {
+		return platforms
+	}
+
+	return f[anyImage]
+}
+
+// matchPlatform reports whether the platform is allowed by any of the given platforms. The
+// variant is only compared when it is set in the allowed platform.
+func matchPlatform(platform *v1.Platform, allowed []v1.Platform) bool {
+	if platform == nil {
+		return false
+	}
+
+	for _, a := range allowed {
+		if a.OS == platform.OS && a.Architecture == platform.Architecture &&
+			(len(a.Variant) == 0 || a.Variant == platform.Variant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filteredIndex is an image index that only references the manifests of the allowed
+// platforms of the underlying index.
+type filteredIndex struct {
+	base     v1.ImageIndex
+	manifest *v1.IndexManifest
+	raw      []byte
+}
+
+func filterIndex(index v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index manifest: %v", err)
+	}
+
+	filtered := manifest.DeepCopy()
+	filtered.Manifests = nil
+
+	for _, desc := range manifest.Manifests {
+		if matchPlatform(desc.Platform, platforms) {
+			filtered.Manifests = append(filtered.Manifests, desc)
+		}
+	}
+
+	if len(filtered.Manifests) == 0 {
+		return nil, fmt.Errorf("none of the platforms %v found in the index", platforms)
+	}
+
+	raw, err := json.Marshal(filtered)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal index manifest: %v", err)
+	}
+
+	return &filteredIndex{
+		base:     index,
+		manifest: filtered,
+		raw:      raw,
+	}, nil
+}
+
+// Digest returns the sha256 of the filtered index manifest.
+func (fi *filteredIndex) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(fi.raw))
+
+	return h, err
+}
+
+// Size returns the size of the filtered index manifest.
+func (fi *filteredIndex) Size() (int64, error) {
+	return int64(len(fi.raw)), nil
+}
+
+// IndexManifest returns the filtered index manifest.
+func (fi *filteredIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return fi.manifest.DeepCopy(), nil
+}
+
+// RawManifest returns the serialized filtered index manifest.
+func (fi *filteredIndex) RawManifest() ([]byte, error) {
+	return fi.raw, nil
+}
+
+// MediaType returns the media type of the underlying index.
+func (fi *filteredIndex) MediaType() (types.MediaType, error) {
+	if len(fi.manifest.MediaType) != 0 {
+		return fi.manifest.MediaType, nil
+	}
+
+	return fi.base.MediaType()
+}
+
+// Image returns the image of the underlying index.
+func (fi *filteredIndex) Image(h v1.Hash) (v1.Image, error) {
+	return fi.base.Image(h)
+}
+
+// ImageIndex returns the image index of the underlying index.
+func (fi *filteredIndex) ImageIndex(h v1.Hash) (v1.ImageIndex, error) {
+	return fi.base.ImageIndex(h)
+}
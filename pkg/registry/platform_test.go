@@ -0,0 +1,166 @@
+//nolint:testpackage
+package registry
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+//nolint:funlen
+func TestParsePlatformFilter(t *testing.T) {
+	cases := []struct {
+		input     string
+		image     string
+		platforms []v1.Platform
+		expectErr bool
+	}{
+		{
+			input: "",
+			image: "nginx",
+		},
+		{
+			input:     "nginx=linux/amd64,linux/arm/v7",
+			image:     "docker.io/library/nginx",
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm", Variant: "v7"}},
+		},
+		{
+			input:     "*=linux/amd64; quay.io/prometheus/node-exporter=linux/arm64",
+			image:     "quay.io/prometheus/node-exporter",
+			platforms: []v1.Platform{{OS: "linux", Architecture: "arm64"}},
+		},
+		{
+			input:     "*=linux/amd64;quay.io/prometheus/node-exporter=linux/arm64",
+			image:     "busybox",
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}},
+		},
+		{
+			input:     "nginx",
+			expectErr: true,
+		},
+		{
+			input:     "nginx=linux",
+			expectErr: true,
+		},
+	}
+
+	for _, testcase := range cases {
+		filter, err := ParsePlatformFilter(testcase.input)
+		if testcase.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected error", testcase.input)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: failed to parse platforms: %v", testcase.input, err)
+
+			continue
+		}
+
+		repo, err := name.NewRepository(testcase.image)
+		if err != nil {
+			t.Fatalf("failed parsing repository: %v", err)
+		}
+
+		platforms := filter.platformsFor(repo)
+		if len(platforms) != len(testcase.platforms) {
+			t.Errorf("%q: expected platforms %v, got %v", testcase.input, testcase.platforms, platforms)
+
+			continue
+		}
+
+		for index := range platforms {
+			if !platforms[index].Equals(testcase.platforms[index]) {
+				t.Errorf("%q: expected platforms %v, got %v", testcase.input, testcase.platforms, platforms)
+			}
+		}
+	}
+}
+
+// imageIndex allows embedding v1.ImageIndex, whose ImageIndex method conflicts with the
+// name of the embedded field.
+type imageIndex interface {
+	v1.ImageIndex
+}
+
+type fakeIndex struct {
+	imageIndex
+
+	manifest *v1.IndexManifest
+}
+
+func (fi *fakeIndex) IndexManifest() (*v1.IndexManifest, error) {
+	return fi.manifest, nil
+}
+
+//nolint:funlen
+func TestFilterIndex(t *testing.T) {
+	index := &fakeIndex{
+		manifest: &v1.IndexManifest{
+			SchemaVersion: 2, //nolint:gomnd
+			MediaType:     types.DockerManifestList,
+			Manifests: []v1.Descriptor{
+				{Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+				{Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v6"}},
+				{Platform: &v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}},
+				{},
+			},
+		},
+	}
+
+	cases := []struct {
+		platforms []v1.Platform
+		manifests int
+		expectErr bool
+	}{
+		{
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}},
+			manifests: 1,
+		},
+		{
+			platforms: []v1.Platform{{OS: "linux", Architecture: "arm"}},
+			manifests: 2, //nolint:gomnd
+		},
+		{
+			platforms: []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm", Variant: "v7"}},
+			manifests: 2, //nolint:gomnd
+		},
+		{
+			platforms: []v1.Platform{{OS: "windows", Architecture: "amd64"}},
+			expectErr: true,
+		},
+	}
+
+	for _, testcase := range cases {
+		filtered, err := filterIndex(index, testcase.platforms)
+		if testcase.expectErr {
+			if err == nil {
+				t.Errorf("%v: expected error", testcase.platforms)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("%v: failed to filter index: %v", testcase.platforms, err)
+		}
+
+		manifest, err := filtered.IndexManifest()
+		if err != nil {
+			t.Fatalf("failed to get index manifest: %v", err)
+		}
+
+		if len(manifest.Manifests) != testcase.manifests {
+			t.Errorf("%v: expected %d manifests, got %d", testcase.platforms, testcase.manifests, len(manifest.Manifests))
+		}
+
+		if mediaType, _ := filtered.MediaType(); mediaType != types.DockerManifestList {
+			t.Errorf("expected media type %q, got %q", types.DockerManifestList, mediaType)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultRateLimit is the default number of requests per second sent to each registry.
+	DefaultRateLimit = 10
+	// DefaultRateBurst is the default number of requests sent at once to each registry.
+	DefaultRateBurst = 20
+)
+
+// defaultRateLimiter is shared by the calls without WithRateLimiter.
+var defaultRateLimiter = NewRateLimiter(DefaultRateLimit, DefaultRateBurst)
+
+// RateLimiter limits the requests sent to each registry with a token bucket per registry. A
+// registry throttling the requests is not sent any request until its Retry-After delay is
+// over.
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu         sync.Mutex
+	registries map[string]*registryLimiter
+}
+
+type registryLimiter struct {
+	limiter *rate.Limiter
+
+	mu sync.Mutex
+	// pausedUntil is the end of the Retry-After delay of the registry.
+	pausedUntil time.Time
+}
+
+// NewRateLimiter returns a RateLimiter sending up to requestsPerSecond requests per second to
+// each registry, with bursts of up to burst requests.
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		limit:      rate.Limit(requestsPerSecond),
+		burst:      burst,
+		registries: map[string]*registryLimiter{},
+	}
+}
+
+func (l *RateLimiter) registry(host string) *registryLimiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	r, ok := l.registries[host]
+	if !ok {
+		r = &registryLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.registries[host] = r
+	}
+
+	return r
+}
+
+// wait waits for a token of the registry. Returns the remaining delay when the registry is
+// paused instead of waiting for it.
+func (r *registryLimiter) wait(ctx context.Context, now time.Time) (time.Duration, error) {
+	r.mu.Lock()
+	paused := r.pausedUntil.Sub(now)
+	r.mu.Unlock()
+
+	if paused > 0 {
+		return paused, nil
+	}
+
+	return 0, r.limiter.Wait(ctx)
+}
+
+func (r *registryLimiter) pause(until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if until.After(r.pausedUntil) {
+		r.pausedUntil = until
+	}
+}
+
+// rateLimitedTransport sends the requests within the limits of the RateLimiter, and records the
+// last failure for classifyError.
+type rateLimitedTransport struct {
+	inner   http.RoundTripper
+	limiter *RateLimiter
+
+	mu sync.Mutex
+	// failedHost is the host of the last request which failed, and retryAfter its Retry-After
+	// delay if it was throttled.
+	failedHost string
+	retryAfter time.Duration
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	registry := t.limiter.registry(req.URL.Host)
+
+	paused, err := registry.wait(req.Context(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	if paused > 0 {
+		t.failed(req.URL.Host, paused)
+
+		// The throttled registry is not sent the request, the error is returned as if it
+		// answered it.
+		return &http.Response{
+			Status:     http.StatusText(http.StatusTooManyRequests),
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{},
+			Body:       http.NoBody,
+			Request:    req,
+		}, nil
+	}
+
+	resp, err := t.inner.RoundTrip(req)
+	if err != nil {
+		t.failed(req.URL.Host, 0)
+
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		retryAfter := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if retryAfter <= 0 {
+			retryAfter = defaultRetryAfter
+		}
+
+		registry.pause(time.Now().Add(retryAfter))
+		t.failed(req.URL.Host, retryAfter)
+	case isFailure(req, resp):
+		t.failed(req.URL.Host, 0)
+	}
+
+	return resp, nil
+}
+
+// isFailure reports whether the response is an error of the registry. The authentication
+// challenges, answered before the requests are sent again with a token, and the images found
+// missing by a HEAD request checking whether they exist are part of the normal exchanges.
+func isFailure(req *http.Request, resp *http.Response) bool {
+	switch {
+	case resp.StatusCode < http.StatusBadRequest:
+		return false
+	case resp.StatusCode == http.StatusUnauthorized && len(resp.Header.Get("WWW-Authenticate")) != 0:
+		return false
+	case resp.StatusCode == http.StatusNotFound && req.Method == http.MethodHead:
+		return false
+	default:
+		return true
+	}
+}
+
+func (t *rateLimitedTransport) failed(host string, retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failedHost, t.retryAfter = host, retryAfter
+}
+
+// classifyError classifies the error of the requests sent through the transport.
+func (t *rateLimitedTransport) classifyError(err error) error {
+	t.mu.Lock()
+	host, retryAfter := t.failedHost, t.retryAfter
+	t.mu.Unlock()
+
+	return classifyError(err, host, retryAfter)
+}
+
+// parseRetryAfter parses the Retry-After header, either a number of seconds or an HTTP date.
+// Returns zero when not set or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if len(value) == 0 {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date.Sub(now)
+	}
+
+	return 0
+}
@@ -0,0 +1,115 @@
+//nolint:testpackage
+package registry
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitedTransport(t *testing.T) {
+	requests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	limited := &rateLimitedTransport{inner: http.DefaultTransport, limiter: NewRateLimiter(DefaultRateLimit, 1)}
+	client := &http.Client{Transport: limited}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL) //nolint:noctx
+		if err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, resp.StatusCode)
+		}
+	}
+
+	// The registry is not sent any request until its Retry-After delay is over.
+	if requests != 1 {
+		t.Errorf("expected 1 request sent to the registry, got %d", requests)
+	}
+
+	if retryAfter := limited.retryAfter; retryAfter <= time.Minute || retryAfter > 2*time.Minute {
+		t.Errorf("expected a retry after about 2 minutes, got %s", retryAfter)
+	}
+}
+
+func TestRateLimitedTransportFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/challenge":
+			w.Header().Set("WWW-Authenticate", `Bearer realm="https://auth.example.com/token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/unauthorized":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case "/error":
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		method string
+		path   string
+		failed bool
+	}{
+		{method: http.MethodGet, path: "/ok"},
+		{method: http.MethodGet, path: "/challenge"},
+		{method: http.MethodHead, path: "/missing"},
+		{method: http.MethodGet, path: "/missing", failed: true},
+		{method: http.MethodGet, path: "/unauthorized", failed: true},
+		{method: http.MethodPut, path: "/error", failed: true},
+	}
+
+	for _, testcase := range cases {
+		limited := &rateLimitedTransport{inner: http.DefaultTransport, limiter: NewRateLimiter(DefaultRateLimit, 1)}
+
+		req, err := http.NewRequest(testcase.method, server.URL+testcase.path, nil) //nolint:noctx
+		if err != nil {
+			t.Fatalf("failed to create request: %v", err)
+		}
+
+		resp, err := limited.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s %s: failed to send request: %v", testcase.method, testcase.path, err)
+		}
+
+		resp.Body.Close()
+
+		if failed := len(limited.failedHost) != 0; failed != testcase.failed {
+			t.Errorf("%s %s: expected failure recorded %t, got %t", testcase.method, testcase.path, testcase.failed, failed)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	cases := map[string]time.Duration{
+		"":                              0,
+		"30":                            30 * time.Second,
+		"Mon, 01 Mar 2021 12:01:00 GMT": time.Minute,
+		"soon":                          0,
+	}
+
+	for value, wanted := range cases {
+		if delay := parseRetryAfter(value, now); delay != wanted {
+			t.Errorf("%q: expected %s, got %s", value, wanted, delay)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const digestDelimiter = "@"
+
+// imageReference is a parsed image reference. Unlike name.ParseReference it keeps both the
+// tag and the digest of the references pinned by a tag and a digest, e.g.
+// `nginx:1.21@sha256:...`.
+type imageReference struct {
+	repository name.Repository
+	// tag is empty when the image has no explicit tag.
+	tag string
+	// digest is empty when the image is not pinned by digest.
+	digest string
+}
+
+func parseImage(image string) (*imageReference, error) {
+	ref := &imageReference{}
+	base := image
+
+	if index := strings.LastIndex(image, digestDelimiter); index != -1 {
+		digest, err := name.NewDigest(image)
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing image reference: %v", err)
+		}
+
+		ref.digest = digest.DigestStr()
+		base = image[:index]
+	}
+
+	// No default tag, so that the tag is only set when explicitly provided.
+	tag, err := name.NewTag(base, name.WithDefaultTag(""))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing image reference: %v", err)
+	}
+
+	ref.repository = tag.Context()
+	ref.tag = tag.TagStr()
+
+	return ref, nil
+}
+
+// suffix returns the tag and digest part of the reference, e.g. `:1.21@sha256:...`.
+func (r *imageReference) suffix() string {
+	suffix := ""
+
+	if len(r.tag) != 0 {
+		suffix += fmt.Sprintf(":%s", r.tag)
+	}
+
+	if len(r.digest) != 0 {
+		suffix += fmt.Sprintf("%s%s", digestDelimiter, r.digest)
+	}
+
+	return suffix
+}
+
+// sourceReference returns the reference the image is pulled with. The digest takes
+// precedence over the tag, as the runtime does when pulling the image.
+func (r *imageReference) sourceReference() name.Reference {
+	if len(r.digest) != 0 {
+		return r.repository.Digest(r.digest)
+	}
+
+	return r.tagReference()
+}
+
+// destinationReference returns the reference the image is pushed with. The tag takes
+// precedence over the digest, so that the pushed image is tagged. The digest is the digest
+// of the source image, being copied as is.
+func (r *imageReference) destinationReference() name.Reference {
+	if len(r.tag) == 0 && len(r.digest) != 0 {
+		return r.repository.Digest(r.digest)
+	}
+
+	return r.tagReference()
+}
+
+func (r *imageReference) tagReference() name.Tag {
+	if len(r.tag) != 0 {
+		return r.repository.Tag(r.tag)
+	}
+
+	return r.repository.Tag(name.DefaultTag)
+}
+
+// PinDigest returns the image pinned by the digest, keeping its tag, e.g.
+// `registry.example.com/backup/nginx:1.21@sha256:...`. Images already pinned by digest are
+// returned unchanged.
+func PinDigest(image, digest string) (string, error) {
+	ref, err := parseImage(image)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ref.digest) != 0 {
+		return image, nil
+	}
+
+	if _, err := v1.NewHash(digest); err != nil {
+		return "", fmt.Errorf("invalid digest %q: %w", digest, err)
+	}
+
+	return image + digestDelimiter + digest, nil
+}
+
+// UnpinDigest returns the image without its digest, e.g. `nginx:1.21` for
+// `nginx:1.21@sha256:...`.
+func UnpinDigest(image string) string {
+	if index := strings.LastIndex(image, digestDelimiter); index != -1 {
+		return image[:index]
+	}
+
+	return image
+}
@@ -3,145 +3,261 @@
 package registry
 
 import (
+	"errors"
 	"fmt"
-	"os"
-	"strings"
+	"net/http"
+	"time"
 
-	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+
+	"github.com/impochi/cloner/pkg/metrics"
 )
 
-type registryCredentials struct {
-	provider string
-	username string
-	password string
+// GetDestinationImage returns the name of the destination image, named after the source
+// image with the naming scheme set by WithNamingScheme. Images already in the destination
+// repository, images not selected by WithSourceFilter and images skipped by the rules of
+// WithSourceRules are returned unchanged. An Error of kind ErrorDisallowed is returned for the
+// images denied by the rules.
+func GetDestinationImage(srcImage string, opts ...Option) (string, error) {
+	decision, err := Decide(srcImage, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	if decision.Action == RuleActionDeny {
+		return "", decision.Err()
+	}
+
+	return decision.Destination, nil
 }
 
-func fetchCredentials() (*registryCredentials, error) {
-	registryUsername := os.Getenv("REGISTRY_USERNAME")
-	registryPassword := os.Getenv("REGISTRY_PASSWORD")
-	registryProvider := os.Getenv("REGISTRY_PROVIDER")
+// Backup pushes the docker image to the provided repository. Multi-architecture images are
+// backed up as a whole index, restricted to the platforms allowed by WithPlatforms.
+// The source image is pulled anonymously, unless credentials are set by WithSourceKeychain.
+// The credentials of the destination registry are only sent to the destination registry.
+// The errors of the registries are returned as Error, the requests being limited by
+// WithRateLimiter. Returns the descriptor of the destination image, whether it was pushed or
+// already backed up, so that it can be pinned by digest. The destination image is not copied to
+// the replicas, see Replicate.
+func Backup(srcImage, dstImage string, opts ...Option) (*v1.Descriptor, error) {
+	o := makeOptions(opts...)
+
+	start := time.Now()
+	limited := &rateLimitedTransport{inner: http.DefaultTransport, limiter: o.rateLimiter}
+	uploads := &countingTransport{inner: limited}
+
+	pushed, desc, err := backup(srcImage, dstImage, o, limited, uploads, true)
+	err = limited.classifyError(err)
+
+	registry := sourceRegistry(srcImage)
+
+	switch {
+	case err != nil:
+		metrics.CopyFailed(errorKind(err), registry)
+
+		return nil, err
+	case pushed:
+		metrics.ImageCopied(registry, uploads.count(), time.Since(start).Seconds())
+	default:
+		metrics.CacheHit(registry)
+	}
 
-	if len(registryUsername) == 0 || len(registryPassword) == 0 {
-		return nil, fmt.Errorf("registry username or password cannot be empty")
+	return desc, nil
+}
+
+// IsBackedUp reports whether the destination image is the backup of the source image, as it
+// would be pushed by Backup with the same options. Nothing is pushed.
+func IsBackedUp(srcImage, dstImage string, opts ...Option) (bool, error) {
+	o := makeOptions(opts...)
+	limited := &rateLimitedTransport{inner: http.DefaultTransport, limiter: o.rateLimiter}
+
+	outdated, _, err := backup(srcImage, dstImage, o, limited, limited, false)
+	if err != nil {
+		return false, limited.classifyError(err)
 	}
 
-	return &registryCredentials{
-		provider: registryProvider,
-		username: registryUsername,
-		password: registryPassword,
-	}, nil
+	return !outdated, nil
 }
 
-// GetDestinationImage returns the name of the destination image.
-func GetDestinationImage(srcImage string) (string, error) {
-	dstImage := ""
+// backup backs up the image, sending the requests to the source and destination registries
+// through the given transports. Returns whether the destination image was missing or outdated,
+// in which case it is pushed only when push is set, and the descriptor of the image backed up.
+func backup(srcImage, dstImage string, o *options, srcTransport, dstTransport http.RoundTripper,
+	push bool) (bool, *v1.Descriptor, error) {
+	src, err := parseImage(srcImage)
+	if err != nil {
+		return false, nil, err
+	}
+
+	dst, err := parseImage(dstImage)
+	if err != nil {
+		return false, nil, err
+	}
+
+	srcRef := src.sourceReference()
+	dstRef := dst.destinationReference()
 
-	creds, err := fetchCredentials()
+	creds, err := o.credentials()
 	if err != nil {
-		return dstImage, err
+		return false, nil, fmt.Errorf("failed to fetch credentials: %w", err)
 	}
 
-	repo, tag := getRepoAndTagFromImage(srcImage)
+	dstKeychain, err := destinationKeychain(o.destinationRepository(creds), creds)
+	if err != nil {
+		return false, nil, err
+	}
 
-	if len(creds.provider) != 0 {
-		dstImage += fmt.Sprintf("%s/", creds.provider)
+	dstOpts := []remote.Option{
+		remote.WithAuthFromKeychain(dstKeychain),
+		remote.WithTransport(dstTransport),
+		remote.WithContext(o.ctx),
 	}
 
-	dstImage += fmt.Sprintf("%s/%s", creds.username, repo)
+	desc, err := remote.Get(srcRef, remote.WithAuthFromKeychain(o.sourceKeychain), remote.WithTransport(srcTransport),
+		remote.WithContext(o.ctx))
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to fetch image: %w", err)
+	}
 
-	if len(tag) != 0 {
-		dstImage += fmt.Sprintf(":%s", tag)
+	if desc.MediaType.IsIndex() {
+		return backupIndex(desc, srcRef, dstRef, o, dstOpts, push)
 	}
 
-	return dstImage, nil
+	return backupImage(desc, srcRef, dstRef, o, dstOpts, push)
 }
 
-// Backup pushes the docker image to the provided repository.
-func Backup(srcImage, dstImage string) error {
-	srcRef, err := getReference(srcImage)
+func backupImage(desc *remote.Descriptor, srcRef, dstRef name.Reference, o *options,
+	dstOpts []remote.Option, push bool) (bool, *v1.Descriptor, error) {
+	img, err := desc.Image()
 	if err != nil {
-		return err
+		return false, nil, fmt.Errorf("failed to fetch image: %w", err)
 	}
 
-	creds, err := fetchCredentials()
+	imgDesc, err := partial.Descriptor(img)
 	if err != nil {
-		return fmt.Errorf("failed to fetch credentials: %v", err)
+		return false, nil, fmt.Errorf("failed to get digest of source image %q: %w", srcRef, err)
 	}
 
-	authConfig := authn.AuthConfig{
-		Username: creds.username,
-		Password: creds.password,
+	backedUp, err := isBackedUp(dstRef, imgDesc.Digest, dstOpts...)
+	if err != nil {
+		return false, nil, err
 	}
 
-	auth := authn.FromConfig(authConfig)
+	if backedUp || !push {
+		// The layers of the destination image are known to be in its repository.
+		if backedUp {
+			mounter := newMounter(o.blobs, dstRef.Context(), nil)
+			if _, err := mounter.image(img).Layers(); err == nil {
+				mounter.pushed()
+			}
+		}
 
-	img, err := remote.Image(srcRef, remote.WithAuth(auth))
-	if err != nil {
-		return fmt.Errorf("failed to fetch image: %v", err)
+		return !backedUp, imgDesc, nil
 	}
 
-	dstRef, err := getReference(dstImage)
+	transfer, err := o.transfers.startCopy(o.ctx)
 	if err != nil {
-		return err
+		return false, nil, err
 	}
+	defer transfer.done()
 
-	// Check if image:tag with latest digest already present. If yes then
-	// there is no need to push the image.
-	// If there is no error, it means atleast the image was present, may or not be
-	// same as the source image.
-	// If there is an error, it means either the image is not present in the backup repository
-	// or network issue or some other issue. Point being we can go ahead and push the image.
-	if dstimg, err := remote.Image(dstRef, remote.WithAuth(authn.Anonymous)); err == nil {
-		dstHash, err := dstimg.Digest()
-		if err != nil {
-			return fmt.Errorf("destination image %q already present , failed to get digest: %v", dstImage, err)
-		}
+	mounter := newMounter(o.blobs, dstRef.Context(), transfer)
 
-		srcHash, err := img.Digest()
-		if err != nil {
-			return fmt.Errorf("failed to get digest of source image %q: %v", srcImage, err)
-		}
+	if err = remote.Write(dstRef, mounter.image(img), dstOpts...); err != nil {
+		return false, nil, fmt.Errorf("failed to push image: %w", err)
+	}
+
+	mounter.pushed()
+
+	return true, imgDesc, nil
+}
+
+func backupIndex(desc *remote.Descriptor, srcRef, dstRef name.Reference, o *options,
+	dstOpts []remote.Option, push bool) (bool, *v1.Descriptor, error) {
+	index, err := desc.ImageIndex()
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to fetch image index: %w", err)
+	}
 
-		if srcHash == dstHash {
-			return nil
+	// Filtering the platforms changes the digest of the index, which is not possible for the
+	// images pinned by digest.
+	_, pinned := srcRef.(name.Digest)
+
+	if platforms := o.platforms.platformsFor(srcRef.Context()); len(platforms) != 0 && !pinned {
+		if index, err = filterIndex(index, platforms); err != nil {
+			return false, nil, fmt.Errorf("failed to filter platforms of image index %q: %w", srcRef, err)
 		}
 	}
 
-	if err = remote.Write(dstRef, img, remote.WithAuth(auth)); err != nil {
-		return fmt.Errorf("failed to push image: %v", err)
+	indexDesc, err := partial.Descriptor(index)
+	if err != nil {
+		return false, nil, fmt.Errorf("failed to get digest of source image index %q: %w", srcRef, err)
 	}
 
-	return nil
-}
+	backedUp, err := isBackedUp(dstRef, indexDesc.Digest, dstOpts...)
+	if err != nil {
+		return false, nil, err
+	}
 
-func getRepoAndTagFromImage(image string) (repository, tag string) {
-	if len(image) == 0 {
-		return repository, tag
+	if backedUp || !push {
+		return !backedUp, indexDesc, nil
 	}
 
-	str := strings.Split(image, ":")
+	transfer, err := o.transfers.startCopy(o.ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	defer transfer.done()
 
-	imageWithoutTag := str[0]
+	mounter := newMounter(o.blobs, dstRef.Context(), transfer)
 
-	if len(str) == 1 {
-		tag = ""
-	} else {
-		tag = str[len(str)-1]
+	if err = remote.WriteIndex(dstRef, mounter.index(index), dstOpts...); err != nil {
+		return false, nil, fmt.Errorf("failed to push image index: %w", err)
 	}
 
-	str = strings.Split(imageWithoutTag, "/")
-	repository = str[len(str)-1]
+	mounter.pushed()
 
-	return repository, tag
+	return true, indexDesc, nil
 }
 
-func getReference(image string) (name.Reference, error) {
-	ref, err := name.ParseReference(image)
+// isBackedUp checks if image:tag with latest digest already present. If yes then
+// there is no need to push the image.
+// Only the digest is needed, so the manifest is not downloaded. Only a destination image
+// that is not found leads to a push, any other error such as an authentication or network
+// error is returned.
+func isBackedUp(dstRef name.Reference, srcHash v1.Hash, dstOpts ...remote.Option) (bool, error) {
+	dstDesc, err := remote.Head(dstRef, dstOpts...)
+	if isNotFound(err) {
+		return false, nil
+	}
+
 	if err != nil {
-		return nil, fmt.Errorf("failed parsing image reference: %v", err)
+		return false, fmt.Errorf("failed to check destination image %q: %w", dstRef, err)
+	}
+
+	return dstDesc.Digest == srcHash, nil
+}
+
+// isNotFound reports whether the error is returned by the registry for a missing image.
+func isNotFound(err error) bool {
+	var terr *transport.Error
+	if !errors.As(err, &terr) {
+		return false
+	}
+
+	if terr.StatusCode == http.StatusNotFound {
+		return true
+	}
+
+	for _, diagnostic := range terr.Errors {
+		if diagnostic.Code == transport.ManifestUnknownErrorCode || diagnostic.Code == transport.NameUnknownErrorCode {
+			return true
+		}
 	}
 
-	return ref, nil
+	return false
 }
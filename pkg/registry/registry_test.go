@@ -4,13 +4,15 @@ package registry
 import (
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
 const (
-	username = "foo"
-	password = "bar"
-	provider = "test"
+	username   = "foo"
+	password   = "bar"
+	provider   = "test"
+	testDigest = "sha256:0b159cd1ee1203dad901967ac55eee18c24da84ba3be384690304be93538bea8"
 )
 
 func TestFetchCredentials(t *testing.T) {
@@ -145,43 +147,262 @@ func TestGetDestinationImage(t *testing.T) { //nolint:funlen
 	}
 }
 
-func TestGetRepoAndTagFromImage(t *testing.T) {
+func TestGetDestinationImageNamingScheme(t *testing.T) { //nolint:funlen
 	cases := []struct {
-		input string
-		repo  string
-		tag   string
+		scheme NamingScheme
+		input  string
+		output string
 	}{
 		{
-			input: "ubuntu",
-			repo:  "ubuntu",
-			tag:   "",
+			scheme: NamingSchemePath,
+			input:  "nginx:1.2",
+			output: fmt.Sprintf("%s/%s/docker.io/library/nginx:1.2", provider, username),
 		},
 		{
-			input: "quay.io/busybox",
-			repo:  "busybox",
-			tag:   "",
+			scheme: NamingSchemePath,
+			input:  "bitnami/nginx:1.2",
+			output: fmt.Sprintf("%s/%s/docker.io/bitnami/nginx:1.2", provider, username),
 		},
 		{
-			input: "ubuntu:1.0",
-			repo:  "ubuntu",
-			tag:   "1.0",
+			scheme: NamingSchemePath,
+			input:  "quay.io/bitnami/nginx",
+			output: fmt.Sprintf("%s/%s/quay.io/bitnami/nginx", provider, username),
 		},
 		{
-			input: "quay.io/testrepo:v2.0",
-			repo:  "testrepo",
-			tag:   "v2.0",
+			scheme: NamingSchemeFlat,
+			input:  "quay.io/bitnami/nginx",
+			output: fmt.Sprintf("%s/%s/nginx", provider, username),
+		},
+		{
+			scheme: NamingSchemeFlat,
+			input:  "nginx@" + testDigest,
+			output: fmt.Sprintf("%s/%s/nginx@%s", provider, username, testDigest),
+		},
+		{
+			scheme: NamingSchemePath,
+			input:  "nginx:1.21@" + testDigest,
+			output: fmt.Sprintf("%s/%s/docker.io/library/nginx:1.21@%s", provider, username, testDigest),
+		},
+		{
+			scheme: NamingSchemeFlat,
+			input:  "myregistry:5000/team/app",
+			output: fmt.Sprintf("%s/%s/app", provider, username),
+		},
+		{
+			scheme: NamingSchemePath,
+			input:  "myregistry:5000/team/app:v1",
+			output: fmt.Sprintf("%s/%s/myregistry_5000/team/app:v1", provider, username),
+		},
+		{
+			// Already backed up with the path naming scheme.
+			scheme: NamingSchemePath,
+			input:  fmt.Sprintf("%s/%s/quay.io/bitnami/nginx:1.2", provider, username),
+			output: fmt.Sprintf("%s/%s/quay.io/bitnami/nginx:1.2", provider, username),
+		},
+		{
+			// Already backed up with the flat naming scheme.
+			scheme: NamingSchemePath,
+			input:  fmt.Sprintf("%s/%s/nginx:1.2", provider, username),
+			output: fmt.Sprintf("%s/%s/nginx:1.2", provider, username),
+		},
+		{
+			scheme: NamingSchemeFlat,
+			input:  fmt.Sprintf("%s/%s/docker.io/library/nginx:1.2", provider, username),
+			output: fmt.Sprintf("%s/%s/docker.io/library/nginx:1.2", provider, username),
 		},
 	}
 
+	if err := os.Setenv("REGISTRY_PROVIDER", provider); err != nil {
+		t.Fatalf("Failed to set env variable `REGISTRY_PROVIDER`: %q", err)
+	}
+
+	if err := os.Setenv("REGISTRY_USERNAME", username); err != nil {
+		t.Fatalf("Failed to set env variable `REGISTRY_USERNAME`: %q", err)
+	}
+
+	if err := os.Setenv("REGISTRY_PASSWORD", password); err != nil {
+		t.Fatalf("Failed to set env variable `REGISTRY_PASSWORD`: %q", err)
+	}
+
 	for _, testcase := range cases {
-		imagerepo, imagetag := getRepoAndTagFromImage(testcase.input)
+		dst, err := GetDestinationImage(testcase.input, WithNamingScheme(testcase.scheme))
+		if err != nil {
+			t.Errorf("Failed to get destination image: %v", err)
+		}
 
-		if testcase.repo != imagerepo {
-			t.Errorf("Expected repository name as %q, got %q", testcase.repo, imagerepo)
+		if testcase.output != dst {
+			t.Errorf("Expected destination image as %q, got %q", testcase.output, dst)
 		}
+	}
+}
+
+func TestParseImage(t *testing.T) { //nolint:funlen
+	cases := []struct {
+		input      string
+		repository string
+		tag        string
+		digest     string
+		expectErr  bool
+	}{
+		{
+			input:      "ubuntu",
+			repository: "index.docker.io/library/ubuntu",
+		},
+		{
+			input:      "quay.io/busybox",
+			repository: "quay.io/busybox",
+		},
+		{
+			input:      "ubuntu:1.0",
+			repository: "index.docker.io/library/ubuntu",
+			tag:        "1.0",
+		},
+		{
+			input:      "quay.io/testrepo:v2.0",
+			repository: "quay.io/testrepo",
+			tag:        "v2.0",
+		},
+		{
+			input:      "myregistry:5000/app",
+			repository: "myregistry:5000/app",
+		},
+		{
+			input:      "myregistry:5000/team/app:v1",
+			repository: "myregistry:5000/team/app",
+			tag:        "v1",
+		},
+		{
+			input:      "nginx@" + testDigest,
+			repository: "index.docker.io/library/nginx",
+			digest:     testDigest,
+		},
+		{
+			input:      "myregistry:5000/nginx:1.21@" + testDigest,
+			repository: "myregistry:5000/nginx",
+			tag:        "1.21",
+			digest:     testDigest,
+		},
+		{
+			input:     "nginx@sha256:abc",
+			expectErr: true,
+		},
+		{
+			input:     "Nginx",
+			expectErr: true,
+		},
+	}
 
-		if testcase.tag != imagetag {
-			t.Errorf("Expected repository name as %q, got %q", testcase.tag, imagetag)
+	for _, testcase := range cases {
+		ref, err := parseImage(testcase.input)
+		if testcase.expectErr {
+			if err == nil {
+				t.Errorf("%q: expected error", testcase.input)
+			}
+
+			continue
 		}
+
+		if err != nil {
+			t.Errorf("%q: failed parsing image: %v", testcase.input, err)
+
+			continue
+		}
+
+		if testcase.repository != ref.repository.Name() {
+			t.Errorf("Expected repository name as %q, got %q", testcase.repository, ref.repository.Name())
+		}
+
+		if testcase.tag != ref.tag {
+			t.Errorf("Expected tag as %q, got %q", testcase.tag, ref.tag)
+		}
+
+		if testcase.digest != ref.digest {
+			t.Errorf("Expected digest as %q, got %q", testcase.digest, ref.digest)
+		}
+	}
+}
+
+func TestImageReferences(t *testing.T) {
+	cases := []struct {
+		input       string
+		source      string
+		destination string
+	}{
+		{
+			input:       "nginx",
+			source:      "index.docker.io/library/nginx:latest",
+			destination: "index.docker.io/library/nginx:latest",
+		},
+		{
+			input:       "nginx:1.21",
+			source:      "index.docker.io/library/nginx:1.21",
+			destination: "index.docker.io/library/nginx:1.21",
+		},
+		{
+			input:       "nginx@" + testDigest,
+			source:      "index.docker.io/library/nginx@" + testDigest,
+			destination: "index.docker.io/library/nginx@" + testDigest,
+		},
+		{
+			input:       "nginx:1.21@" + testDigest,
+			source:      "index.docker.io/library/nginx@" + testDigest,
+			destination: "index.docker.io/library/nginx:1.21",
+		},
+	}
+
+	for _, testcase := range cases {
+		ref, err := parseImage(testcase.input)
+		if err != nil {
+			t.Fatalf("%q: failed parsing image: %v", testcase.input, err)
+		}
+
+		if source := ref.sourceReference().Name(); testcase.source != source {
+			t.Errorf("Expected source reference as %q, got %q", testcase.source, source)
+		}
+
+		if destination := ref.destinationReference().Name(); testcase.destination != destination {
+			t.Errorf("Expected destination reference as %q, got %q", testcase.destination, destination)
+		}
+	}
+}
+
+func TestPinDigest(t *testing.T) {
+	otherDigest := "sha256:" + strings.Repeat("0", 64) //nolint:gomnd
+
+	cases := []struct {
+		input    string
+		expected string
+	}{
+		{
+			input:    "registry.example.com/backup/nginx:1.21",
+			expected: "registry.example.com/backup/nginx:1.21@" + testDigest,
+		},
+		{
+			input:    "registry.example.com/backup/nginx",
+			expected: "registry.example.com/backup/nginx@" + testDigest,
+		},
+		{
+			input:    "registry.example.com/backup/nginx:1.21@" + otherDigest,
+			expected: "registry.example.com/backup/nginx:1.21@" + otherDigest,
+		},
+	}
+
+	for _, testcase := range cases {
+		pinned, err := PinDigest(testcase.input, testDigest)
+		if err != nil {
+			t.Fatalf("%q: failed pinning image: %v", testcase.input, err)
+		}
+
+		if pinned != testcase.expected {
+			t.Errorf("Expected pinned image as %q, got %q", testcase.expected, pinned)
+		}
+
+		if unpinned := UnpinDigest(pinned); unpinned != UnpinDigest(testcase.input) {
+			t.Errorf("Expected unpinned image as %q, got %q", UnpinDigest(testcase.input), unpinned)
+		}
+	}
+
+	if _, err := PinDigest("registry.example.com/backup/nginx:1.21", "latest"); err == nil {
+		t.Errorf("Expected an error for an invalid digest")
 	}
 }
@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrNotInDestination is returned for the images which can't be copied to the replicas, not
+// being in the destination repository.
+var ErrNotInDestination = errors.New("image not in the destination repository")
+
+// maxReplicaImages is the number of replica images remembered as up to date, the oldest ones
+// being forgotten first.
+const maxReplicaImages = 10000
+
+// ReplicaResult is the result of the copy of a destination image to a replica registry.
+type ReplicaResult struct {
+	// Image is the copy of the destination image in the replica registry, empty when it
+	// couldn't be named.
+	Image string
+	// Digest is the digest of the destination image, and of its copy once copied.
+	Digest string
+	// Outdated is set when the copy was missing or outdated, and copied unless only checked.
+	Outdated bool
+	// Err is the error of the copy, returned as Error for the errors of the registries.
+	Err error
+}
+
+// WithReplicas sets the credentials of the replica registries, the destination images being
+// copied into the `<provider>/<username>` repository of each of them by Replicate. The
+// credentials are loaded when the images are copied, so that they can be reloaded.
+func WithReplicas(replicas ...*CredentialsStore) Option {
+	return func(o *options) {
+		o.replicas = replicas
+	}
+}
+
+// Replicate copies the destination image to the replica registries set by WithReplicas,
+// skipping the replicas already up to date. The destination image is read with the
+// credentials of the destination registry. The replicas already confirmed to hold the digest
+// of the destination image, when known, are not checked again.
+func Replicate(dstImage, digest string, opts ...Option) []ReplicaResult {
+	return replicate(dstImage, digest, makeOptions(opts...), true)
+}
+
+// CheckReplicas reports which replicas of the destination image are outdated, as Replicate
+// would copy them. Nothing is copied.
+func CheckReplicas(dstImage string, opts ...Option) []ReplicaResult {
+	return replicate(dstImage, "", makeOptions(opts...), false)
+}
+
+// replicate copies the destination image to all the replicas at the same time, only when push
+// is set. The replicas confirmed to hold the digest of the destination image, when known, are
+// not sent any request. The results are in the order of the replicas.
+func replicate(dstImage, digest string, o *options, push bool) []ReplicaResult {
+	results := make([]ReplicaResult, len(o.replicas))
+	if len(o.replicas) == 0 {
+		return results
+	}
+
+	creds, err := o.credentials()
+	if err != nil {
+		err = fmt.Errorf("failed to fetch credentials: %w", err)
+	}
+
+	var keychain Keychain
+
+	if err == nil {
+		keychain, err = destinationKeychain(o.destinationRepository(creds), creds)
+	}
+
+	if err != nil {
+		for i := range results {
+			results[i].Err = err
+		}
+
+		return results
+	}
+
+	var wg sync.WaitGroup
+
+	for i, replica := range o.replicas {
+		wg.Add(1)
+
+		go func(result *ReplicaResult, replica *Credentials) {
+			defer wg.Done()
+
+			*result = replicateTo(dstImage, digest, o.destinationRepository(creds), keychain, replica, o, push)
+		}(&results[i], replica.Load())
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// replicateTo copies the destination image of the destination repository to a replica, only
+// when push is set.
+func replicateTo(dstImage, digest, dstRepository string, keychain Keychain, replica *Credentials, o *options,
+	push bool) ReplicaResult {
+	if replica == nil {
+		return ReplicaResult{Err: fmt.Errorf("credentials of replica not loaded")}
+	}
+
+	image, err := replicaImage(dstImage, dstRepository, replica.destination())
+	if err != nil {
+		return ReplicaResult{Err: err}
+	}
+
+	if push && len(digest) != 0 && o.confirmed.has(image, digest) {
+		return ReplicaResult{Image: image, Digest: digest}
+	}
+
+	// The destination image is copied as is, e.g. without filtering its platforms again,
+	// so that the copies keep its digest.
+	replicaOpts := &options{
+		sourceKeychain: keychain,
+		creds:          replica,
+		rateLimiter:    o.rateLimiter,
+		blobs:          o.blobs,
+		transfers:      o.transfers,
+		ctx:            o.ctx,
+	}
+
+	limited := &rateLimitedTransport{inner: http.DefaultTransport, limiter: o.rateLimiter}
+
+	outdated, desc, err := backup(dstImage, image, replicaOpts, limited, limited, push)
+	if err != nil {
+		return ReplicaResult{Image: image, Err: limited.classifyError(err)}
+	}
+
+	if push {
+		o.confirmed.add(image, desc.Digest.String())
+	}
+
+	return ReplicaResult{Image: image, Outdated: outdated, Digest: desc.Digest.String()}
+}
+
+// replicaCache remembers the digests copied to the replicas or found up to date, so that the
+// images backed up again are not checked on every replica.
+type replicaCache struct {
+	mu sync.Mutex
+	// digests is the digest of each replica image.
+	digests map[string]string
+	// order is the order the images were added in, to forget the oldest ones.
+	order []string
+}
+
+// defaultReplicaCache is shared by all the calls.
+var defaultReplicaCache = newReplicaCache()
+
+func newReplicaCache() *replicaCache {
+	return &replicaCache{digests: map[string]string{}}
+}
+
+// add records that the replica image holds the digest.
+func (c *replicaCache) add(image, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.digests[image]; !ok {
+		c.order = append(c.order, image)
+	}
+
+	c.digests[image] = digest
+
+	for len(c.order) > maxReplicaImages {
+		delete(c.digests, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+// has reports whether the replica image is known to hold the digest.
+func (c *replicaCache) has(image, digest string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.digests[image] == digest
+}
+
+// replicaImage returns the copy of the destination image in the replica repository, e.g.
+// `eu.quay.io/foo/nginx:1.21` for `quay.io/foo/nginx:1.21`.
+func replicaImage(dstImage, destination, replica string) (string, error) {
+	if !strings.HasPrefix(dstImage, destination+"/") {
+		return "", fmt.Errorf("%w %q: %q", ErrNotInDestination, destination, dstImage)
+	}
+
+	return replica + strings.TrimPrefix(dstImage, destination), nil
+}
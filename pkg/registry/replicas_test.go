@@ -0,0 +1,125 @@
+//nolint:testpackage
+package registry
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestReplicaImage(t *testing.T) {
+	cases := []struct {
+		dstImage string
+		wanted   string
+		isError  bool
+	}{
+		{
+			dstImage: "quay.io/foo/nginx:1.21",
+			wanted:   "eu.quay.io/bar/nginx:1.21",
+		},
+		{
+			dstImage: "quay.io/foo/docker.io/library/nginx@" + testDigest,
+			wanted:   "eu.quay.io/bar/docker.io/library/nginx@" + testDigest,
+		},
+		{
+			// Prefix of the destination repository, but not in it.
+			dstImage: "quay.io/foobar/nginx:1.21",
+			isError:  true,
+		},
+	}
+
+	for _, testcase := range cases {
+		image, err := replicaImage(testcase.dstImage, "quay.io/foo", "eu.quay.io/bar")
+		if testcase.isError {
+			if err == nil {
+				t.Errorf("%q: expected an error", testcase.dstImage)
+			}
+
+			continue
+		}
+
+		if err != nil || image != testcase.wanted {
+			t.Errorf("%q: expected %q, got %q (%v)", testcase.dstImage, testcase.wanted, image, err)
+		}
+	}
+}
+
+func TestReplicateUnloadedCredentials(t *testing.T) {
+	loaded := &CredentialsStore{}
+	loaded.Store(&Credentials{Provider: "eu." + provider, Username: "bar", Password: password})
+
+	results := CheckReplicas(provider+"/"+username+"/nginx:1.21",
+		WithCredentials(&Credentials{Provider: provider, Username: username, Password: password}),
+		WithReplicas(&CredentialsStore{}, loaded))
+
+	if len(results) != 2 { //nolint:gomnd
+		t.Fatalf("expected a result per replica, got %v", results)
+	}
+
+	if results[0].Err == nil || len(results[0].Image) != 0 {
+		t.Errorf("expected an error for the replica without credentials, got %+v", results[0])
+	}
+}
+
+func TestReplicateSkipsConfirmedReplicas(t *testing.T) {
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testIndex)))
+
+	var replicaRequests int32
+
+	// The source, destination and replica images are all up to date.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			w.WriteHeader(http.StatusOK)
+
+			return
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/v2/bar/") {
+			atomic.AddInt32(&replicaRequests, 1)
+		}
+
+		w.Header().Set("Content-Type", string(types.DockerManifestList))
+		w.Header().Set("Content-Length", fmt.Sprint(len(testIndex)))
+		w.Header().Set("Docker-Content-Digest", digest)
+
+		if r.Method == http.MethodGet {
+			_, _ = w.Write([]byte(testIndex))
+		}
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	replica := &CredentialsStore{}
+	replica.Store(&Credentials{Provider: host, Username: "bar", Password: password})
+
+	for i, wanted := range []int32{1, 0} {
+		before := atomic.LoadInt32(&replicaRequests)
+
+		opts := []Option{
+			WithCredentials(&Credentials{Provider: host, Username: username, Password: password}),
+			WithReplicas(replica),
+		}
+
+		desc, err := Backup(host+"/library/nginx:1.21", host+"/foo/nginx:1.21", opts...)
+		if err != nil {
+			t.Fatalf("backup %d: unexpected error: %v", i, err)
+		}
+
+		results := Replicate(host+"/foo/nginx:1.21", desc.Digest.String(), opts...)
+
+		if len(results) != 1 || results[0].Err != nil || results[0].Outdated || results[0].Digest != digest ||
+			results[0].Image != host+"/bar/nginx:1.21" {
+			t.Errorf("backup %d: expected the replica to be up to date, got %+v", i, results)
+		}
+
+		if sent := atomic.LoadInt32(&replicaRequests) - before; sent != wanted {
+			t.Errorf("backup %d: expected %d requests to the replica, got %d", i, wanted, sent)
+		}
+	}
+}
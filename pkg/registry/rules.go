@@ -0,0 +1,210 @@
+package registry
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// RuleAction is what is done with the source images matched by a SourceRule.
+type RuleAction string
+
+const (
+	// RuleActionMirror backs up the images and rewrites the workloads to the destination
+	// images.
+	RuleActionMirror RuleAction = "mirror"
+	// RuleActionSkip leaves the images alone, e.g. the images already in a trusted registry.
+	RuleActionSkip RuleAction = "skip"
+	// RuleActionDeny flags the images as disallowed, they are neither backed up nor rewritten.
+	RuleActionDeny RuleAction = "deny"
+)
+
+// SourceRule decides what is done with the source images whose repository matches its
+// pattern, e.g. `docker.io/library/nginx`. A glob pattern matches the repository or any of its
+// parents, so `quay.io` matches all the images of quay.io, and supports the wildcards of
+// path.Match. A pattern enclosed in slashes, e.g. `/.*\.example\.com/.*/`, is a regular
+// expression matching the whole repository.
+type SourceRule struct {
+	Action  RuleAction
+	Pattern string
+
+	regexp *regexp.Regexp
+}
+
+// NewSourceRule returns the rule of the action and pattern, checking the pattern is valid.
+func NewSourceRule(action RuleAction, pattern string) (SourceRule, error) {
+	rule := SourceRule{Action: action, Pattern: pattern}
+
+	switch action {
+	case RuleActionMirror, RuleActionSkip, RuleActionDeny:
+	default:
+		return rule, fmt.Errorf("invalid action %q of source rule %q, must be one of %q, %q or %q",
+			action, pattern, RuleActionMirror, RuleActionSkip, RuleActionDeny)
+	}
+
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(fmt.Sprintf("^(?:%s)$", pattern[1:len(pattern)-1]))
+		if err != nil {
+			return rule, fmt.Errorf("invalid regular expression of source rule %q: %w", pattern, err)
+		}
+
+		rule.regexp = re
+
+		return rule, nil
+	}
+
+	if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+		return rule, fmt.Errorf("invalid pattern of source rule %q: %v", pattern, err)
+	}
+
+	return rule, nil
+}
+
+func (r SourceRule) String() string {
+	return fmt.Sprintf("%s=%s", r.Action, r.Pattern)
+}
+
+func (r SourceRule) matches(source string) bool {
+	if r.regexp != nil {
+		return r.regexp.MatchString(source)
+	}
+
+	return matchAny([]string{r.Pattern}, source)
+}
+
+// SourceRules are ordered rules, the first rule matching a source image decides what is done
+// with it. The images matched by no rule are mirrored.
+type SourceRules []SourceRule
+
+// ParseSourceRules parses the rules provided by the user, formatted as
+// `<action>=<pattern>;...`, e.g. `skip=registry.example.com;deny=/docker\.io/untrusted/.*/`.
+func ParseSourceRules(rules string) (SourceRules, error) {
+	parsed := SourceRules{}
+
+	for _, entry := range strings.Split(rules, ";") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		// The regular expressions may contain `=`.
+		parts := strings.SplitN(entry, "=", filterEntryFields)
+		if len(parts) != filterEntryFields {
+			return nil, fmt.Errorf("invalid source rule %q, expected <action>=<pattern>", entry)
+		}
+
+		rule, err := NewSourceRule(RuleAction(strings.TrimSpace(parts[0])), strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, rule)
+	}
+
+	return parsed, nil
+}
+
+// decide returns the decision of the first rule matching the repository.
+func (r SourceRules) decide(repo name.Repository) Decision {
+	source := sourceName(repo)
+
+	for index, rule := range r {
+		if rule.matches(source) {
+			return Decision{
+				Action: rule.Action,
+				Reason: fmt.Sprintf("%s matches source rule %d %q", source, index+1, rule),
+			}
+		}
+	}
+
+	return Decision{Action: RuleActionMirror, Reason: fmt.Sprintf("%s matches no source rule", source)}
+}
+
+// Decision is what is done with a source image, and why.
+type Decision struct {
+	Action RuleAction
+	Reason string
+	// Destination is the destination image of the mirrored images, and the source image of
+	// the others.
+	Destination string
+	// Trusted is set for the skipped images which don't need to be mirrored, being in the
+	// destination repository or skipped by a source rule. It is not set for the images only
+	// skipped by the source filter.
+	Trusted bool
+}
+
+// Err returns the error of a denied image, nil for the other decisions.
+func (d *Decision) Err() error {
+	if d.Action != RuleActionDeny {
+		return nil
+	}
+
+	return &Error{
+		Kind: ErrorDisallowed,
+		Err:  fmt.Errorf("image %s is not allowed: %s", d.Destination, d.Reason),
+	}
+}
+
+// Decide returns what is done with the source image. The images already in the destination
+// repository and the images not selected by WithSourceFilter are skipped, the others are
+// decided by the rules set by WithSourceRules.
+func Decide(srcImage string, opts ...Option) (*Decision, error) {
+	o := makeOptions(opts...)
+
+	creds, err := o.credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	dstImage := o.destinationRepository(creds)
+
+	srcRef, err := parseImage(srcImage)
+	if err != nil {
+		return nil, err
+	}
+
+	backedUp, err := isDestinationRepository(srcRef.repository, dstImage)
+	if err != nil {
+		return nil, err
+	}
+
+	if backedUp {
+		return &Decision{
+			Action:      RuleActionSkip,
+			Reason:      "already in the destination repository",
+			Destination: srcImage,
+			Trusted:     true,
+		}, nil
+	}
+
+	decision := o.rules.decide(srcRef.repository)
+	decision.Destination = srcImage
+	decision.Trusted = decision.Action == RuleActionSkip
+
+	if decision.Action != RuleActionMirror {
+		return &decision, nil
+	}
+
+	if !o.sources.matches(srcRef.repository) {
+		return &Decision{
+			Action:      RuleActionSkip,
+			Reason:      "not selected by the source filter",
+			Destination: srcImage,
+		}, nil
+	}
+
+	repo := path.Base(srcRef.repository.RepositoryStr())
+
+	if o.namingScheme == NamingSchemePath {
+		repo = repositoryPath(srcRef.repository)
+	}
+
+	// The destination keeps the tag and digest of the source image, the digest of the image
+	// doesn't change when being backed up.
+	decision.Destination = fmt.Sprintf("%s/%s%s", dstImage, repo, srcRef.suffix())
+
+	return &decision, nil
+}
@@ -0,0 +1,109 @@
+//nolint:testpackage
+package registry
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseSourceRules(t *testing.T) {
+	rules, err := ParseSourceRules(`skip=registry.example.com; deny=/docker\.io/[a-z]+-untrusted/.*/;mirror=*`)
+	if err != nil {
+		t.Fatalf("failed parsing rules: %v", err)
+	}
+
+	if len(rules) != 3 || rules[1].Action != RuleActionDeny || rules[1].regexp == nil {
+		t.Errorf("unexpected rules %v", rules)
+	}
+
+	for _, invalid := range []string{"registry.example.com", "allow=quay.io", "deny=quay.io/[", "deny=/(/", "skip="} {
+		if _, err := ParseSourceRules(invalid); err == nil {
+			t.Errorf("%q: expected an error", invalid)
+		}
+	}
+}
+
+func TestDecide(t *testing.T) { //nolint:funlen
+	rules, err := ParseSourceRules(
+		`skip=registry.example.com;deny=/docker\.io/[a-z]+-untrusted/.*/;skip=quay.io/team;mirror=quay.io`)
+	if err != nil {
+		t.Fatalf("failed parsing rules: %v", err)
+	}
+
+	creds := &Credentials{Provider: provider, Username: username, Password: password}
+	opts := []Option{
+		WithCredentials(creds),
+		WithDestination("quay.io/team"),
+		WithSourceRules(rules),
+		WithSourceFilter(SourceFilter{Exclude: []string{"gcr.io"}}),
+	}
+
+	cases := []struct {
+		image       string
+		action      RuleAction
+		destination string
+		trusted     bool
+	}{
+		{
+			image:       "registry.example.com/platform/app:1.0",
+			action:      RuleActionSkip,
+			destination: "registry.example.com/platform/app:1.0",
+			trusted:     true,
+		},
+		{
+			image:       "evil-untrusted/miner:latest",
+			action:      RuleActionDeny,
+			destination: "evil-untrusted/miner:latest",
+		},
+		{
+			// In the destination repository, before any rule.
+			image:       "quay.io/team/nginx:1.2",
+			action:      RuleActionSkip,
+			destination: "quay.io/team/nginx:1.2",
+			trusted:     true,
+		},
+		{
+			image:       "quay.io/prometheus/node-exporter:v1.1.2",
+			action:      RuleActionMirror,
+			destination: "quay.io/team/node-exporter:v1.1.2",
+		},
+		{
+			// Matched by no rule.
+			image:       "nginx:1.2",
+			action:      RuleActionMirror,
+			destination: "quay.io/team/nginx:1.2",
+		},
+		{
+			// Not selected by the source filter.
+			image:       "gcr.io/distroless/static",
+			action:      RuleActionSkip,
+			destination: "gcr.io/distroless/static",
+		},
+	}
+
+	for _, testcase := range cases {
+		decision, err := Decide(testcase.image, opts...)
+		if err != nil {
+			t.Fatalf("%q: failed to decide: %v", testcase.image, err)
+		}
+
+		if decision.Action != testcase.action || decision.Destination != testcase.destination ||
+			decision.Trusted != testcase.trusted {
+			t.Errorf("%q: expected %s to %q, got %s to %q (%s)", testcase.image, testcase.action,
+				testcase.destination, decision.Action, decision.Destination, decision.Reason)
+		}
+
+		dst, err := GetDestinationImage(testcase.image, opts...)
+
+		var registryErr *Error
+
+		switch {
+		case testcase.action == RuleActionDeny:
+			if !errors.As(err, &registryErr) || registryErr.Kind != ErrorDisallowed || !registryErr.Permanent() {
+				t.Errorf("%q: expected a permanent disallowed error, got %v", testcase.image, err)
+			}
+		case err != nil || dst != testcase.destination:
+			t.Errorf("%q: expected destination image %q, got %q (%v)", testcase.image, testcase.destination, dst, err)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// SourceFilter restricts the source images being backed up with patterns matched against the
+// source repository, e.g. `docker.io/library/nginx`. A pattern matches the repository or any
+// of its parents, so `quay.io` matches all the images of quay.io. The patterns support the
+// wildcards of path.Match.
+type SourceFilter struct {
+	// Include are the patterns of the images being backed up, all the images when empty.
+	Include []string
+	// Exclude are the patterns of the images which are not backed up, taking precedence over
+	// Include.
+	Exclude []string
+}
+
+// Validate checks that the patterns are valid.
+func (f SourceFilter) Validate() error {
+	for _, pattern := range append(append([]string{}, f.Include...), f.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid source pattern %q: %v", pattern, err)
+		}
+	}
+
+	return nil
+}
+
+// matches reports whether the images of the repository are backed up.
+func (f SourceFilter) matches(repo name.Repository) bool {
+	source := sourceName(repo)
+
+	if len(f.Include) != 0 && !matchAny(f.Include, source) {
+		return false
+	}
+
+	return !matchAny(f.Exclude, source)
+}
+
+func matchAny(patterns []string, source string) bool {
+	segments := strings.Split(source, "/")
+
+	for _, pattern := range patterns {
+		for i := range segments {
+			// Invalid patterns never match, they are rejected by Validate.
+			if ok, _ := path.Match(pattern, strings.Join(segments[:i+1], "/")); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// sourceName returns the name of the repository as matched by the source patterns, with
+// Docker Hub as `docker.io`.
+func sourceName(repo name.Repository) string {
+	registry := repo.RegistryStr()
+	if registry == name.DefaultRegistry {
+		registry = dockerHubRegistry
+	}
+
+	return path.Join(registry, repo.RepositoryStr())
+}
@@ -0,0 +1,99 @@
+//nolint:testpackage
+package registry
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSourceFilter(t *testing.T) {
+	filter := SourceFilter{
+		Include: []string{"docker.io/library", "quay.io", "gcr.io/*-team"},
+		Exclude: []string{"quay.io/internal"},
+	}
+
+	if err := filter.Validate(); err != nil {
+		t.Fatalf("unexpected invalid filter: %v", err)
+	}
+
+	cases := []struct {
+		image   string
+		matches bool
+	}{
+		{image: "nginx:1.2", matches: true},
+		{image: "index.docker.io/library/nginx", matches: true},
+		{image: "bitnami/nginx", matches: false},
+		{image: "quay.io/prometheus/node-exporter", matches: true},
+		{image: "quay.io/internal/app", matches: false},
+		{image: "gcr.io/web-team/app/frontend", matches: true},
+		{image: "gcr.io/distroless/static", matches: false},
+	}
+
+	for _, testcase := range cases {
+		ref, err := parseImage(testcase.image)
+		if err != nil {
+			t.Fatalf("failed parsing image: %v", err)
+		}
+
+		if matches := filter.matches(ref.repository); matches != testcase.matches {
+			t.Errorf("%q: expected match to be %t, got %t", testcase.image, testcase.matches, matches)
+		}
+	}
+
+	if err := (SourceFilter{Exclude: []string{"quay.io/["}}).Validate(); err == nil {
+		t.Errorf("expected error for invalid pattern")
+	}
+}
+
+func TestGetDestinationImageOverride(t *testing.T) {
+	creds := &Credentials{Provider: provider, Username: username, Password: password}
+	opts := []Option{
+		WithCredentials(creds),
+		WithDestination("quay.io/team"),
+		WithSourceFilter(SourceFilter{Exclude: []string{"gcr.io"}}),
+	}
+
+	cases := []struct {
+		input  string
+		output string
+	}{
+		{
+			input:  "nginx:1.2",
+			output: "quay.io/team/nginx:1.2",
+		},
+		{
+			// Not selected by the source filter.
+			input:  "gcr.io/distroless/static",
+			output: "gcr.io/distroless/static",
+		},
+		{
+			input:  "quay.io/team/nginx:1.2",
+			output: "quay.io/team/nginx:1.2",
+		},
+		{
+			// The default destination is not the destination anymore.
+			input:  fmt.Sprintf("%s/%s/nginx:1.2", provider, username),
+			output: "quay.io/team/nginx:1.2",
+		},
+	}
+
+	for _, testcase := range cases {
+		dst, err := GetDestinationImage(testcase.input, opts...)
+		if err != nil {
+			t.Fatalf("failed to get destination image: %v", err)
+		}
+
+		if dst != testcase.output {
+			t.Errorf("%q: expected destination image %q, got %q", testcase.input, testcase.output, dst)
+		}
+	}
+
+	data, err := DestinationDockerConfig(opts...)
+	if err != nil {
+		t.Fatalf("failed to get docker config: %v", err)
+	}
+
+	if wanted := `{"auths":{"quay.io":{"username":"foo","password":"bar"}}}`; string(data) != wanted {
+		t.Errorf("expected docker config %s, got %s", wanted, data)
+	}
+}
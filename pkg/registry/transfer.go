@@ -0,0 +1,183 @@
+package registry
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"golang.org/x/time/rate"
+)
+
+// maxBandwidthBurst is the largest number of bytes transferred at once within the bandwidth
+// limit.
+const maxBandwidthBurst = 64 * 1024
+
+// defaultTransferLimiter is shared by the calls without WithTransferLimiter, it doesn't limit
+// the transfers.
+var defaultTransferLimiter = NewTransferLimiter(0, 0, 0)
+
+// TransferLimiter limits the layers transferred by the copies of the images, i.e. the layers
+// pulled from the source registry and pushed to the destination registry. The limits are
+// shared by all the copies using the same TransferLimiter.
+type TransferLimiter struct {
+	// layers is the number of layers of a copy transferred at the same time, all of them when
+	// zero.
+	layers int
+	// copies holds a token per image being pushed, nil when not limited.
+	copies chan struct{}
+	// bandwidth limits the bytes transferred per second by all the copies, nil when not
+	// limited.
+	bandwidth *rate.Limiter
+}
+
+// NewTransferLimiter returns a TransferLimiter transferring up to layers layers of each copy at
+// the same time, pushing up to copies images at the same time and transferring up to
+// bytesPerSecond bytes per second across all the copies. Zero doesn't limit the transfers.
+func NewTransferLimiter(layers, copies int, bytesPerSecond int64) *TransferLimiter {
+	l := &TransferLimiter{layers: layers}
+
+	if copies > 0 {
+		l.copies = make(chan struct{}, copies)
+	}
+
+	if bytesPerSecond > 0 {
+		burst := maxBandwidthBurst
+		if bytesPerSecond < maxBandwidthBurst {
+			burst = int(bytesPerSecond)
+		}
+
+		l.bandwidth = rate.NewLimiter(rate.Limit(bytesPerSecond), burst)
+	}
+
+	return l
+}
+
+// WithTransferLimiter sets the limits of the layers transferred by Backup. The calls without
+// TransferLimiter don't limit the transfers.
+func WithTransferLimiter(limiter *TransferLimiter) Option {
+	return func(o *options) {
+		o.transfers = limiter
+	}
+}
+
+// startCopy waits until an image can be pushed, or the context is done. The returned copy
+// limits the transfers of its layers within the context, and must be done once the image is
+// pushed.
+func (l *TransferLimiter) startCopy(ctx context.Context) (*copyLimiter, error) {
+	if l.copies != nil {
+		select {
+		case l.copies <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	c := &copyLimiter{limiter: l, ctx: ctx}
+
+	if l.layers > 0 {
+		c.layers = make(chan struct{}, l.layers)
+	}
+
+	return c, nil
+}
+
+// copyLimiter limits the layers transferred by a copy.
+type copyLimiter struct {
+	limiter *TransferLimiter
+	ctx     context.Context
+	// layers holds a token per layer being transferred, nil when not limited.
+	layers chan struct{}
+}
+
+// done releases the copy.
+func (c *copyLimiter) done() {
+	if c.limiter.copies != nil {
+		<-c.limiter.copies
+	}
+}
+
+// layer returns the layer transferred within the limits of the copy.
+func (c *copyLimiter) layer(layer v1.Layer) v1.Layer {
+	if c.layers == nil && c.limiter.bandwidth == nil {
+		return layer
+	}
+
+	return &limitedLayer{Layer: layer, transfer: c}
+}
+
+// limitedLayer is a layer whose compressed content is read within the limits of its copy, the
+// layer being transferred until its content is closed.
+type limitedLayer struct {
+	v1.Layer
+
+	transfer *copyLimiter
+}
+
+// Compressed implements v1.Layer.
+func (l *limitedLayer) Compressed() (io.ReadCloser, error) {
+	if l.transfer.layers != nil {
+		select {
+		case l.transfer.layers <- struct{}{}:
+		case <-l.transfer.ctx.Done():
+			return nil, l.transfer.ctx.Err()
+		}
+	}
+
+	release := func() {
+		if l.transfer.layers != nil {
+			<-l.transfer.layers
+		}
+	}
+
+	rc, err := l.Layer.Compressed()
+	if err != nil {
+		release()
+
+		return nil, err
+	}
+
+	return &limitedReader{
+		ReadCloser: rc,
+		ctx:        l.transfer.ctx,
+		bandwidth:  l.transfer.limiter.bandwidth,
+		release:    release,
+	}, nil
+}
+
+type limitedReader struct {
+	io.ReadCloser
+	ctx       context.Context
+	bandwidth *rate.Limiter
+
+	once    sync.Once
+	release func()
+}
+
+// Read reads up to the bytes allowed by the bandwidth limit.
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if r.bandwidth == nil {
+		return r.ReadCloser.Read(p)
+	}
+
+	if len(p) > r.bandwidth.Burst() {
+		p = p[:r.bandwidth.Burst()]
+	}
+
+	n, err := r.ReadCloser.Read(p)
+
+	if n > 0 {
+		if waitErr := r.bandwidth.WaitN(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
+
+// Close closes the content and releases the layer.
+func (r *limitedReader) Close() error {
+	r.once.Do(r.release)
+
+	return r.ReadCloser.Close()
+}
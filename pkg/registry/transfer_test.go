@@ -0,0 +1,127 @@
+//nolint:testpackage
+package registry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// contentLayer is a layer whose only known property is its content.
+type contentLayer struct {
+	v1.Layer
+
+	content []byte
+}
+
+func (l *contentLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.content)), nil
+}
+
+func TestTransferLimiterLayers(t *testing.T) {
+	transfer, err := NewTransferLimiter(1, 0, 0).startCopy(context.Background())
+	if err != nil {
+		t.Fatalf("failed to start copy: %v", err)
+	}
+	defer transfer.done()
+
+	first, err := transfer.layer(&contentLayer{}).Compressed()
+	if err != nil {
+		t.Fatalf("failed to read layer: %v", err)
+	}
+
+	opened := make(chan io.ReadCloser)
+
+	go func() {
+		second, err := transfer.layer(&contentLayer{}).Compressed()
+		if err != nil {
+			t.Errorf("failed to read layer: %v", err)
+		}
+
+		opened <- second
+	}()
+
+	select {
+	case <-opened:
+		t.Fatalf("expected the second layer to wait for the first one")
+	case <-time.After(50 * time.Millisecond): //nolint:gomnd
+	}
+
+	first.Close()
+
+	select {
+	case second := <-opened:
+		second.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("expected the second layer to be transferred once the first one is done")
+	}
+}
+
+func TestTransferLimiterBandwidth(t *testing.T) {
+	const bytesPerSecond = 1000
+
+	transfer, err := NewTransferLimiter(0, 0, bytesPerSecond).startCopy(context.Background())
+	if err != nil {
+		t.Fatalf("failed to start copy: %v", err)
+	}
+	defer transfer.done()
+
+	rc, err := transfer.layer(&contentLayer{content: make([]byte, bytesPerSecond*3/2)}).Compressed()
+	if err != nil {
+		t.Fatalf("failed to read layer: %v", err)
+	}
+	defer rc.Close()
+
+	start := time.Now()
+
+	content, err := ioutil.ReadAll(rc)
+	if err != nil || len(content) != bytesPerSecond*3/2 {
+		t.Fatalf("failed to read layer: %v", err)
+	}
+
+	// The first second of bytes is read at once, the remaining half within the limit.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond { //nolint:gomnd
+		t.Errorf("expected the layer to be read within the bandwidth limit, read in %s", elapsed)
+	}
+}
+
+func TestTransferLimiterCancel(t *testing.T) {
+	limiter := NewTransferLimiter(0, 1, 0)
+
+	transfer, err := limiter.startCopy(context.Background())
+	if err != nil {
+		t.Fatalf("failed to start copy: %v", err)
+	}
+	defer transfer.done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// The only copy allowed is running.
+	if _, err := limiter.startCopy(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the copy to be canceled, got %v", err)
+	}
+
+	// The copy not limited starts, its layers are not transferred.
+	unlimited, err := NewTransferLimiter(0, 0, 1000).startCopy(ctx) //nolint:gomnd
+	if err != nil {
+		t.Fatalf("failed to start copy: %v", err)
+	}
+	defer unlimited.done()
+
+	rc, err := unlimited.layer(&contentLayer{content: make([]byte, 10)}).Compressed() //nolint:gomnd
+	if err != nil {
+		t.Fatalf("failed to read layer: %v", err)
+	}
+	defer rc.Close()
+
+	if _, err := ioutil.ReadAll(rc); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the transfer to be canceled, got %v", err)
+	}
+}
@@ -0,0 +1,324 @@
+// Package webhook handles the admission webhooks of the controller, backing up the images of
+// the workloads and rewriting them before the objects are persisted, and checking that they
+// only use the images of the destination registry.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	clonercontroller "github.com/impochi/cloner/pkg/controller"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// MutatePath is the path the mutating webhook is served at.
+const MutatePath = "/mutate-workloads"
+
+// FailurePolicy defines how an object is admitted when its images can't be backed up.
+type FailurePolicy string
+
+const (
+	// FailurePolicyIgnore admits the object with its original images, the controller
+	// rewrites them once the object is ready.
+	FailurePolicyIgnore FailurePolicy = "Ignore"
+	// FailurePolicyFail rejects the object.
+	FailurePolicyFail FailurePolicy = "Fail"
+)
+
+// ParseFailurePolicy parses the failure policy provided by the user.
+func ParseFailurePolicy(policy string) (FailurePolicy, error) {
+	switch FailurePolicy(policy) {
+	case FailurePolicyIgnore, FailurePolicyFail:
+		return FailurePolicy(policy), nil
+	default:
+		return "", fmt.Errorf("invalid failure policy %q, must be one of %q or %q",
+			policy, FailurePolicyIgnore, FailurePolicyFail)
+	}
+}
+
+// Mutator is a mutating admission handler that backs up the images of a workload and points
+// its containers to the destination images.
+type Mutator struct {
+	// Timeout is the time given to back up all the images of an object. It must be lower than
+	// the timeout of the webhook configuration.
+	Timeout time.Duration
+	// FailurePolicy decides how the object is admitted when the images couldn't be backed up
+	// within the Timeout.
+	FailurePolicy FailurePolicy
+	// Filter selects the workloads handled, the others are admitted unchanged.
+	Filter clonercontroller.WorkloadFilter
+	// RegistryOptions are passed to the registry when backing up the images.
+	RegistryOptions []pkgregistry.Option
+	// Credentials of the destination registry, the REGISTRY_* environment variables are used
+	// when nil or empty.
+	Credentials *pkgregistry.CredentialsStore
+	// Client reads the clone policies and namespaces.
+	Client client.Reader
+	// APIReader reads the credentials Secrets of the clone policies.
+	APIReader client.Reader
+	// Mirrors records the backed up images.
+	Mirrors *clonercontroller.MirrorRecorder
+	// Copier backs up the images, the copies of the same image being shared with the controller
+	// and the other requests. The images are backed up within the request without Copier.
+	Copier *clonercontroller.Copier
+	// PinDigests rewrites the containers to the destination images pinned by the digest
+	// backed up.
+	PinDigests bool
+
+	decoder *admission.Decoder
+}
+
+// InjectDecoder injects the decoder into the Mutator.
+func (m *Mutator) InjectDecoder(d *admission.Decoder) error {
+	m.decoder = d
+
+	return nil
+}
+
+// Handle handles the admission requests of the workloads.
+func (m *Mutator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := pkglog.FromContext(ctx).WithName("webhook").WithValues(
+		"kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name)
+
+	workload, ok := clonercontroller.WorkloadFor(req.Kind.Group, req.Kind.Kind)
+	if !ok {
+		return admission.Allowed("kind not handled")
+	}
+
+	if m.Filter.IgnoresNamespace(req.Namespace) {
+		return admission.Allowed("namespace ignored")
+	}
+
+	// The pod template of immutable kinds can only be set at creation.
+	if workload.Immutable && req.Operation != admissionv1.Create {
+		return admission.Allowed("pod template is immutable")
+	}
+
+	// Backing up the images is a side effect which must not happen for dry run requests.
+	if req.DryRun != nil && *req.DryRun {
+		return admission.Allowed("dry run")
+	}
+
+	obj := workload.New()
+	if err := m.decoder.Decode(req, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	if clonercontroller.IsOwnedByWorkload(obj) {
+		return admission.Allowed("object is updated through its owner")
+	}
+
+	if !m.Filter.Selects(obj) {
+		return admission.Allowed("object not selected")
+	}
+
+	template := workload.PodTemplate(obj)
+	if len(template.Spec.ImagePullSecrets) != 0 {
+		return admission.Allowed("object uses image pull secrets")
+	}
+
+	return m.rewrite(ctx, log, req, obj, template)
+}
+
+// rewrite backs up the images of the object within the Timeout and points its pod template to
+// the destination images.
+func (m *Mutator) rewrite(ctx context.Context, log logr.Logger, req admission.Request, obj client.Object,
+	template *corev1.PodTemplateSpec) admission.Response {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	// The namespace is not always set in the object of CREATE requests, it is only set on a
+	// copy so that it is not part of the patch.
+	namespaced, _ := obj.DeepCopyObject().(client.Object)
+	namespaced.SetNamespace(req.Namespace)
+
+	policy, err := clonercontroller.ResolvePolicy(ctx, m.Client, namespaced)
+	if err != nil {
+		return m.failed(log, err)
+	}
+
+	// Only the controller backs up the images of the workloads which are not rewritten.
+	if !policy.Rewrite() {
+		return admission.Allowed("images are only mirrored")
+	}
+
+	opts, err := registryOptions(ctx, m.APIReader, policy, m.RegistryOptions, m.Credentials)
+	if err != nil {
+		return m.failed(log, err)
+	}
+
+	// The images are backed up on a copy of the template, so that it is left untouched if the
+	// timeout is reached. The copies keep running in the Copier in that case, for the images to
+	// be available on the next attempt.
+	mutated := template.DeepCopy()
+
+	images, err := m.backupImages(pkglog.IntoContext(ctx, log), workloadReference(req), obj, mutated, opts)
+	if err != nil {
+		return m.failed(log, err)
+	}
+
+	if len(images) == 0 {
+		return admission.Allowed("images already backed up")
+	}
+
+	*template = *mutated
+
+	if err := clonercontroller.AnnotateRewrite(obj, images, time.Now()); err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	marshaled, err := json.Marshal(obj)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// failed returns the response of an object whose images couldn't be backed up, depending on
+// the FailurePolicy.
+func (m *Mutator) failed(log logr.Logger, err error) admission.Response {
+	log.Error(err, "failed to back up images", "failure policy", m.FailurePolicy)
+
+	if m.FailurePolicy == FailurePolicyFail {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	return admission.Allowed(fmt.Sprintf("images not backed up: %v", err))
+}
+
+// backupImages backs up the images of the containers of the template not skipped by the
+// object and points them to the destination images. All the copies are requested before
+// waiting for any of them, so that they run at the same time.
+func (m *Mutator) backupImages(ctx context.Context, workload *clonerv1alpha1.WorkloadReference, obj client.Object,
+	template *corev1.PodTemplateSpec, opts []pkgregistry.Option) ([]clonercontroller.BackedUpImage, error) {
+	requests, err := m.copyRequests(ctx, obj, workload, template, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []clonercontroller.BackedUpImage{}
+
+	for _, request := range requests {
+		image, err := m.backupImage(ctx, request.CopyRequest)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("timed out backing up images: %w", err)
+			}
+
+			return nil, fmt.Errorf("failed to push image %q: %w", request.Source, err)
+		}
+
+		request.container.Image = image.ContainerImage(m.PinDigests)
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+// copyRequest is the copy of the image of a container.
+type copyRequest struct {
+	container *corev1.Container
+	clonercontroller.CopyRequest
+}
+
+// copyRequests returns the copies of the images of the containers of the template not skipped
+// by the object, requesting them to the Copier right away.
+func (m *Mutator) copyRequests(ctx context.Context, obj client.Object, workload *clonerv1alpha1.WorkloadReference,
+	template *corev1.PodTemplateSpec, opts []pkgregistry.Option) ([]copyRequest, error) {
+	log := pkglog.FromContext(ctx)
+	requests := []copyRequest{}
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for index := range containers {
+			container := &containers[index]
+			if clonercontroller.SkipsContainer(obj, container.Name) {
+				continue
+			}
+
+			decision, err := clonercontroller.DecideImage(log, container.Image, opts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get destination image: %w", err)
+			}
+
+			// The disallowed images are left unchanged.
+			if decision.Action == pkgregistry.RuleActionDeny || container.Image == decision.Destination {
+				continue
+			}
+
+			request := clonercontroller.CopyRequest{
+				Workload:    workload,
+				Container:   container.Name,
+				Source:      container.Image,
+				Destination: decision.Destination,
+				Options:     opts,
+			}
+
+			if m.Copier != nil {
+				// The result is waited for by backupImages.
+				_, _, _ = m.Copier.Copy(ctx, request)
+			}
+
+			requests = append(requests, copyRequest{container: container, CopyRequest: request})
+		}
+	}
+
+	return requests, nil
+}
+
+// backupImage waits for the copy of the image by the Copier, or backs it up right away without
+// Copier. The copies to the replica registries are not waited for.
+func (m *Mutator) backupImage(ctx context.Context, request clonercontroller.CopyRequest) (
+	clonercontroller.BackedUpImage, error) {
+	if m.Copier != nil {
+		return m.Copier.Wait(ctx, request)
+	}
+
+	image, err := clonercontroller.BackupImage(ctx, m.Mirrors, request.Workload, request.Container,
+		request.Source, request.Destination, request.Options)
+	if err == nil {
+		// The replicas are copied once the request is answered, regardless of its context.
+		go clonercontroller.ReplicateImage(pkglog.IntoContext(context.Background(), pkglog.FromContext(ctx)),
+			m.Mirrors, request.Source, request.Destination, image.Digest, request.Options)
+	}
+
+	return image, err
+}
+
+// workloadReference returns the reference of the object of the request, nil when the object is
+// created with a generated name which is not known yet.
+func workloadReference(req admission.Request) *clonerv1alpha1.WorkloadReference {
+	if len(req.Name) == 0 {
+		return nil
+	}
+
+	return &clonerv1alpha1.WorkloadReference{Kind: req.Kind.Kind, Namespace: req.Namespace, Name: req.Name}
+}
+
+// registryOptions returns the options of the registry: the options of the controller, the
+// credentials of the destination registry when loaded, and the options of the clone policy.
+func registryOptions(ctx context.Context, reader client.Reader, policy *clonercontroller.Policy,
+	base []pkgregistry.Option, credentials *pkgregistry.CredentialsStore) ([]pkgregistry.Option, error) {
+	opts := append([]pkgregistry.Option{}, base...)
+	if creds := credentials.Load(); creds != nil {
+		opts = append(opts, pkgregistry.WithCredentials(creds))
+	}
+
+	policyOpts, err := policy.RegistryOptions(ctx, reader, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(opts, policyOpts...), nil
+}
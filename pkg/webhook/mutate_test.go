@@ -0,0 +1,262 @@
+package webhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	clonerv1alpha1 "github.com/impochi/cloner/pkg/apis/cloner/v1alpha1"
+	clonercontroller "github.com/impochi/cloner/pkg/controller"
+	"github.com/impochi/cloner/pkg/webhook"
+)
+
+// policyReader serves the given ClonePolicies and Deployments by name, and no other object.
+type policyReader struct {
+	policies    []clonerv1alpha1.ClonePolicy
+	deployments map[string]appsv1.Deployment
+}
+
+func (r *policyReader) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	if deployment, ok := r.deployments[key.Name]; ok {
+		if obj, ok := obj.(*appsv1.Deployment); ok {
+			deployment.DeepCopyInto(obj)
+
+			return nil
+		}
+	}
+
+	return errors.NewNotFound(schema.GroupResource{}, key.Name)
+}
+
+func (r *policyReader) List(_ context.Context, list client.ObjectList, _ ...client.ListOption) error {
+	if policies, ok := list.(*clonerv1alpha1.ClonePolicyList); ok {
+		policies.Items = r.policies
+	}
+
+	return nil
+}
+
+func newRequest(t *testing.T, namespace string, deployment *appsv1.Deployment) admission.Request {
+	raw, err := json.Marshal(deployment)
+	if err != nil {
+		t.Fatalf("failed to marshal Deployment: %v", err)
+	}
+
+	return admission.Request{
+		AdmissionRequest: admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+			Namespace: namespace,
+			Name:      deployment.Name,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+func newDeployment(image string) *appsv1.Deployment {
+	return &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx"},
+		Spec: appsv1.DeploymentSpec{
+			Template: corev1.PodTemplateSpec{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "nginx", Image: image}},
+				},
+			},
+		},
+	}
+}
+
+//nolint:funlen
+func TestMutatorHandle(t *testing.T) {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	if err != nil {
+		t.Fatalf("failed to create decoder: %v", err)
+	}
+
+	cases := []struct {
+		username      string
+		namespace     string
+		image         string
+		failurePolicy webhook.FailurePolicy
+		policies      []clonerv1alpha1.ClonePolicy
+		annotations   map[string]string
+		pullSecrets   []corev1.LocalObjectReference
+		optIn         bool
+		allowed       bool
+	}{
+		{
+			// Image already backed up.
+			username:      "foo",
+			namespace:     "default",
+			image:         "test/foo/nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			allowed:       true,
+		},
+		{
+			// Ignored namespace, the credentials are never looked up.
+			username:      "",
+			namespace:     "kube-system",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			allowed:       true,
+		},
+		{
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyIgnore,
+			allowed:       true,
+		},
+		{
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			allowed:       false,
+		},
+		{
+			// Images only mirrored by the controller, the credentials are never looked up.
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			policies: []clonerv1alpha1.ClonePolicy{{
+				ObjectMeta: metav1.ObjectMeta{Name: "mirror", Namespace: "default"},
+				Spec:       clonerv1alpha1.ClonePolicySpec{Mode: clonerv1alpha1.CloneModeMirrorOnly},
+			}},
+			allowed: true,
+		},
+		{
+			// Images not selected by the policy.
+			username:      "foo",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			policies: []clonerv1alpha1.ClonePolicy{{
+				ObjectMeta: metav1.ObjectMeta{Name: "quay", Namespace: "default"},
+				Spec: clonerv1alpha1.ClonePolicySpec{
+					Destination: &clonerv1alpha1.Destination{Repository: "test/team"},
+					Sources:     &clonerv1alpha1.Sources{Include: []string{"quay.io"}},
+				},
+			}},
+			allowed: true,
+		},
+		{
+			// Skipped workload, the credentials are never looked up.
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			annotations:   map[string]string{clonercontroller.AnnotationSkip: "true"},
+			allowed:       true,
+		},
+		{
+			// Skipped container.
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			annotations:   map[string]string{clonercontroller.AnnotationSkip: "sidecar, nginx"},
+			allowed:       true,
+		},
+		{
+			// Workload not opted in.
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			optIn:         true,
+			allowed:       true,
+		},
+		{
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			annotations:   map[string]string{clonercontroller.AnnotationEnabled: "true"},
+			optIn:         true,
+			allowed:       false,
+		},
+		{
+			// Workload using image pull secrets, left to the controller which reads them.
+			username:      "",
+			namespace:     "default",
+			image:         "nginx:1.0",
+			failurePolicy: webhook.FailurePolicyFail,
+			pullSecrets:   []corev1.LocalObjectReference{{Name: "private"}},
+			allowed:       true,
+		},
+	}
+
+	for _, testcase := range cases {
+		if err := os.Setenv("REGISTRY_PROVIDER", "test"); err != nil {
+			t.Fatalf("Failed to set env variable `REGISTRY_PROVIDER`: %q", err)
+		}
+
+		if err := os.Setenv("REGISTRY_USERNAME", testcase.username); err != nil {
+			t.Fatalf("Failed to set env variable `REGISTRY_USERNAME`: %q", err)
+		}
+
+		if err := os.Setenv("REGISTRY_PASSWORD", "bar"); err != nil {
+			t.Fatalf("Failed to set env variable `REGISTRY_PASSWORD`: %q", err)
+		}
+
+		mutator := &webhook.Mutator{
+			Timeout:       time.Second,
+			FailurePolicy: testcase.failurePolicy,
+			Filter: clonercontroller.WorkloadFilter{
+				IgnoreNamespaces: []string{"kube-system"},
+				OptIn:            testcase.optIn,
+			},
+			Client: &policyReader{policies: testcase.policies},
+		}
+
+		if err := mutator.InjectDecoder(decoder); err != nil {
+			t.Fatalf("failed to inject decoder: %v", err)
+		}
+
+		deployment := newDeployment(testcase.image)
+		deployment.Annotations = testcase.annotations
+		deployment.Spec.Template.Spec.ImagePullSecrets = testcase.pullSecrets
+
+		resp := mutator.Handle(context.TODO(), newRequest(t, testcase.namespace, deployment))
+
+		if resp.Allowed != testcase.allowed {
+			t.Errorf("image %q in namespace %q: expected allowed to be %t, got %t",
+				testcase.image, testcase.namespace, testcase.allowed, resp.Allowed)
+		}
+
+		if len(resp.Patches) != 0 {
+			t.Errorf("image %q in namespace %q: expected no patches, got %v",
+				testcase.image, testcase.namespace, resp.Patches)
+		}
+	}
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	if _, err := webhook.ParseFailurePolicy("Ignore"); err != nil {
+		t.Errorf("expected `Ignore` to be valid: %v", err)
+	}
+
+	if _, err := webhook.ParseFailurePolicy("Fail"); err != nil {
+		t.Errorf("expected `Fail` to be valid: %v", err)
+	}
+
+	if _, err := webhook.ParseFailurePolicy("Retry"); err == nil {
+		t.Errorf("expected `Retry` to be invalid")
+	}
+}
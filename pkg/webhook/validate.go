@@ -0,0 +1,261 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-logr/logr"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	pkglog "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	clonercontroller "github.com/impochi/cloner/pkg/controller"
+	"github.com/impochi/cloner/pkg/metrics"
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+)
+
+// ValidatePath is the path the validating webhook is served at.
+const ValidatePath = "/validate-workloads"
+
+// ValidationMode defines what is done with the workloads whose images are not in the
+// destination registry.
+type ValidationMode string
+
+const (
+	// ValidationModeEnforce rejects the workloads.
+	ValidationModeEnforce ValidationMode = "enforce"
+	// ValidationModeAudit admits the workloads with a warning.
+	ValidationModeAudit ValidationMode = "audit"
+)
+
+// ParseValidationMode parses the validation mode provided by the user, empty when the
+// validating webhook is disabled.
+func ParseValidationMode(mode string) (ValidationMode, error) {
+	switch ValidationMode(mode) {
+	case "", ValidationModeEnforce, ValidationModeAudit:
+		return ValidationMode(mode), nil
+	default:
+		return "", fmt.Errorf("invalid validation mode %q, must be one of %q or %q",
+			mode, ValidationModeEnforce, ValidationModeAudit)
+	}
+}
+
+// Validator is a validating admission handler that checks that the images of a workload are
+// in the destination registry. The images skipped by the source rules are trusted as well. The
+// protected namespaces are selected by the namespace selector of the webhook configuration.
+type Validator struct {
+	// Mode decides whether the workloads using other images are rejected or only warned about.
+	Mode ValidationMode
+	// IgnoreNamespaces are the namespaces whose workloads are always admitted.
+	IgnoreNamespaces []string
+	// RegistryOptions are passed to the registry when naming the destination images.
+	RegistryOptions []pkgregistry.Option
+	// Credentials of the destination registry, the REGISTRY_* environment variables are used
+	// when nil or empty.
+	Credentials *pkgregistry.CredentialsStore
+	// Client reads the clone policies, namespaces and owners of the workloads.
+	Client client.Reader
+	// APIReader reads the credentials Secrets of the clone policies.
+	APIReader client.Reader
+
+	decoder *admission.Decoder
+}
+
+// registryOptions returns the options of the registry with the clone policy applying to the
+// object.
+func (v *Validator) registryOptions(ctx context.Context, obj client.Object) ([]pkgregistry.Option, error) {
+	policy, err := clonercontroller.ResolvePolicy(ctx, v.Client, obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return registryOptions(ctx, v.APIReader, policy, v.RegistryOptions, v.Credentials)
+}
+
+// admittedThroughOwner reports whether the object is controlled by an existing workload with
+// the same images, e.g. a ReplicaSet created by an admitted Deployment. An owner reference to
+// a missing workload, or to a workload with other images, doesn't bypass the validation.
+func (v *Validator) admittedThroughOwner(ctx context.Context, obj client.Object,
+	template *corev1.PodTemplateSpec) (bool, error) {
+	if !clonercontroller.IsOwnedByWorkload(obj) {
+		return false, nil
+	}
+
+	ref := metav1.GetControllerOf(obj)
+
+	ownerGV, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return false, nil
+	}
+
+	ownerWorkload, _ := clonercontroller.WorkloadFor(ownerGV.Group, ref.Kind)
+	owner := ownerWorkload.New()
+
+	err = v.Client.Get(ctx, types.NamespacedName{Namespace: obj.GetNamespace(), Name: ref.Name}, owner)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to get owner %s %s: %w", ref.Kind, ref.Name, err)
+	}
+
+	if owner.GetUID() != ref.UID {
+		return false, nil
+	}
+
+	ownerImages := map[string]bool{}
+	for _, image := range templateImages(ownerWorkload.PodTemplate(owner)) {
+		ownerImages[image] = true
+	}
+
+	for _, image := range templateImages(template) {
+		if !ownerImages[image] {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// templateImages returns the images of the init containers and of the containers of the
+// template.
+func templateImages(template *corev1.PodTemplateSpec) []string {
+	images := []string{}
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for _, container := range containers {
+			images = append(images, container.Image)
+		}
+	}
+
+	return images
+}
+
+// InjectDecoder injects the decoder into the Validator.
+func (v *Validator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+
+	return nil
+}
+
+// Handle handles the admission requests of the workloads.
+func (v *Validator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	log := pkglog.FromContext(ctx).WithName("validating-webhook").WithValues(
+		"kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name)
+
+	workload, ok := clonercontroller.WorkloadFor(req.Kind.Group, req.Kind.Kind)
+	if !ok {
+		return admission.Allowed("kind not handled")
+	}
+
+	filter := clonercontroller.WorkloadFilter{IgnoreNamespaces: v.IgnoreNamespaces}
+	if filter.IgnoresNamespace(req.Namespace) {
+		return admission.Allowed("namespace ignored")
+	}
+
+	// The pod template of immutable kinds can only be set at creation, the objects created
+	// before the validation must still be updatable.
+	if workload.Immutable && req.Operation != admissionv1.Create {
+		return admission.Allowed("pod template is immutable")
+	}
+
+	obj := workload.New()
+	if err := v.decoder.Decode(req, obj); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// The namespace is not always set in the object of CREATE requests.
+	obj.SetNamespace(req.Namespace)
+
+	owned, err := v.admittedThroughOwner(ctx, obj, workload.PodTemplate(obj))
+	if err != nil {
+		return v.failed(log, err)
+	}
+
+	if owned {
+		return admission.Allowed("object is validated through its owner")
+	}
+
+	opts, err := v.registryOptions(ctx, obj)
+	if err != nil {
+		return v.failed(log, err)
+	}
+
+	violations := violations(log, workload.PodTemplate(obj), opts)
+	if len(violations) == 0 {
+		return admission.Allowed("images in the destination registry")
+	}
+
+	metrics.AdmissionViolations(req.Kind.Kind, string(v.Mode), len(violations))
+
+	if v.Mode == ValidationModeAudit {
+		log.Info("admitting images not in the destination registry", "violations", violations)
+
+		return admission.Allowed("audit mode").WithWarnings(violations...)
+	}
+
+	log.Info("rejecting images not in the destination registry", "violations", violations)
+
+	return admission.Denied(strings.Join(violations, "; "))
+}
+
+// failed returns the response of an object whose images couldn't be validated, rejected in
+// enforce mode.
+func (v *Validator) failed(log logr.Logger, err error) admission.Response {
+	log.Error(err, "failed to validate images", "mode", v.Mode)
+
+	if v.Mode == ValidationModeAudit {
+		return admission.Allowed("audit mode").WithWarnings(fmt.Sprintf("images not validated: %v", err))
+	}
+
+	return admission.Errored(http.StatusInternalServerError, err)
+}
+
+// violations returns the messages of the images of the template which are not in the
+// destination registry, with the destination image to use instead for the mirrored images.
+func violations(log logr.Logger, template *corev1.PodTemplateSpec, opts []pkgregistry.Option) []string {
+	messages := []string{}
+
+	for _, containers := range [][]corev1.Container{template.Spec.InitContainers, template.Spec.Containers} {
+		for _, container := range containers {
+			decision, err := clonercontroller.DecideImage(log, container.Image, opts)
+			if err != nil {
+				messages = append(messages, fmt.Sprintf("image %s of container %s: %v", container.Image,
+					container.Name, err))
+
+				continue
+			}
+
+			if decision.Trusted {
+				continue
+			}
+
+			message := ""
+
+			switch decision.Action {
+			case pkgregistry.RuleActionMirror:
+				message = fmt.Sprintf("image %s of container %s is not in the destination registry, use %s instead",
+					container.Image, container.Name, decision.Destination)
+			case pkgregistry.RuleActionDeny:
+				message = fmt.Sprintf("image %s of container %s is not allowed: %s", container.Image,
+					container.Name, decision.Reason)
+			case pkgregistry.RuleActionSkip:
+				message = fmt.Sprintf("image %s of container %s is not in the destination registry: %s",
+					container.Image, container.Name, decision.Reason)
+			}
+
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
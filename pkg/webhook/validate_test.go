@@ -0,0 +1,192 @@
+package webhook_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	pkgregistry "github.com/impochi/cloner/pkg/registry"
+	"github.com/impochi/cloner/pkg/webhook"
+)
+
+//nolint:funlen
+func TestValidatorHandle(t *testing.T) {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	if err != nil {
+		t.Fatalf("failed to create decoder: %v", err)
+	}
+
+	rules, err := pkgregistry.ParseSourceRules("skip=registry.example.com;deny=docker.io/untrusted")
+	if err != nil {
+		t.Fatalf("failed to parse source rules: %v", err)
+	}
+
+	cases := []struct {
+		namespace string
+		image     string
+		mode      webhook.ValidationMode
+		allowed   bool
+		// message is expected in the message of a rejection, or the warnings of an admission.
+		message string
+	}{
+		{
+			namespace: "default",
+			image:     "test/foo/nginx:1.0",
+			mode:      webhook.ValidationModeEnforce,
+			allowed:   true,
+		},
+		{
+			namespace: "default",
+			image:     "nginx:1.0",
+			mode:      webhook.ValidationModeEnforce,
+			allowed:   false,
+			message:   "use test/foo/nginx:1.0 instead",
+		},
+		{
+			namespace: "default",
+			image:     "nginx:1.0",
+			mode:      webhook.ValidationModeAudit,
+			allowed:   true,
+			message:   "use test/foo/nginx:1.0 instead",
+		},
+		{
+			// Skipped by the source rules.
+			namespace: "default",
+			image:     "registry.example.com/platform/app:1.0",
+			mode:      webhook.ValidationModeEnforce,
+			allowed:   true,
+		},
+		{
+			namespace: "default",
+			image:     "untrusted/miner:latest",
+			mode:      webhook.ValidationModeEnforce,
+			allowed:   false,
+			message:   "is not allowed",
+		},
+		{
+			// Ignored namespace.
+			namespace: "kube-system",
+			image:     "nginx:1.0",
+			mode:      webhook.ValidationModeEnforce,
+			allowed:   true,
+		},
+	}
+
+	for _, testcase := range cases {
+		validator := &webhook.Validator{
+			Mode:             testcase.mode,
+			IgnoreNamespaces: []string{"kube-system"},
+			RegistryOptions: []pkgregistry.Option{
+				pkgregistry.WithCredentials(&pkgregistry.Credentials{Provider: "test", Username: "foo", Password: "bar"}),
+				pkgregistry.WithSourceRules(rules),
+			},
+			Client:    &policyReader{},
+			APIReader: &policyReader{},
+		}
+
+		if err := validator.InjectDecoder(decoder); err != nil {
+			t.Fatalf("failed to inject decoder: %v", err)
+		}
+
+		resp := validator.Handle(context.Background(), newRequest(t, testcase.namespace, newDeployment(testcase.image)))
+
+		if resp.Allowed != testcase.allowed {
+			t.Errorf("%q in %s mode: expected allowed to be %t, got %t: %v", testcase.image, testcase.mode,
+				testcase.allowed, resp.Allowed, resp.Result)
+		}
+
+		messages := strings.Join(resp.Warnings, "; ")
+		if resp.Result != nil {
+			messages += string(resp.Result.Reason)
+		}
+
+		if !strings.Contains(messages, testcase.message) {
+			t.Errorf("%q in %s mode: expected %q in %q", testcase.image, testcase.mode, testcase.message, messages)
+		}
+
+		if len(testcase.message) == 0 && len(resp.Warnings) != 0 {
+			t.Errorf("%q in %s mode: unexpected warnings %v", testcase.image, testcase.mode, resp.Warnings)
+		}
+	}
+}
+
+//nolint:funlen
+func TestValidatorHandleOwned(t *testing.T) {
+	decoder, err := admission.NewDecoder(scheme.Scheme)
+	if err != nil {
+		t.Fatalf("failed to create decoder: %v", err)
+	}
+
+	owner := func(uid types.UID, image string) appsv1.Deployment {
+		deployment := newDeployment(image)
+		deployment.Name = "owner"
+		deployment.UID = uid
+
+		return *deployment
+	}
+
+	controllerRef := true
+
+	cases := []struct {
+		name    string
+		owners  map[string]appsv1.Deployment
+		allowed bool
+	}{
+		{
+			name:    "missing owner",
+			allowed: false,
+		},
+		{
+			name:    "owner with the same images",
+			owners:  map[string]appsv1.Deployment{"owner": owner("owner-uid", "nginx:1.0")},
+			allowed: true,
+		},
+		{
+			name:    "owner with other images",
+			owners:  map[string]appsv1.Deployment{"owner": owner("owner-uid", "test/foo/nginx:1.0")},
+			allowed: false,
+		},
+		{
+			name:    "recreated owner",
+			owners:  map[string]appsv1.Deployment{"owner": owner("other-uid", "nginx:1.0")},
+			allowed: false,
+		},
+	}
+
+	for _, testcase := range cases {
+		validator := &webhook.Validator{
+			Mode: webhook.ValidationModeEnforce,
+			RegistryOptions: []pkgregistry.Option{
+				pkgregistry.WithCredentials(&pkgregistry.Credentials{Provider: "test", Username: "foo", Password: "bar"}),
+			},
+			Client:    &policyReader{deployments: testcase.owners},
+			APIReader: &policyReader{},
+		}
+
+		if err := validator.InjectDecoder(decoder); err != nil {
+			t.Fatalf("failed to inject decoder: %v", err)
+		}
+
+		owned := newDeployment("nginx:1.0")
+		owned.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Name:       "owner",
+			UID:        "owner-uid",
+			Controller: &controllerRef,
+		}}
+
+		resp := validator.Handle(context.Background(), newRequest(t, "default", owned))
+
+		if resp.Allowed != testcase.allowed {
+			t.Errorf("%s: expected allowed to be %t, got %t: %v", testcase.name, testcase.allowed, resp.Allowed,
+				resp.Result)
+		}
+	}
+}